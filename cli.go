@@ -0,0 +1,258 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	dbpkg "sudocrypt25/db"
+	"sudocrypt25/handlers"
+)
+
+const usage = `usage: sudocrypt25 [command]
+
+With no command the server starts.
+
+commands:
+  backup [dir]             write a verified snapshot of the database
+  backups [dir]            list snapshots
+  check [file]             run an integrity check on a database file
+  restore <snapshot> [db]  replace the database with a snapshot (stop the server first)
+  export [-sections a,b] <file>
+                           write an event bundle (levels, hints, announcements,
+                           accounts, solves, messages, logs, attempts)
+  import [-mode skip|overwrite|fail] [-sections a,b] <file>
+                           apply an event bundle
+  levels export <track> <file>
+                           write a track as a level file
+  levels import [-dry-run] [-prune] <file>
+                           sync a track with a level file in one transaction;
+                           -prune deletes levels and hints the file leaves out
+`
+
+func runCommand(args []string) int {
+	switch args[0] {
+	case "backup", "backups":
+		d, err := dbpkg.Open(os.Getenv("DB_DRIVER"), os.Getenv("DB_DSN"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer d.Close()
+		dir := os.Getenv("BACKUP_DIR")
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		keep, _ := strconv.Atoi(os.Getenv("BACKUP_KEEP"))
+		b := dbpkg.NewBackups(d, dir, keep)
+		if args[0] == "backups" {
+			list, err := b.List()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			for _, info := range list {
+				fmt.Printf("%s\t%d\n", info.Path, info.Size)
+			}
+			return 0
+		}
+		info, err := b.Run()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(info.Path)
+		return 0
+	case "check":
+		path := dbpkg.SQLitePath(os.Getenv("DB_DSN"))
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := dbpkg.IntegrityCheck(path); err != nil {
+			fmt.Fprintln(os.Stderr, path+":", err)
+			return 1
+		}
+		fmt.Println(path + ": ok")
+		return 0
+	case "restore":
+		if len(args) < 2 {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		dst := dbpkg.SQLitePath(os.Getenv("DB_DSN"))
+		if len(args) > 2 {
+			dst = args[2]
+		}
+		saved, err := dbpkg.Restore(args[1], dst)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if saved != "" {
+			fmt.Println("previous database moved to", saved)
+		}
+		fmt.Println("restored", args[1], "to", dst)
+		return 0
+	case "export", "import":
+		return runBundle(args)
+	case "levels":
+		return runLevels(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return 2
+}
+
+func runBundle(args []string) int {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	sections := fs.String("sections", "", "comma separated sections, default all")
+	mode := fs.String("mode", "skip", "conflict mode for import: skip, overwrite or fail")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	var list []string
+	for _, s := range strings.Split(*sections, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	d, err := dbpkg.Open(os.Getenv("DB_DRIVER"), os.Getenv("DB_DSN"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer d.Close()
+	if err := dbpkg.InitDB(d); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	path := fs.Arg(0)
+	if args[0] == "export" {
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := dbpkg.ExportBundle(d, f, list); err != nil {
+			f.Close()
+			os.Remove(path)
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := f.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("wrote", path)
+		return 0
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	res, err := dbpkg.ImportBundle(d, f, st.Size(), dbpkg.ImportOptions{Mode: dbpkg.ImportMode(*mode), Sections: list})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, s := range dbpkg.BundleSections {
+		if r, ok := res.Sections[s]; ok {
+			fmt.Printf("%-14s inserted %d, updated %d, skipped %d\n", s, r.Inserted, r.Updated, r.Skipped)
+		}
+	}
+	return 0
+}
+
+func runLevels(args []string) int {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	fs := flag.NewFlagSet("levels "+args[0], flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "show the changes without writing them")
+	prune := fs.Bool("prune", false, "delete levels and hints missing from the file")
+	want := 1
+	if args[0] == "export" {
+		want = 2
+	}
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != want {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	d, err := dbpkg.Open(os.Getenv("DB_DRIVER"), os.Getenv("DB_DSN"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer d.Close()
+	if err := dbpkg.InitDB(d); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	handlers.InitTracks(d)
+	if args[0] == "export" {
+		lf, err := handlers.ExportLevelFile(d, fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		out, err := os.Create(fs.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		err = handlers.WriteLevelFile(out, lf)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("wrote", fs.Arg(1))
+		return 0
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	lf, err := handlers.ParseLevelFile(f)
+	f.Close()
+	if errs, ok := err.(handlers.LevelFileErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, fs.Arg(0)+":", e)
+		}
+		return 1
+	}
+	res, err := handlers.SyncLevelFile(d, lf, handlers.LevelSyncOptions{Prune: *prune, DryRun: *dryRun})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, c := range res.Changes {
+		if c.Action == "unchanged" {
+			continue
+		}
+		fmt.Printf("%-7s %s %s\n", c.Action, c.Level, strings.Join(c.Fields, ","))
+		for _, h := range c.Hints {
+			fmt.Printf("  %-7s hint %s %s\n", h.Action, h.ID, strings.Join(h.Fields, ","))
+		}
+	}
+	if *dryRun {
+		fmt.Println("dry run, nothing written")
+	}
+	return 0
+}
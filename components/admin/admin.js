@@ -40,6 +40,7 @@ function openPopup(levelNumber) {
         displayEl.value = ""
         sourceHintField.value = ''
         answerField.value = ''
+        setAnswerSpecFields(null)
         if (walkthroughField) walkthroughField.value = ''
         const walkthroughPartsContainer = document.getElementById('walkthroughParts');
         if (walkthroughPartsContainer) {
@@ -58,7 +59,9 @@ function openPopup(levelNumber) {
         updateDisplay()
     } else {
         sourceHintField.value = levelsData[levelNumber]["sourcehint"]
-        answerField.value = levelsData[levelNumber]["answer"]
+        answerField.value = ''
+        setAnswerSpecFields(levelsData[levelNumber]["answer_spec"])
+        loadNearMisses(levelNumber)
         inputEl.value = levelsData[levelNumber]["markup"]
         try {
             const raw = levelsData[levelNumber]["walkthrough"] || '';
@@ -90,6 +93,69 @@ function openPopup(levelNumber) {
     }
 }
 
+function setAnswerSpecFields(spec) {
+    const specEl = document.getElementById('answerSpecField')
+    if (specEl) specEl.value = spec ? JSON.stringify(spec, null, 2) : ''
+    const testEl = document.getElementById('answerTestField')
+    if (testEl) testEl.value = ''
+    const out = document.getElementById('answerTestResults')
+    if (out) out.innerHTML = ''
+    const near = document.getElementById('nearMisses')
+    if (near) near.innerHTML = ''
+}
+
+// loadNearMisses lists how often submissions hit each of the level's close
+// patterns.
+// Staff without logs.read get a 403 and see nothing.
+async function loadNearMisses(levelId) {
+    const near = document.getElementById('nearMisses')
+    if (!near) return
+    const res = await fetch('/api/admin/levels/close?level=' + encodeURIComponent(levelId), { credentials: 'same-origin' }).catch(() => null)
+    if (!res || !res.ok) return
+    const data = await res.json()
+    const list = data.near_misses || []
+    if (list.length === 0) return
+    near.innerHTML = '<p class="form-label">Near misses</p>' + list.map(m => `<div>${escapeHtml(m.pattern)} × ${m.count} (${m.players} players)</div>`).join('')
+}
+
+// revealAnswers fetches the sealed answers of the open level into the form.
+// Each reveal is audited.
+async function revealAnswers() {
+    const levelId = document.getElementById("levelId").value.trim()
+    if (!levelsData[levelId]) { if (notyf) notyf.error('Save the level first'); return }
+    const res = await fetch('/api/admin/levels/reveal', { method: 'POST', credentials: 'same-origin', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ level: levelId }) }).catch(() => null)
+    if (!res || !res.ok) { if (notyf) notyf.error(res ? await res.text() : 'Failed'); return }
+    const data = await res.json()
+    answerField.value = data.answer || ''
+    const spec = readAnswerSpec() || {}
+    spec.accept = data.accept || []
+    spec.regex = data.regex || ''
+    const specEl = document.getElementById('answerSpecField')
+    if (specEl) specEl.value = JSON.stringify(spec, null, 2)
+}
+
+// readAnswerSpec returns the spec typed in the form, {} when empty, or
+// undefined if it is not valid JSON.
+function readAnswerSpec() {
+    const specEl = document.getElementById('answerSpecField')
+    const raw = specEl ? specEl.value.trim() : ''
+    if (raw === '') return {}
+    try { return JSON.parse(raw) } catch(e) { return undefined }
+}
+
+async function testAnswers() {
+    const out = document.getElementById('answerTestResults')
+    const spec = readAnswerSpec()
+    if (spec === undefined) { if (notyf) notyf.error('Answer spec is not valid JSON'); return }
+    var levelId = document.getElementById("levelId").value.trim()
+    if (/^[0-9]+$/.test(levelId)) levelId = adminDefaultTrack + "-" + levelId
+    const candidates = (document.getElementById('answerTestField').value || '').split('\n').filter(x => x.trim() !== '')
+    const res = await fetch('/api/admin/levels/test', { method: 'POST', credentials: 'same-origin', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ level: levelId, candidates: candidates, answer: answerField.value.trim(), answer_spec: spec }) }).catch(() => null)
+    if (!res || !res.ok) { if (notyf) notyf.error(res ? await res.text() : 'Failed'); return }
+    const data = await res.json()
+    if (out) out.innerHTML = (data.results || []).map(r => `<div style="color:${r.correct ? '#6c6' : r.close ? '#cc6' : '#c66'}">${r.correct ? '✓' : r.close ? '~' : '✗'} ${escapeHtml(r.candidate)} → ${escapeHtml(r.normalized)}${r.reason ? ' (' + escapeHtml(r.reason) + ')' : ''}</div>`).join('')
+}
+
 function closePopup() {
     popupContainer.style.display = 'none';
 }
@@ -106,12 +172,15 @@ function submitForm() {
     } catch(e) { walkthrough = JSON.stringify([]); }
     var levelId = document.getElementById("levelId").value.trim()
     if (/^[0-9]+$/.test(levelId)) {
-        levelId = "cryptic-" + levelId
+        levelId = adminDefaultTrack + "-" + levelId
     }
     if (levelId === "") {
-        levelId = "cryptic-0"
+        levelId = adminDefaultTrack + "-0"
     }
-    fetch("/set_level?source=" + encodeURIComponent(sourceHint) + "&answer=" + encodeURIComponent(answer) + "&markup=" + encodeURIComponent(inputEl.value.trim()) + "&walkthrough=" + encodeURIComponent(walkthrough) + "&levelid=" + String(levelId)).then((x) => {
+    const answerSpec = readAnswerSpec()
+    if (answerSpec === undefined) { if (notyf) notyf.error('Answer spec is not valid JSON'); return }
+    fetch("/set_level", { method: "POST", credentials: "same-origin", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ source: sourceHint, answer: answer, answer_spec: answerSpec, markup: inputEl.value.trim(), walkthrough: walkthrough, levelid: String(levelId) }) }).then(async (x) => {
+        if (!x.ok) { if (notyf) notyf.error(await x.text()); return }
         window.location = "/admin"
     })
 }
@@ -151,12 +220,12 @@ else window.addEventListener('load', function(){ const b = document.getElementBy
 function deleteLevel() {
     var levelId = document.getElementById("levelId").value.trim()
     if (/^[0-9]+$/.test(levelId)) {
-        levelId = "cryptic-" + levelId
+        levelId = adminDefaultTrack + "-" + levelId
     }
     if (levelId === "") {
-        levelId = "cryptic-0"
+        levelId = adminDefaultTrack + "-0"
     }
-    fetch("/delete_level?level=" + encodeURIComponent(levelId)).then(() => {
+    fetch("/delete_level", { method: "POST", credentials: "same-origin", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ level: levelId }) }).then(() => {
         window.location = "/admin"
     })
 }
@@ -243,6 +312,22 @@ if (_toggleAI) {
     })
 }
 
+let adminTrackNames = null
+let adminDefaultTrack = 'cryptic'
+
+async function loadAdminTracks() {
+    if (adminTrackNames) return adminTrackNames
+    adminTrackNames = {}
+    try {
+        const res = await fetch('/api/tracks', {credentials: 'same-origin'})
+        const list = res.ok ? await res.json() : []
+        list.forEach(t => { adminTrackNames[t.id] = t.name })
+        if (list.length > 0) adminDefaultTrack = list[0].id
+    } catch(e) {}
+    return adminTrackNames
+}
+loadAdminTracks()
+
 async function fetchAdminUsers() {
     try {
         const res = await fetch('/api/admin/users', {credentials: 'same-origin'})
@@ -255,8 +340,20 @@ async function fetchAdminUsers() {
 function renderAdminUser(u) {
     const email = u.email || ''
     const name = u.name || ''
-    const cryptic = (typeof u.cryptic === 'number') ? u.cryptic : 0
-    const ctf = (typeof u.ctf === 'number') ? u.ctf : 0
+    const levels = u.levels || {}
+    const trackIds = Object.keys(levels)
+    const trackName = id => (adminTrackNames && adminTrackNames[id]) || id
+    const levelLine = trackIds.map(id => `Current ${escapeHtml(trackName(id))} Level: ${levels[id]}`).join(' &nbsp; • &nbsp; ')
+    const resets = trackIds.map((id, i) => `<button class="btn-primary user-reset-track" data-email="${escapeHtml(email)}" data-track="${escapeHtml(id)}"${i > 0 ? ' style="background:#444"' : ''}>Reset ${escapeHtml(trackName(id))} lvl</button>`).join('')
+    const sanctions = u.sanctions || {}
+    const badges = Object.keys(sanctions).map(k => {
+        const sn = sanctions[k]
+        const until = sn.expires_at ? ' until ' + new Date(sn.expires_at * 1000).toLocaleString() : ''
+        return `<span title="${escapeHtml(sn.reason || '')}" style="padding:2px 6px;border-radius:4px;background:#7a1a1a;font-size:11px">${escapeHtml(k + until)}</span>`
+    }).join(' ')
+    const toggle = (kind, on, off, label) => sanctions[kind]
+        ? `<button class="btn-primary user-sanction" data-email="${escapeHtml(email)}" data-action="${off}" style="background:#444">Undo ${label}</button>`
+        : `<button class="btn-primary user-sanction" data-email="${escapeHtml(email)}" data-action="${on}" style="background:#444">${label.charAt(0).toUpperCase() + label.slice(1)}</button>`
     const el = document.createElement('div')
     el.style.padding = '12px'
     el.style.borderRadius = '8px'
@@ -268,11 +365,16 @@ function renderAdminUser(u) {
         <div style="flex:1">
             <div style="font-size:14px;color:rgba(255,255,255,0.9);font-weight:600">${escapeHtml(name) || escapeHtml(email)}</div>
             <div style="font-size:12px;color:rgba(255,255,255,0.6)">${escapeHtml(email)}</div>
-            <div style="margin-top:6px;font-size:13px;color:rgba(255,255,255,0.8)">Current Cryptic Level: ${cryptic} &nbsp; • &nbsp; Current CTF Level: ${ctf}</div>
+            <div style="margin-top:6px;font-size:13px;color:rgba(255,255,255,0.8)">${levelLine}</div>
+            ${badges ? `<div style="margin-top:6px;display:flex;gap:4px;flex-wrap:wrap">${badges}</div>` : ''}
         </div>
         <div style="display:flex;flex-direction:column;gap:6px;margin-left:12px">
-            <button class="btn-primary user-reset-cryptic" data-email="${escapeHtml(email)}">Reset cryptic lvl</button>
-            <button class="btn-primary user-reset-ctf" data-email="${escapeHtml(email)}" style="background:#444">Reset CTF lvl</button>
+            ${resets}
+            ${toggle('disqualified', 'disqualify', 'reinstate', 'disqualify')}
+            ${toggle('suspended', 'suspend', 'unsuspend', 'suspend')}
+            ${toggle('muted', 'mute', 'unmute', 'mute')}
+            ${toggle('hidden', 'hide', 'unhide', 'hide')}
+            <button class="btn-primary user-view-as" data-email="${escapeHtml(email)}" style="background:#444">View as player</button>
             <button class="btn-primary user-delete" data-email="${escapeHtml(email)}" style="background:#7a1a1a">Delete user</button>
         </div>
     `
@@ -283,6 +385,7 @@ async function reloadAdminUsers() {
     const container = document.getElementById('adminUsersList')
     if (!container) return
     container.innerHTML = ''
+    await loadAdminTracks()
     const list = await fetchAdminUsers()
     if (!list || list.length === 0) {
         container.innerHTML = '<div style="color:rgba(255,255,255,0.6)">No users found</div>'
@@ -293,9 +396,9 @@ async function reloadAdminUsers() {
     }
 }
 
-async function postAdminUserAction(email, action) {
+async function postAdminUserAction(email, action, extra) {
     try {
-        const res = await fetch('/api/admin/user', {method: 'POST', credentials: 'same-origin', headers: {'Content-Type':'application/json'}, body: JSON.stringify({email: email, action: action})})
+        const res = await fetch('/api/admin/user', {method: 'POST', credentials: 'same-origin', headers: {'Content-Type':'application/json'}, body: JSON.stringify(Object.assign({email: email, action: action}, extra || {}))})
         return res && res.ok
     } catch(e) { return false }
 }
@@ -324,20 +427,38 @@ function showAdminConfirm(message) {
 document.addEventListener('click', async function(e){
     const t = e.target
     if (t && t.classList) {
-        if (t.classList.contains('user-reset-cryptic')) {
+        if (t.classList.contains('user-reset-track')) {
             const email = t.getAttribute('data-email')
-            if (!email) return
+            const track = t.getAttribute('data-track')
+            if (!email || !track) return
             t.disabled = true
-            const ok = await postAdminUserAction(email, 'reset_cryptic')
+            const ok = await postAdminUserAction(email, 'reset_' + track)
             t.disabled = false
-            if (ok) { if (notyf) notyf.success('Reset cryptic level'); reloadAdminUsers() } else { if (notyf) notyf.error('Failed') }
-        } else if (t.classList.contains('user-reset-ctf')) {
+            if (ok) { if (notyf) notyf.success('Reset ' + ((adminTrackNames && adminTrackNames[track]) || track) + ' level'); reloadAdminUsers() } else { if (notyf) notyf.error('Failed') }
+        } else if (t.classList.contains('user-view-as')) {
             const email = t.getAttribute('data-email')
             if (!email) return
+            const res = await fetch('/api/admin/view_as', {method: 'POST', credentials: 'same-origin', headers: {'Content-Type':'application/json'}, body: JSON.stringify({email: email})}).catch(() => null)
+            if (res && res.ok) { window.location.href = '/play' } else { if (notyf) notyf.error(res ? (await res.text()) : 'Failed') }
+        } else if (t.classList.contains('user-sanction')) {
+            const email = t.getAttribute('data-email')
+            const action = t.getAttribute('data-action')
+            if (!email || !action) return
+            const extra = {}
+            if (['disqualify', 'suspend', 'mute', 'hide'].includes(action)) {
+                const reason = prompt('Reason shown to ' + email + ' (optional)')
+                if (reason === null) return
+                extra.reason = reason
+            }
+            if (action === 'suspend' || action === 'mute') {
+                const d = prompt('For how long? e.g. 24h' + (action === 'mute' ? ' (blank for until lifted)' : ''), action === 'suspend' ? '24h' : '')
+                if (d === null) return
+                if (d.trim()) extra.duration = d.trim()
+            }
             t.disabled = true
-            const ok = await postAdminUserAction(email, 'reset_ctf')
+            const ok = await postAdminUserAction(email, action, extra)
             t.disabled = false
-            if (ok) { if (notyf) notyf.success('Reset CTF level'); reloadAdminUsers() } else { if (notyf) notyf.error('Failed') }
+            if (ok) { if (notyf) notyf.success('Done'); reloadAdminUsers() } else { if (notyf) notyf.error('Failed') }
         } else if (t.classList.contains('user-delete')) {
             const email = t.getAttribute('data-email')
             if (!email) return
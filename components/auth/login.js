@@ -8,9 +8,13 @@ const submitBtn = document.getElementById('submit')
 const otpContainer = document.getElementById('otpform_container')
 const inputListEl = document.getElementById('inputList')
 const authTxt = document.getElementById('authTxt')
+const forgotEl = document.getElementById('forgotPassword')
+const mfaEl = document.getElementById('mfaCode')
+const resetToken = new URLSearchParams(window.location.search || '').get('reset_token')
 const otpInputs = () => Array.from(document.querySelectorAll('.otp-input'))
-let mode = 'signup'
+let mode = resetToken ? 'reset' : 'signup'
 let pending = {}
+let mfaToken = ''
 function readOtp() {
     return otpInputs().map(i => i.value || '').join('')
 }
@@ -20,6 +24,33 @@ function showToast(msg, ok = true) {
     }
 }
 function updateUI() {
+    forgotEl && (forgotEl.style.display = mode === 'login' ? '' : 'none')
+    mfaEl && (mfaEl.style.display = mode === 'mfa' ? '' : 'none')
+    if (mode === 'mfa') {
+        modeToggle && (modeToggle.style.display = 'none')
+        submitBtn && (submitBtn.textContent = 'Verify')
+        authTxt && (authTxt.textContent = 'Two-Factor')
+        nameEl && (nameEl.style.display = 'none')
+        phoneEl && (phoneEl.style.display = 'none')
+        emailEl && (emailEl.style.display = 'none')
+        passEl && (passEl.style.display = 'none')
+        mfaEl && setTimeout(() => mfaEl.focus(), 100)
+        return
+    }
+    passEl && (passEl.style.display = '')
+    if (mode === 'reset') {
+        modeToggle && (modeToggle.style.display = 'none')
+        submitBtn && (submitBtn.textContent = 'Set Password')
+        authTxt && (authTxt.textContent = 'Reset Password')
+        nameEl && (nameEl.style.display = 'none')
+        phoneEl && (phoneEl.style.display = 'none')
+        emailEl && (emailEl.style.display = 'none')
+        passEl && (passEl.placeholder = 'Enter a new password')
+        return
+    }
+    modeToggle && (modeToggle.style.display = '')
+    emailEl && (emailEl.style.display = '')
+    passEl && (passEl.placeholder = 'Enter your password')
     if (mode === 'signup') {
         modeToggle && (modeToggle.textContent = 'Already Registered?')
         submitBtn && (submitBtn.textContent = 'Register')
@@ -95,10 +126,91 @@ function setupOtpInputsBehavior() {
 }
 
 setupOtpInputsBehavior()
+
+function postAuth(body) {
+    return fetch('/api/auth', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        credentials: 'same-origin',
+        body: JSON.stringify(body)
+    })
+}
+
+forgotEl && forgotEl.addEventListener('click', async (e) => {
+    e.preventDefault()
+    const email = emailEl && emailEl.value.trim()
+    if (!email) {
+        showToast('Enter your email first', false)
+        return
+    }
+    try {
+        const res = await postAuth({ method: 'reset_request', email })
+        const j = await res.json().catch(() => ({}))
+        if (res.ok) {
+            showToast('If that account exists, a reset link is on its way')
+        } else {
+            showToast(j.error || 'Could not send reset link', false)
+        }
+    } catch (err) {
+        showToast('Could not send reset link', false)
+    }
+})
 submitBtn && submitBtn.addEventListener('click', async (e) => {
     e.preventDefault()
     const email = emailEl && emailEl.value.trim()
     const password = passEl && passEl.value
+    if (mode === 'mfa') {
+        const code = mfaEl && mfaEl.value.trim()
+        if (!code) {
+            showToast('Enter your code', false)
+            return
+        }
+        try {
+            const res = await postAuth({ method: 'login_mfa', mfa_token: mfaToken, code })
+            const j = await res.json().catch(() => ({}))
+            if (res.ok) {
+                showToast('Login successful')
+                const params = new URLSearchParams(window.location.search || '')
+                const from = params.get('from') || '/play'
+                const sep = from.includes('?') ? '&' : '?'
+                window.location.href = from + sep + 'auth=login'
+            } else {
+                showToast(j.error || 'Verification failed', false)
+                if (res.status === 401 && !(j.error || '').startsWith('incorrect')) {
+                    mode = 'login'
+                    mfaToken = ''
+                    updateUI()
+                }
+            }
+        } catch (err) {
+            showToast('Verification failed', false)
+        }
+        return
+    }
+    if (mode === 'reset') {
+        if (!password) {
+            showToast('Missing fields', false)
+            return
+        }
+        try {
+            const res = await postAuth({ method: 'reset', token: resetToken, password })
+            const j = await res.json().catch(() => ({}))
+            if (res.ok) {
+                showToast('Password updated, please login')
+                if (history && history.replaceState) {
+                    history.replaceState(null, '', window.location.pathname)
+                }
+                mode = 'login'
+                passEl.value = ''
+                updateUI()
+            } else {
+                showToast(j.error || 'Reset failed', false)
+            }
+        } catch (err) {
+            showToast('Reset failed', false)
+        }
+        return
+    }
     if (mode === 'signup') {
         const name = nameEl && nameEl.value.trim()
         const ph = phoneEl && phoneEl.value.trim()
@@ -138,9 +250,8 @@ submitBtn && submitBtn.addEventListener('click', async (e) => {
             showToast('Enter 6 digit OTP', false)
             return
         }
-        const params = new URLSearchParams({ method: 'signup', email: pending.email, password: pending.password, name: pending.name, phonenumber: pending.ph, otp })
         try {
-            const res = await fetch('/api/auth?' + params.toString())
+            const res = await postAuth({ method: 'signup', email: pending.email, password: pending.password, name: pending.name, phonenumber: pending.ph, otp })
             const j = await res.json().catch(() => ({}))
                 if (res.ok) {
                     showToast('Auth successful')
@@ -161,11 +272,15 @@ submitBtn && submitBtn.addEventListener('click', async (e) => {
             showToast('Missing fields', false)
             return
         }
-        const params = new URLSearchParams({ method: 'login', email, password })
         try {
-            const res = await fetch('/api/auth?' + params.toString())
+            const res = await postAuth({ method: 'login', email, password })
             const j = await res.json().catch(() => ({}))
-            if (res.ok) {
+            if (res.ok && j.mfa_required) {
+                mfaToken = j.mfa_token
+                mode = 'mfa'
+                mfaEl && (mfaEl.value = '')
+                updateUI()
+            } else if (res.ok) {
                 showToast('Login successful')
                 const params = new URLSearchParams(window.location.search || '')
                 const from = params.get('from') || '/play'
@@ -34,9 +34,10 @@ function getLevelType() {
 	try {
 		const u = new URL(window.location.href);
 		const t = u.searchParams.get('type');
-		if (u.pathname && u.pathname.indexOf('/play') === 0 && t === 'ctf') return 'ctf';
+		if (window.level_Track) return window.level_Track;
+		if (u.pathname && u.pathname.indexOf('/play') === 0 && t) return t;
 	} catch (e) {}
-	return 'cryptic';
+	return '';
 }
 
 function setupChatSignalHandlers() {
@@ -456,8 +457,12 @@ async function sendChatMessage() {
 				sender.textContent = 'AI';
 				const text = document.createElement('div');
 				text.className = 'chat-message-text';
+				let sanction = null;
+				try { sanction = JSON.parse(txt || '') } catch (e) { sanction = null }
 				if (res.status === 404) {
 					text.textContent = 'no walkthrough available';
+				} else if (sanction && sanction.sanction) {
+					text.textContent = sanction.error;
 				} else if (txt) {
 					text.textContent = txt;
 				} else {
@@ -536,6 +541,10 @@ async function sendChatMessage() {
 		if (!resp.ok) {
 			let data = null
 			try { data = await resp.json() } catch (e) { data = null }
+			if (data && data.sanction) {
+				if (typeof Notyf !== 'undefined') new Notyf().error({ message: data.error, duration: 8000 })
+				return
+			}
 			if (data && data.when) {
 				const n = typeof Notyf !== 'undefined' ? new Notyf() : null
 				if (n) n.error(data.error || (data.when === 'before' ? 'The event has not commenced yet' : 'The event has concluded'))
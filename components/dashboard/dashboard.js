@@ -56,7 +56,7 @@ function buildConversationList(allMsgs) {
     const me = window.__adminEmail || '';
     const adminAddress = "admin@sudocrypt.com";
     const levelVal = (m.level_id || m.LevelID || m.level || m.Level || '') || '';
-    if (String(levelVal || '').toLowerCase().startsWith('ctf')) return;
+    if (String(levelVal || '').toLowerCase().startsWith('ctf-')) return;
     let other = '';
     if (m.from === adminAddress) other = m.to;
     else if (m.to === adminAddress) other = m.from;
@@ -93,7 +93,7 @@ function buildConversationListCTF(allMsgs) {
     const me = window.__adminEmail || '';
     const adminAddress = "admin@sudocrypt.com";
     const levelVal = (m.level_id || m.LevelID || m.level || m.Level || '') || '';
-    if (!String(levelVal || '').toLowerCase().startsWith('ctf')) return;
+    if (!String(levelVal || '').toLowerCase().startsWith('ctf-')) return;
     let other = '';
     if (m.from === adminAddress) other = m.to;
     else if (m.to === adminAddress) other = m.from;
@@ -144,7 +144,7 @@ function renderThread(user, data) {
   cont.innerHTML = '';
   msgs.forEach(m => {
     const level = m.level_id || m.LevelID || m.level || m.Level || '';
-    if (String(level || '').toLowerCase().startsWith('ctf')) return;
+    if (String(level || '').toLowerCase().startsWith('ctf-')) return;
     const row = document.createElement('div');
     const isFromAdmin = (m.from === me || m.from === adminAddress);
     row.className = 'msg-row' + (isFromAdmin ? ' msg-me' : '');
@@ -191,7 +191,7 @@ function renderThreadCTF(user, data) {
   cont.innerHTML = '';
   msgs.forEach(m => {
     const level = m.level_id || m.LevelID || m.level || m.Level || '';
-    if (!String(level || '').toLowerCase().startsWith('ctf')) return;
+    if (!String(level || '').toLowerCase().startsWith('ctf-')) return;
     const row = document.createElement('div');
     const isFromAdmin = (m.from === me || m.from === adminAddress);
     row.className = 'msg-row' + (isFromAdmin ? ' msg-me' : '');
@@ -0,0 +1,25 @@
+(function () {
+  function csrfToken() {
+    const m = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]+)/);
+    return m ? decodeURIComponent(m[1]) : '';
+  }
+  window.csrfToken = csrfToken;
+
+  const origFetch = window.fetch.bind(window);
+  window.fetch = function (input, init) {
+    init = init || {};
+    const method = String(init.method || (input && input.method) || 'GET').toUpperCase();
+    const url = new URL(typeof input === 'string' ? input : input.url, window.location.href);
+    if (method !== 'GET' && method !== 'HEAD' && url.origin === window.location.origin) {
+      const headers = new Headers(init.headers || (input && input.headers) || {});
+      if (!headers.has('X-CSRF-Token')) headers.set('X-CSRF-Token', csrfToken());
+      init = Object.assign({}, init, { headers });
+    }
+    return origFetch(input, init);
+  };
+
+  document.addEventListener('submit', function (e) {
+    const form = e.target;
+    if (form && form.elements && form.elements['csrf_token']) form.elements['csrf_token'].value = csrfToken();
+  }, true);
+})();
@@ -6,9 +6,16 @@ document.addEventListener('click', async (e) => {
     window.location.href = '/auth';
     return;
   }
+  if (action === 'exit-view-as') {
+    try {
+      await fetch('/api/admin/view_as', { method: 'DELETE', credentials: 'same-origin' });
+    } catch (err) {}
+    window.location.href = '/admin';
+    return;
+  }
   if (action === 'logout') {
     try {
-      const res = await fetch('/logout', { method: 'GET', credentials: 'same-origin' });
+      const res = await fetch('/logout', { method: 'POST', credentials: 'same-origin' });
       if (res.ok) {
         window.location.href = '/auth';
       } else {
@@ -176,29 +176,17 @@ async function submitAnswer() {
         setTimeout(() => { if (sendBtn) sendBtn.disabled = false; }, submitCooldownMs);
 
         const params = new URLSearchParams((new URL(window.location.href)).search);
-        const type = params.get('type') || 'cryptic';
+        const type = window.level_Track || params.get('type') || '';
         let ansRaw = input.value;
 
         const levelId = window.__currentLevelId || '';
         const typeWithLevel = levelId ? levelId : type;
         await post_log(typeWithLevel, ansRaw);
 
-        if (type === 'cryptic') {
-            const v = ansRaw.trim().toLowerCase();
-            if (v === '') return;
-            if (!/^[a-z]+$/.test(v)) {
-                const n = new Notyf();
-                n.error('Invalid answer format');
-                return;
-            }
-            ansRaw = v;
-        } else {
-            ansRaw = ansRaw.trim();
-            if (ansRaw === '') return;
-        }
+        ansRaw = ansRaw.trim();
+        if (ansRaw === '') return;
         
-        const url = `/submit?answer=${encodeURIComponent(ansRaw)}&type=${encodeURIComponent(type)}`;
-        const resp = await fetch(url, { credentials: 'same-origin' });
+        const resp = await fetch('/submit', { method: 'POST', credentials: 'same-origin', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ answer: ansRaw, type: type }) });
         let data = null;
         if (!resp.ok) {
             try {
@@ -208,6 +196,10 @@ async function submitAnswer() {
             }
             const n = new Notyf();
             if (resp.status === 403) {
+                if (data && data.sanction) {
+                    n.error({ message: data.error, duration: 8000 });
+                    return;
+                }
                 if (data && data.when) {
                     const msg = data.error || (data.when === 'before' ? 'The event has not commenced yet' : 'The event has concluded');
                     n.error(msg);
@@ -236,7 +228,7 @@ async function submitAnswer() {
             n.success('Correct');
             setTimeout(function () { window.location.reload(); }, 300);
         } else {
-            n.error('incorrect');
+            n.error((data && data.message) || 'incorrect');
         }
     } catch (err) {
         const n = new Notyf();
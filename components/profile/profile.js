@@ -32,16 +32,88 @@ window.enterEditMode = enterEditMode;
 window.cancelEdit = cancelEdit;
 window.saveBio = saveBio;
 
+async function postTwoFactor(body){
+	const res = await fetch('/api/2fa',{method:'POST',credentials:'same-origin',headers:{'Content-Type':'application/json'},body:JSON.stringify(body)});
+	const text = await res.text();
+	let data = {};
+	try{data=JSON.parse(text)}catch(e){data={error:text.trim()}}
+	if(!res.ok) throw new Error(data.error||'Request failed');
+	return data;
+}
+
+function showRecoveryCodes(codes){
+	document.getElementById('recoveryCodesList').textContent = (codes||[]).join('\n');
+	document.getElementById('recoveryCodes').style.display='block';
+}
+
+async function loadTwoFactor(){
+	const box = document.getElementById('twoFactor');
+	if(!box) return;
+	try{
+		const res = await fetch('/api/2fa',{credentials:'same-origin'});
+		if(!res.ok) return;
+		const st = await res.json();
+		const status = document.getElementById('twoFactorStatus');
+		const controls = document.getElementById('twoFactorControls');
+		controls.innerHTML='';
+		const button = (label, cls, fn) => {const b=document.createElement('button');b.className='btn '+cls;b.textContent=label;b.onclick=fn;controls.appendChild(b)};
+		if(st.enabled){
+			status.textContent='Two-factor authentication: on ('+st.recovery_codes_left+' recovery codes left)';
+			button('New recovery codes','btn-secondary',()=>twoFactorWithCode('recovery_codes'));
+			button('Turn off','btn-secondary',()=>twoFactorWithCode('disable'));
+		}else{
+			status.textContent='Two-factor authentication: off';
+			button('Set up','btn-primary',enrollTwoFactor);
+		}
+	}catch(err){}
+}
+
+async function enrollTwoFactor(){
+	try{
+		const data = await postTwoFactor({action:'enroll'});
+		document.getElementById('twoFactorSecret').textContent=data.secret;
+		document.getElementById('twoFactorLink').href=data.uri;
+		document.getElementById('twoFactorSetup').style.display='block';
+		document.getElementById('twoFactorCode').focus();
+	}catch(err){notyf.error(err.message)}
+}
+
+async function confirmTwoFactor(){
+	const code = document.getElementById('twoFactorCode').value.trim();
+	try{
+		const data = await postTwoFactor({action:'confirm',code});
+		document.getElementById('twoFactorSetup').style.display='none';
+		showRecoveryCodes(data.recovery_codes);
+		notyf.success('Two-factor authentication is on');
+		loadTwoFactor();
+	}catch(err){notyf.error(err.message)}
+}
+
+async function twoFactorWithCode(action){
+	const code = window.prompt('Enter a code from your authenticator app or a recovery code');
+	if(!code) return;
+	try{
+		const data = await postTwoFactor({action,code});
+		if(data.recovery_codes) showRecoveryCodes(data.recovery_codes);
+		notyf.success(action==='disable'?'Two-factor authentication is off':'New recovery codes created');
+		loadTwoFactor();
+	}catch(err){notyf.error(err.message)}
+}
+
+window.confirmTwoFactor = confirmTwoFactor;
+if(new URLSearchParams(window.location.search).get('toast')==='2fa'){notyf.error('Set up two-factor authentication to use admin pages')}
+loadTwoFactor();
+
 let pollingInterval = null;
 let allLogs = [];
 
 async function fetchAttemptLogs() {
     try {
-        let url = '/api/attempt_logs';
+        let url = '/api/attempt_logs?limit=1000';
         const profileEmailEl = document.querySelector('.profile-email');
         if (profileEmailEl) {
             const profileEmail = (profileEmailEl.textContent || '').trim();
-            if (profileEmail) url += '?email=' + encodeURIComponent(profileEmail);
+            if (profileEmail) url += '&email=' + encodeURIComponent(profileEmail);
         }
         const response = await fetch(url, {
             method: 'GET',
@@ -52,11 +124,11 @@ async function fetchAttemptLogs() {
             return;
         }
         const result = await response.json();
-        if (typeof result.data !== 'string') {
+        if (!Array.isArray(result.attempts)) {
             console.error('Invalid data format');
             return;
         }
-        parseLogs(result.data);
+        parseLogs(result.attempts);
         applyFilters();
     } catch (error) {
         console.error('Error fetching attempt logs:', error);
@@ -68,32 +140,13 @@ function formatTime(unixTimestamp) {
     return date.toLocaleString();
 }
 
-function parseLogs(logsString) {
-    allLogs = [];
-    const trimmed = logsString.trim();
-    if (!trimmed) {
-        return;
-    }
-    const logs = trimmed.split('\n').filter(entry => entry.length > 0);
-    logs.forEach((logEntry) => {
-        const parts = logEntry.split('+');
-        if (parts.length < 3) {
-                return;
-            }
-        const timeStr = parts[parts.length - 1];
-        const typpe = parts[parts.length - 2];
-        const attempt = parts.slice(0, parts.length - 2).join('+');
-        const unixTime = parseInt(timeStr, 10);
-        if (isNaN(unixTime)) {
-            return;
-        }
-        allLogs.push({
-            time: unixTime,
-            formattedTime: formatTime(unixTime),
-            type: typpe,
-            attempt: attempt
-        });
-    });
+function parseLogs(attempts) {
+    allLogs = attempts.map((a) => ({
+        time: a.created_at,
+        formattedTime: formatTime(a.created_at),
+        type: a.level_id || a.track,
+        attempt: a.payload
+    }));
 }
 
 function applyFilters() {
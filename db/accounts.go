@@ -0,0 +1,397 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrConflict      = errors.New("account was modified concurrently")
+	ErrAlreadySolved = errors.New("level already solved")
+)
+
+const accountRetries = 5
+
+type Account struct {
+	Email        string                `json:"email"`
+	Name         string                `json:"name"`
+	PhoneNumber  string                `json:"phonenumber"`
+	Password     string                `json:"-"`
+	Bio          string                `json:"bio"`
+	BioPublic    bool                  `json:"bio_public"`
+	Admin        bool                  `json:"admin"`
+	Disqualified bool                  `json:"disqualified"`
+	Points       int                   `json:"points"`
+	LastSolveAt  int64                 `json:"time"`
+	LastSubmitAt int64                 `json:"last_submit"`
+	CreatedAt    int64                 `json:"created_at"`
+	UpdatedAt    int64                 `json:"updated_at"`
+	Version      int64                 `json:"-"`
+	Levels       map[string]int        `json:"levels"`
+	Checkpoints  map[string]Checkpoint `json:"progress"`
+}
+
+type Checkpoint struct {
+	LevelID    string `json:"level_id"`
+	Checkpoint int    `json:"checkpoint"`
+}
+
+type Solve struct {
+	ID        int64  `json:"id"`
+	Email     string `json:"email"`
+	Track     string `json:"track"`
+	LevelID   string `json:"level_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+const accountColumns = `email, name, phonenumber, password, bio, bio_public, admin, disqualified, points, last_solve_at, last_submit_at, created_at, updated_at, version`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Queryer is satisfied by both a Store and a *Tx, so helpers can run either
+// standalone or inside a transaction.
+type Queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func scanAccount(s rowScanner) (*Account, error) {
+	var a Account
+	if err := s.Scan(&a.Email, &a.Name, &a.PhoneNumber, &a.Password, &a.Bio, &a.BioPublic, &a.Admin, &a.Disqualified, &a.Points, &a.LastSolveAt, &a.LastSubmitAt, &a.CreatedAt, &a.UpdatedAt, &a.Version); err != nil {
+		return nil, err
+	}
+	a.Levels = map[string]int{}
+	a.Checkpoints = map[string]Checkpoint{}
+	return &a, nil
+}
+
+func (a *Account) Level(track string) int {
+	if a == nil || a.Levels == nil {
+		return 0
+	}
+	return a.Levels[track]
+}
+
+func (a *Account) DisplayName() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.Email
+}
+
+func GetAccount(d Store, email string) (*Account, error) {
+	return getAccount(d, email)
+}
+
+func getAccount(d Queryer, email string) (*Account, error) {
+	a, err := scanAccount(d.QueryRow(`SELECT `+accountColumns+` FROM accounts WHERE email = ?`, email))
+	if err != nil {
+		return nil, err
+	}
+	if err := loadProgress(d, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func AccountExists(d Store, email string) (bool, error) {
+	var n int
+	if err := d.QueryRow(`SELECT COUNT(*) FROM accounts WHERE email = ?`, email).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func loadProgress(d Queryer, a *Account) error {
+	rows, err := d.Query(`SELECT track, level FROM progress WHERE email = ?`, a.Email)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var track string
+		var level int
+		if err := rows.Scan(&track, &level); err != nil {
+			rows.Close()
+			return err
+		}
+		a.Levels[track] = level
+	}
+	rows.Close()
+	rows, err = d.Query(`SELECT track, level_id, checkpoint FROM checkpoints WHERE email = ?`, a.Email)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var track string
+		var cp Checkpoint
+		if err := rows.Scan(&track, &cp.LevelID, &cp.Checkpoint); err != nil {
+			return err
+		}
+		a.Checkpoints[track] = cp
+	}
+	return rows.Err()
+}
+
+func ListAccounts(d Store) ([]*Account, error) {
+	rows, err := d.Query(`SELECT ` + accountColumns + ` FROM accounts ORDER BY points DESC, last_solve_at ASC`)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Account
+	byEmail := map[string]*Account{}
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, a)
+		byEmail[a.Email] = a
+	}
+	rows.Close()
+	rows, err = d.Query(`SELECT email, track, level FROM progress`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var email, track string
+		var level int
+		if err := rows.Scan(&email, &track, &level); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if a, ok := byEmail[email]; ok {
+			a.Levels[track] = level
+		}
+	}
+	rows.Close()
+	rows, err = d.Query(`SELECT email, track, level_id, checkpoint FROM checkpoints`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var email, track string
+		var cp Checkpoint
+		if err := rows.Scan(&email, &track, &cp.LevelID, &cp.Checkpoint); err != nil {
+			return nil, err
+		}
+		if a, ok := byEmail[email]; ok {
+			a.Checkpoints[track] = cp
+		}
+	}
+	return out, rows.Err()
+}
+
+func CreateAccount(d Queryer, a *Account) error {
+	now := time.Now().Unix()
+	if a.CreatedAt == 0 {
+		a.CreatedAt = now
+	}
+	a.UpdatedAt = now
+	_, err := d.Exec(`INSERT INTO accounts(`+accountColumns+`) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		a.Email, a.Name, a.PhoneNumber, a.Password, a.Bio, a.BioPublic, a.Admin, a.Disqualified, a.Points, a.LastSolveAt, a.LastSubmitAt, a.CreatedAt, a.UpdatedAt, a.Version)
+	return err
+}
+
+func UpdateBio(d Store, email, bio string, bioPublic bool) error {
+	res, err := d.Exec(`UPDATE accounts SET bio = ?, bio_public = ?, updated_at = ?, version = version + 1 WHERE email = ?`, bio, bioPublic, time.Now().Unix(), email)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+func SetPassword(d Queryer, email, hash string) error {
+	res, err := d.Exec(`UPDATE accounts SET password = ?, updated_at = ?, version = version + 1 WHERE email = ?`, hash, time.Now().Unix(), email)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+func DeleteAccount(d Store, email string) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		`DELETE FROM checkpoints WHERE email = ?`,
+		`DELETE FROM progress WHERE email = ?`,
+		`DELETE FROM solves WHERE email = ?`,
+		`DELETE FROM attempts WHERE email = ?`,
+		`DELETE FROM sessions WHERE email = ?`,
+		`DELETE FROM recovery_codes WHERE email = ?`,
+		`DELETE FROM totp WHERE email = ?`,
+		`DELETE FROM account_roles WHERE email = ?`,
+		`DELETE FROM account_sanctions WHERE email = ?`,
+		`DELETE FROM accounts WHERE email = ?`,
+	} {
+		if _, err := tx.Exec(q, email); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetLevel moves a player to a level on a track without recording a solve,
+// forgets their solves from that level on, and recomputes their leaderboard
+// points.
+func SetLevel(d Store, email, track string, level int) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	if _, err := tx.Exec(`INSERT INTO progress(email, track, level, updated_at) VALUES(?,?,?,?) ON CONFLICT(email, track) DO UPDATE SET level = excluded.level, updated_at = excluded.updated_at`, email, track, level, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM checkpoints WHERE email = ? AND track = ?`, email, track); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := forgetSolvesFrom(tx, email, track, level); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := refreshPoints(tx, email); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// forgetSolvesFrom deletes email's solves of levels on track at or past
+// level, so they can be solved again.
+func forgetSolvesFrom(tx *Tx, email, track string, level int) error {
+	_, err := tx.Exec(`DELETE FROM solves WHERE email = ? AND track = ? AND CAST(substr(level_id, length(?) + 2) AS INTEGER) >= ?`, email, track, track, level)
+	return err
+}
+
+func SetCheckpoint(d Store, email, track, levelID string, checkpoint int) error {
+	_, err := d.Exec(`INSERT INTO checkpoints(email, track, level_id, checkpoint, updated_at) VALUES(?,?,?,?,?) ON CONFLICT(email, track) DO UPDATE SET level_id = excluded.level_id, checkpoint = excluded.checkpoint, updated_at = excluded.updated_at`,
+		email, track, levelID, checkpoint, time.Now().Unix())
+	return err
+}
+
+// UpdateAccount loads an account inside a transaction, lets fn change it,
+// and writes it back only if no other writer bumped the row version in the
+// meantime. On a version conflict the whole transaction is retried with a
+// fresh copy of the account.
+func UpdateAccount(d Store, email string, fn func(tx *Tx, a *Account) error) error {
+	for i := 0; i < accountRetries; i++ {
+		err := updateAccountOnce(d, email, fn)
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+func updateAccountOnce(d Store, email string, fn func(tx *Tx, a *Account) error) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	a, err := getAccount(tx, email)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(tx, a); err != nil {
+		tx.Rollback()
+		return err
+	}
+	a.UpdatedAt = time.Now().Unix()
+	res, err := tx.Exec(`UPDATE accounts SET name = ?, phonenumber = ?, bio = ?, bio_public = ?, disqualified = ?, points = ?, last_solve_at = ?, last_submit_at = ?, updated_at = ?, version = version + 1 WHERE email = ? AND version = ?`,
+		a.Name, a.PhoneNumber, a.Bio, a.BioPublic, a.Disqualified, a.Points, a.LastSolveAt, a.LastSubmitAt, a.UpdatedAt, a.Email, a.Version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	a.Version++
+	return nil
+}
+
+// RecordSolve stores a solve of levelID and advances the player to the next
+// level on the track. It must run inside UpdateAccount so the account row
+// version guards the progress change. The answer given is not kept: every
+// solve would otherwise hold the level's answer in plaintext.
+func RecordSolve(tx *Tx, a *Account, track, levelID string, at int64) error {
+	res, err := tx.Exec(`INSERT INTO solves(email, track, level_id, created_at) VALUES(?,?,?,?) ON CONFLICT(email, level_id) DO NOTHING`, a.Email, track, levelID, at)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAlreadySolved
+	}
+	a.Levels[track] = a.Level(track) + 1
+	if _, err := tx.Exec(`INSERT INTO progress(email, track, level, updated_at) VALUES(?,?,?,?) ON CONFLICT(email, track) DO UPDATE SET level = excluded.level, updated_at = excluded.updated_at`, a.Email, track, a.Levels[track], at); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM checkpoints WHERE email = ? AND track = ?`, a.Email, track); err != nil {
+		return err
+	}
+	delete(a.Checkpoints, track)
+	if err := tx.QueryRow(pointsQuery, a.Email).Scan(&a.Points); err != nil {
+		return err
+	}
+	a.LastSolveAt = at
+	return nil
+}
+
+func refreshPoints(tx *Tx, email string) error {
+	var points int
+	if err := tx.QueryRow(pointsQuery, email).Scan(&points); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE accounts SET points = ?, updated_at = ?, version = version + 1 WHERE email = ?`, points, time.Now().Unix(), email)
+	return err
+}
+
+func ListSolves(d Store, email string) ([]Solve, error) {
+	rows, err := d.Query(`SELECT id, email, track, level_id, created_at FROM solves WHERE email = ? ORDER BY created_at ASC, id ASC`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Solve{}
+	for rows.Next() {
+		var s Solve
+		if err := rows.Scan(&s.ID, &s.Email, &s.Track, &s.LevelID, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
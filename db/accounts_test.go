@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestStore(t *testing.T) Store {
+	t.Helper()
+	d, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := InitDB(d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func newTestAccount(t *testing.T, d Store, email string) *Account {
+	t.Helper()
+	if err := CreateAccount(d, &Account{Email: email, Name: email}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := GetAccount(d, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// solveCurrent solves whatever level a is on, the way SubmitHandler does.
+func solveCurrent(d Store, email, track string) error {
+	return UpdateAccount(d, email, func(tx *Tx, a *Account) error {
+		levelID := fmt.Sprintf("%s-%d", track, a.Level(track))
+		return RecordSolve(tx, a, track, levelID, 1)
+	})
+}
+
+func countSolves(t *testing.T, d Store, email string) int {
+	t.Helper()
+	solves, err := ListSolves(d, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(solves)
+}
+
+func TestConcurrentSolvesOfOneLevel(t *testing.T) {
+	d := newTestStore(t)
+	start := newTestAccount(t, d, "p@x.com")
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- UpdateAccount(d, "p@x.com", func(tx *Tx, a *Account) error {
+				return RecordSolve(tx, a, "cryptic", "cryptic-0", 1)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	solved := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			solved++
+		case errors.Is(err, ErrAlreadySolved):
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if solved != 1 {
+		t.Fatalf("%d submits solved cryptic-0, want 1", solved)
+	}
+	a, err := GetAccount(d, "p@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Level("cryptic") != 1 || a.Points != 1 {
+		t.Fatalf("level %d points %d, want 1 and 1", a.Level("cryptic"), a.Points)
+	}
+	if a.Version != start.Version+1 {
+		t.Fatalf("version %d, want %d", a.Version, start.Version+1)
+	}
+	if got := countSolves(t, d, "p@x.com"); got != 1 {
+		t.Fatalf("%d solves recorded, want 1", got)
+	}
+}
+
+func TestConcurrentSolvesDoNotLoseUpdates(t *testing.T) {
+	d := newTestStore(t)
+	start := newTestAccount(t, d, "p@x.com")
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- solveCurrent(d, "p@x.com", "cryptic")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("solve failed: %v", err)
+		}
+	}
+
+	a, err := GetAccount(d, "p@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Level("cryptic") != n || a.Points != n {
+		t.Fatalf("level %d points %d, want %d", a.Level("cryptic"), a.Points, n)
+	}
+	if a.Version != start.Version+n {
+		t.Fatalf("version %d, want %d", a.Version, start.Version+n)
+	}
+	if got := countSolves(t, d, "p@x.com"); got != n {
+		t.Fatalf("%d solves recorded, want %d", got, n)
+	}
+}
+
+func TestResetAllowsSolvingAgain(t *testing.T) {
+	d := newTestStore(t)
+	newTestAccount(t, d, "p@x.com")
+	newTestAccount(t, d, "q@x.com")
+	for i := 0; i < 3; i++ {
+		if err := solveCurrent(d, "p@x.com", "cryptic"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, email := range []string{"p@x.com", "q@x.com"} {
+		if err := solveCurrent(d, email, "ctf"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := SetLevel(d, "p@x.com", "cryptic", 1); err != nil {
+		t.Fatal(err)
+	}
+	a, err := GetAccount(d, "p@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Level("cryptic") != 1 || a.Points != 2 {
+		t.Fatalf("after reset: level %d points %d, want 1 and 2", a.Level("cryptic"), a.Points)
+	}
+	// cryptic-0 and ctf-0 stay solved
+	if got := countSolves(t, d, "p@x.com"); got != 2 {
+		t.Fatalf("%d solves kept, want 2", got)
+	}
+
+	if err := solveCurrent(d, "p@x.com", "cryptic"); err != nil {
+		t.Fatalf("re-solving cryptic-1 after a reset: %v", err)
+	}
+	a, err = GetAccount(d, "p@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Level("cryptic") != 2 || a.Points != 3 {
+		t.Fatalf("after re-solve: level %d points %d, want 2 and 3", a.Level("cryptic"), a.Points)
+	}
+	if got := countSolves(t, d, "q@x.com"); got != 1 {
+		t.Fatalf("other player has %d solves, want 1", got)
+	}
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+)
+
+type Attempt struct {
+	ID        int64  `json:"id"`
+	Email     string `json:"email"`
+	Track     string `json:"track"`
+	LevelID   string `json:"level_id"`
+	Payload   string `json:"payload"`
+	Session   string `json:"session"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type AttemptFilter struct {
+	Email   string
+	Track   string
+	LevelID string
+	Since   int64
+	Until   int64
+	Cursor  int64
+	Limit   int
+	Desc    bool
+}
+
+type AttemptStats struct {
+	LevelID  string `json:"level_id"`
+	Track    string `json:"track"`
+	Attempts int64  `json:"attempts"`
+	Players  int64  `json:"players"`
+	FirstAt  int64  `json:"first_at"`
+	LastAt   int64  `json:"last_at"`
+}
+
+func (f AttemptFilter) where() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if f.Email != "" {
+		where = append(where, "email = ?")
+		args = append(args, f.Email)
+	}
+	if f.Track != "" {
+		where = append(where, "track = ?")
+		args = append(args, f.Track)
+	}
+	if f.LevelID != "" {
+		where = append(where, "level_id = ?")
+		args = append(args, f.LevelID)
+	}
+	if f.Since > 0 {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until)
+	}
+	if f.Cursor > 0 {
+		if f.Desc {
+			where = append(where, "id < ?")
+		} else {
+			where = append(where, "id > ?")
+		}
+		args = append(args, f.Cursor)
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func AddAttempt(d Queryer, a *Attempt) error {
+	_, err := d.Exec(`INSERT INTO attempts(email, track, level_id, payload, session, created_at) VALUES(?,?,?,?,?,?)`,
+		a.Email, a.Track, a.LevelID, a.Payload, a.Session, a.CreatedAt)
+	return err
+}
+
+func QueryAttempts(d Queryer, f AttemptFilter) ([]Attempt, error) {
+	where, args := f.where()
+	q := `SELECT id, email, track, level_id, payload, session, created_at FROM attempts` + where
+	if f.Desc {
+		q += " ORDER BY id DESC"
+	} else {
+		q += " ORDER BY id ASC"
+	}
+	if f.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := d.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		if err := rows.Scan(&a.ID, &a.Email, &a.Track, &a.LevelID, &a.Payload, &a.Session, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// AttemptStatsByLevel groups matching attempts per level. Cursor, Limit
+// and Desc are ignored.
+func AttemptStatsByLevel(d Queryer, f AttemptFilter) ([]AttemptStats, error) {
+	f.Cursor = 0
+	where, args := f.where()
+	rows, err := d.Query(`SELECT level_id, track, COUNT(*), COUNT(DISTINCT email), MIN(created_at), MAX(created_at) FROM attempts`+where+` GROUP BY level_id, track ORDER BY track, level_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []AttemptStats{}
+	for rows.Next() {
+		var s AttemptStats
+		if err := rows.Scan(&s.LevelID, &s.Track, &s.Attempts, &s.Players, &s.FirstAt, &s.LastAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// parseLegacyAttempts splits the old attempt_logs string, a series of
+// "\n<payload>+<type>+<unix>" entries where type is a level id or a bare
+// track name. The payload itself may contain "+".
+func parseLegacyAttempts(email, logs string) []Attempt {
+	var out []Attempt
+	for _, line := range strings.Split(logs, "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "+")
+		if len(parts) < 3 {
+			continue
+		}
+		ts, err := strconv.ParseInt(strings.TrimSpace(parts[len(parts)-1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		typ := parts[len(parts)-2]
+		a := Attempt{Email: email, Track: typ, Payload: strings.Join(parts[:len(parts)-2], "+"), CreatedAt: ts}
+		if i := strings.LastIndex(typ, "-"); i > 0 {
+			if _, err := strconv.Atoi(typ[i+1:]); err == nil {
+				a.Track = typ[:i]
+				a.LevelID = typ
+			}
+		}
+		out = append(out, a)
+	}
+	return out
+}
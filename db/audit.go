@@ -0,0 +1,143 @@
+package db
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// AuditEntry is one privileged action. Before and After hold JSON
+// snapshots of the target; either is empty when there was nothing on that
+// side. Rows are never updated or deleted.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	IP        string          `json:"ip"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+// AuditFilter selects audit entries. An Action ending in "." matches every
+// action under that prefix, so "level." finds level.set and level.delete.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  int64
+	Until  int64
+	Cursor int64
+	Limit  int
+	Desc   bool
+}
+
+const auditPageSize = 1000
+
+func (f AuditFilter) where() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		where = append(where, "action LIKE ?")
+		args = append(args, strings.NewReplacer("%", "", "_", "").Replace(f.Action)+"%")
+	} else if f.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Target != "" {
+		where = append(where, "target = ?")
+		args = append(args, f.Target)
+	}
+	if f.Since > 0 {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until)
+	}
+	if f.Cursor > 0 {
+		if f.Desc {
+			where = append(where, "id < ?")
+		} else {
+			where = append(where, "id > ?")
+		}
+		args = append(args, f.Cursor)
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func AddAudit(d Queryer, e *AuditEntry) error {
+	_, err := d.Exec(`INSERT INTO audit_log(actor, action, target, before_json, after_json, ip, created_at) VALUES(?,?,?,?,?,?,?)`,
+		e.Actor, e.Action, e.Target, string(e.Before), string(e.After), e.IP, e.CreatedAt)
+	return err
+}
+
+func QueryAudit(d Queryer, f AuditFilter) ([]AuditEntry, error) {
+	where, args := f.where()
+	q := `SELECT id, actor, action, target, before_json, after_json, ip, created_at FROM audit_log` + where
+	if f.Desc {
+		q += " ORDER BY id DESC"
+	} else {
+		q += " ORDER BY id ASC"
+	}
+	if f.Limit <= 0 || f.Limit > auditPageSize {
+		f.Limit = auditPageSize
+	}
+	q += " LIMIT ?"
+	args = append(args, f.Limit)
+	rows, err := d.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var before, after string
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.Target, &before, &after, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// AuditChange is one field that differs between Before and After.
+type AuditChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Changes compares the top-level fields of Before and After. A snapshot
+// that is missing or not an object counts as having no fields.
+func (e AuditEntry) Changes() map[string]AuditChange {
+	var before, after map[string]json.RawMessage
+	json.Unmarshal(e.Before, &before)
+	json.Unmarshal(e.After, &after)
+	out := map[string]AuditChange{}
+	for k, v := range before {
+		if w, ok := after[k]; !ok || string(w) != string(v) {
+			out[k] = AuditChange{Before: v, After: after[k]}
+		}
+	}
+	for k, w := range after {
+		if _, ok := before[k]; !ok {
+			out[k] = AuditChange{After: w}
+		}
+	}
+	return out
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const snapshotPrefix = "snapshot-"
+
+type BackupInfo struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Backups writes consistent snapshots of a live SQLite database into Dir
+// and keeps the newest Keep of them.
+type Backups struct {
+	d    Store
+	Dir  string
+	Keep int
+	mu   sync.Mutex
+}
+
+func NewBackups(d Store, dir string, keep int) *Backups {
+	if dir == "" {
+		dir = "./backups"
+	}
+	if keep <= 0 {
+		keep = 10
+	}
+	return &Backups{d: d, Dir: dir, Keep: keep}
+}
+
+// Run takes a snapshot with VACUUM INTO, verifies it and prunes old
+// snapshots. The snapshot only appears under its final name once it has
+// passed the integrity check.
+func (b *Backups) Run() (BackupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.d.Driver() != "sqlite" {
+		return BackupInfo{}, fmt.Errorf("backup: online snapshots are only supported on sqlite, use pg_dump for %s", b.d.Driver())
+	}
+	if err := os.MkdirAll(b.Dir, 0o700); err != nil {
+		return BackupInfo{}, err
+	}
+	now := time.Now().UTC()
+	name := snapshotPrefix + now.Format("20060102T150405.000Z") + ".db"
+	final := filepath.Join(b.Dir, name)
+	tmp := filepath.Join(b.Dir, "."+name+".tmp")
+	os.Remove(tmp)
+	if _, err := b.d.Exec(`VACUUM INTO ?`, tmp); err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+	if err := IntegrityCheck(tmp); err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+	if err := b.prune(); err != nil {
+		log.Println("backup: prune:", err)
+	}
+	st, err := os.Stat(final)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return BackupInfo{Name: name, Path: final, Size: st.Size(), CreatedAt: now.Unix()}, nil
+}
+
+func (b *Backups) List() ([]BackupInfo, error) {
+	entries, err := os.ReadDir(b.Dir)
+	if os.IsNotExist(err) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := []BackupInfo{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, ".db") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, BackupInfo{Name: name, Path: filepath.Join(b.Dir, name), Size: info.Size(), CreatedAt: info.ModTime().Unix()})
+	}
+	// names embed a UTC timestamp, so lexical order is chronological
+	sort.Slice(out, func(i, j int) bool { return out[i].Name > out[j].Name })
+	return out, nil
+}
+
+func (b *Backups) prune() error {
+	list, err := b.List()
+	if err != nil {
+		return err
+	}
+	for i := b.Keep; i < len(list); i++ {
+		if err := os.Remove(list[i].Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schedule runs a backup every interval until stop is closed.
+func (b *Backups) Schedule(every time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if info, err := b.Run(); err != nil {
+				log.Println("backup:", err)
+			} else {
+				log.Println("backup: wrote", info.Path)
+			}
+		}
+	}
+}
+
+// CheckIntegrity runs PRAGMA integrity_check on the live database.
+func CheckIntegrity(d Store) error {
+	if d.Driver() != "sqlite" {
+		return nil
+	}
+	return integrityCheck(d.DB())
+}
+
+// IntegrityCheck opens a SQLite file read-only and runs PRAGMA
+// integrity_check on it.
+func IntegrityCheck(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return integrityCheck(conn)
+}
+
+func integrityCheck(conn *sql.DB) error {
+	rows, err := conn.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return err
+		}
+		if s != "ok" {
+			problems = append(problems, s)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Restore replaces the SQLite database at dst with the snapshot at src.
+// The server must be stopped. The previous database is kept next to dst
+// with a .pre-restore suffix.
+func Restore(src, dst string) (string, error) {
+	if err := IntegrityCheck(src); err != nil {
+		return "", fmt.Errorf("restore: %s: %w", src, err)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	tmp := dst + ".restore.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	saved := ""
+	if _, err := os.Stat(dst); err == nil {
+		saved = dst + ".pre-restore-" + time.Now().UTC().Format("20060102T150405Z")
+		if err := os.Rename(dst, saved); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+	// stale WAL and shared-memory files belong to the old database
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if _, err := os.Stat(dst + suffix); err == nil {
+			if saved != "" {
+				os.Rename(dst+suffix, saved+suffix)
+			} else {
+				os.Remove(dst + suffix)
+			}
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return saved, err
+	}
+	return saved, nil
+}
+
+// SQLitePath strips connection parameters from a SQLite DSN.
+func SQLitePath(dsn string) string {
+	if dsn == "" {
+		return "./data.db"
+	}
+	dsn = strings.TrimPrefix(dsn, "file:")
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		dsn = dsn[:i]
+	}
+	return dsn
+}
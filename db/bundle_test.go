@@ -0,0 +1,82 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+func exportTestBundle(t *testing.T, d Store, sections ...string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := ExportBundle(d, &buf, sections); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestExportLeavesOutAnswers(t *testing.T) {
+	src := newTestStore(t)
+	newTestAccount(t, src, "p@x.com")
+	// written the way submissions were logged before answers were redacted
+	if err := Set(src, "logs", "p@x.com", "submit|cryptic|the answer|correct"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(src, "logs", "p@x.com", "submit|cryptic|cryptic-0|correct"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestStore(t)
+	b := exportTestBundle(t, src, "logs")
+	if _, err := ImportBundle(dst, b, b.Size(), ImportOptions{Mode: ImportSkip}); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := QueryLogs(dst, LogFilter{Namespace: "submit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, e := range logs {
+		got[e.Data] = true
+	}
+	if len(got) != 2 || !got["|correct"] || !got["cryptic-0|correct"] {
+		t.Fatalf("imported submit logs %v, want the answer redacted and the level kept", got)
+	}
+}
+
+func TestImportOverwriteTrimsSolves(t *testing.T) {
+	src := newTestStore(t)
+	newTestAccount(t, src, "p@x.com")
+	if err := solveCurrent(src, "p@x.com", "cryptic"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestStore(t)
+	newTestAccount(t, dst, "p@x.com")
+	for i := 0; i < 3; i++ {
+		if err := solveCurrent(dst, "p@x.com", "cryptic"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := solveCurrent(dst, "p@x.com", "ctf"); err != nil {
+		t.Fatal(err)
+	}
+
+	b := exportTestBundle(t, src, "accounts", "solves")
+	if _, err := ImportBundle(dst, b, b.Size(), ImportOptions{Mode: ImportOverwrite}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := GetAccount(dst, "p@x.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Level("cryptic") != 1 || a.Level("ctf") != 0 || a.Points != 1 {
+		t.Fatalf("cryptic %d ctf %d points %d, want 1, 0 and 1", a.Level("cryptic"), a.Level("ctf"), a.Points)
+	}
+	if got := countSolves(t, dst, "p@x.com"); got != 1 {
+		t.Fatalf("%d solves kept, want 1", got)
+	}
+	// the trimmed levels can be solved again
+	if err := solveCurrent(dst, "p@x.com", "cryptic"); err != nil {
+		t.Fatalf("solving cryptic-1 after the import: %v", err)
+	}
+}
@@ -8,119 +8,27 @@ import (
 	"time"
 )
 
-func InitDB(d *sql.DB) error {
-	schema := `
-CREATE TABLE IF NOT EXISTS users (
-	email TEXT PRIMARY KEY,
-	data TEXT,
-	created_at INTEGER
-);
-CREATE TABLE IF NOT EXISTS attempt_logs ( 
-	email TEXT PRIMARY KEY,
-	logs TEXT
-);
-CREATE TABLE IF NOT EXISTS pending_signups (
-	email TEXT PRIMARY KEY,
-	data TEXT,
-	created_at INTEGER
-);
-CREATE TABLE IF NOT EXISTS emails (
-	email TEXT PRIMARY KEY,
-	created_at INTEGER
-);
-CREATE TABLE IF NOT EXISTS levels (
-    id TEXT PRIMARY KEY,
-    data TEXT,
-    created_at INTEGER
-);
-CREATE TABLE IF NOT EXISTS announcements (
-	id TEXT PRIMARY KEY,
-	data TEXT,
-	created_at INTEGER
-);
-CREATE TABLE IF NOT EXISTS hints (
-	level_id TEXT,
-	hint_id TEXT,
-	data TEXT,
-	created_at INTEGER,
-	PRIMARY KEY (level_id, hint_id)
-);
-CREATE TABLE IF NOT EXISTS messages (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	data TEXT,
-	created_at INTEGER,
-	read INTEGER DEFAULT 0
-);
-CREATE TABLE IF NOT EXISTS logs (
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	namespace TEXT,
-	key TEXT,
-	event TEXT,
-	data TEXT,
-	created_at INTEGER
-);
-
-CREATE TABLE IF NOT EXISTS sessions (
-    session_id TEXT PRIMARY KEY,
-    email TEXT,
-    created_at INTEGER
-);
-
-`
-	_, err := d.Exec(schema)
-	return err
+func InitDB(d Store) error {
+	return Migrate(d)
 }
 
-func Set(d *sql.DB, namespace, key, value string) error {
+func Set(d Queryer, namespace, key, value string) error {
 	now := time.Now().Unix()
 	switch namespace {
-	case "accounts", "registration", "users":
-		_, err := d.Exec(`INSERT OR REPLACE INTO users(email, data, created_at) VALUES(?,?,?)`, key, value, now)
-		return err
 	case "pending_signup":
-		_, err := d.Exec(`INSERT OR REPLACE INTO pending_signups(email, data, created_at) VALUES(?,?,?)`, key, value, now)
+		_, err := d.Exec(`INSERT INTO pending_signups(email, data, created_at) VALUES(?,?,?) ON CONFLICT(email) DO UPDATE SET data = excluded.data, created_at = excluded.created_at`, key, value, now)
 		return err
 	case "emails":
-		_, err := d.Exec(`INSERT OR REPLACE INTO emails(email, created_at) VALUES(?,?)`, key, now)
-		return err
-	case "leaderboard":
-		var lb map[string]interface{}
-		if err := json.Unmarshal([]byte(value), &lb); err != nil {
-			return err
-		}
-		var existing sql.NullString
-		if err := d.QueryRow(`SELECT data FROM users WHERE email = ?`, key).Scan(&existing); err != nil && err != sql.ErrNoRows {
-			return err
-		}
-		var user map[string]interface{}
-		if existing.Valid {
-			json.Unmarshal([]byte(existing.String), &user)
-		} else {
-			user = map[string]interface{}{"email": key}
-		}
-		if name, ok := lb["name"].(string); ok && name != "" {
-			user["name"] = name
-		}
-		if points, ok := lb["points"]; ok {
-			user["points"] = points
-		}
-		if t, ok := lb["time"]; ok {
-			user["time"] = t
-		}
-		ub, _ := json.Marshal(user)
-		_, err := d.Exec(`INSERT OR REPLACE INTO users(email, data, created_at) VALUES(?,?,?)`, key, string(ub), now)
+		_, err := d.Exec(`INSERT INTO emails(email, created_at) VALUES(?,?) ON CONFLICT(email) DO UPDATE SET created_at = excluded.created_at`, key, now)
 		return err
 	case "levels":
-		_, err := d.Exec(`INSERT OR REPLACE INTO levels(id, data, created_at) VALUES(?,?,?)`, key, value, now)
+		_, err := d.Exec(`INSERT INTO levels(id, data, created_at) VALUES(?,?,?) ON CONFLICT(id) DO UPDATE SET data = excluded.data, created_at = excluded.created_at`, key, value, now)
 		return err
 	case "sessions":
-		_, err := d.Exec(`INSERT OR REPLACE INTO sessions(session_id, email, created_at) VALUES(?,?,?)`, key, value, now)
+		_, err := d.Exec(`INSERT INTO sessions(session_id, email, created_at, last_seen_at) VALUES(?,?,?,?) ON CONFLICT(session_id) DO UPDATE SET email = excluded.email, created_at = excluded.created_at, last_seen_at = excluded.last_seen_at`, key, value, now, now)
 		return err
 	case "announcements":
-		_, err := d.Exec(`INSERT OR REPLACE INTO announcements(id, data, created_at) VALUES(?,?,?)`, key, value, now)
-		return err
-	case "attempt_logs":
-		_, err := d.Exec(`INSERT OR REPLACE INTO attempt_logs(email, logs) VALUES(?,?)`, key, value)
+		_, err := d.Exec(`INSERT INTO announcements(id, data, created_at) VALUES(?,?,?) ON CONFLICT(id) DO UPDATE SET data = excluded.data, created_at = excluded.created_at`, key, value, now)
 		return err
 	case "hints":
 		parts := strings.SplitN(key, "/", 2)
@@ -129,7 +37,7 @@ func Set(d *sql.DB, namespace, key, value string) error {
 		}
 		levelID := parts[0]
 		hintID := parts[1]
-		_, err := d.Exec(`INSERT OR REPLACE INTO hints(level_id, hint_id, data, created_at) VALUES(?,?,?,?)`, levelID, hintID, value, now)
+		_, err := d.Exec(`INSERT INTO hints(level_id, hint_id, data, created_at) VALUES(?,?,?,?) ON CONFLICT(level_id, hint_id) DO UPDATE SET data = excluded.data, created_at = excluded.created_at`, levelID, hintID, value, now)
 		return err
 	case "logs":
 		parts := strings.SplitN(value, "|", 3)
@@ -150,11 +58,13 @@ func Set(d *sql.DB, namespace, key, value string) error {
 	case "messages":
 		v := strings.TrimSpace(value)
 		var dataStr string
+		obj := map[string]interface{}{}
 		if strings.HasPrefix(v, "{") || strings.HasPrefix(v, "[") {
 			dataStr = v
+			json.Unmarshal([]byte(v), &obj)
 		} else {
 			parts := strings.SplitN(value, "|", 5)
-			obj := map[string]interface{}{"from": "", "to": "", "level_id": "", "type": "", "content": ""}
+			obj = map[string]interface{}{"from": "", "to": "", "level_id": "", "type": "", "content": ""}
 			if len(parts) > 0 {
 				obj["from"] = parts[0]
 			}
@@ -173,33 +83,31 @@ func Set(d *sql.DB, namespace, key, value string) error {
 			b, _ := json.Marshal(obj)
 			dataStr = string(b)
 		}
-		_, err := d.Exec(`INSERT INTO messages(data, created_at, read) VALUES(?,?,?)`, dataStr, now, 0)
+		from, _ := obj["from"].(string)
+		to, _ := obj["to"].(string)
+		levelID, _ := obj["level_id"].(string)
+		typ, _ := obj["type"].(string)
+		_, err := d.Exec(`INSERT INTO messages(data, created_at, read, from_email, to_email, level_id, type) VALUES(?,?,?,?,?,?,?)`, dataStr, now, 0, from, to, levelID, typ)
 		return err
 	default:
-		_, err := d.Exec(`INSERT OR REPLACE INTO users(email, data, created_at) VALUES(?,?,?)`, key, value, now)
+		_, err := d.Exec(`INSERT INTO legacy_users(email, data, created_at) VALUES(?,?,?) ON CONFLICT(email) DO UPDATE SET data = excluded.data, created_at = excluded.created_at`, key, value, now)
 		return err
 	}
 }
 
-func Get(d *sql.DB, namespace, key string) (string, error) {
+func Get(d Queryer, namespace, key string) (string, error) {
 	var query string
 	switch namespace {
-	case "accounts", "registration", "users":
-		query = `SELECT data FROM users WHERE email = ?`
 	case "pending_signup":
 		query = `SELECT data FROM pending_signups WHERE email = ?`
 	case "emails":
 		query = `SELECT created_at FROM emails WHERE email = ?`
-	case "leaderboard":
-		query = `SELECT data FROM users WHERE email = ?`
 	case "levels":
 		query = `SELECT data FROM levels WHERE id = ?`
 	case "sessions":
 		query = `SELECT email FROM sessions WHERE session_id = ?`
 	case "announcements":
 		query = `SELECT data FROM announcements WHERE id = ?`
-	case "attempt_logs":
-		query = `SELECT logs FROM attempt_logs WHERE email = ?`
 	case "hints":
 		rows, err := d.Query(`SELECT hint_id, data FROM hints WHERE level_id = ? ORDER BY created_at ASC`, key)
 		if err != nil {
@@ -225,7 +133,7 @@ func Get(d *sql.DB, namespace, key string) (string, error) {
 		}
 		return string(b), nil
 	default:
-		query = `SELECT data FROM users WHERE email = ?`
+		query = `SELECT data FROM legacy_users WHERE email = ?`
 	}
 	row := d.QueryRow(query, key)
 	var out string
@@ -253,37 +161,19 @@ func Get(d *sql.DB, namespace, key string) (string, error) {
 	}
 }
 
-func Delete(d *sql.DB, namespace, key string) error {
+func Delete(d Queryer, namespace, key string) error {
 	if strings.HasPrefix(namespace, "messages/") {
 		email := strings.TrimPrefix(namespace, "messages/")
-		_, err := d.Exec(`DELETE FROM messages WHERE (json_extract(data, '$.from') = ? OR json_extract(data, '$.to') = ?) AND json_extract(data, '$.type') = ?`, email, email, key)
+		_, err := d.Exec(`DELETE FROM messages WHERE (from_email = ? OR to_email = ?) AND type = ?`, email, email, key)
 		return err
 	}
 	switch namespace {
-	case "accounts", "registration", "users":
-		_, err := d.Exec(`DELETE FROM users WHERE email = ?`, key)
-		return err
 	case "pending_signup":
 		_, err := d.Exec(`DELETE FROM pending_signups WHERE email = ?`, key)
 		return err
 	case "emails":
 		_, err := d.Exec(`DELETE FROM emails WHERE email = ?`, key)
 		return err
-	case "leaderboard":
-		var existing sql.NullString
-		if err := d.QueryRow(`SELECT data FROM users WHERE email = ?`, key).Scan(&existing); err != nil {
-			return err
-		}
-		if existing.Valid {
-			var user map[string]interface{}
-			json.Unmarshal([]byte(existing.String), &user)
-			delete(user, "points")
-			delete(user, "time")
-			ub, _ := json.Marshal(user)
-			_, err := d.Exec(`INSERT OR REPLACE INTO users(email, data, created_at) VALUES(?,?,?)`, key, string(ub), time.Now().Unix())
-			return err
-		}
-		return nil
 	case "levels":
 		_, err := d.Exec(`DELETE FROM levels WHERE id = ?`, key)
 		return err
@@ -293,9 +183,6 @@ func Delete(d *sql.DB, namespace, key string) error {
 	case "announcements":
 		_, err := d.Exec(`DELETE FROM announcements WHERE id = ?`, key)
 		return err
-	case "attempt_logs":
-		_, err := d.Exec(`DELETE FROM attempt_logs WHERE email = ?`, key)
-		return err
 	case "hints":
 		parts := strings.SplitN(key, "/", 2)
 		if len(parts) != 2 {
@@ -306,37 +193,28 @@ func Delete(d *sql.DB, namespace, key string) error {
 		_, err := d.Exec(`DELETE FROM hints WHERE level_id = ? AND hint_id = ?`, levelID, hintID)
 		return err
 	default:
-		_, err := d.Exec(`DELETE FROM users WHERE email = ?`, key)
+		_, err := d.Exec(`DELETE FROM legacy_users WHERE email = ?`, key)
 		return err
 	}
 }
 
-func GetAll(d *sql.DB, namespace string) (map[string]string, error) {
+func GetAll(d Queryer, namespace string) (map[string]string, error) {
 	res := map[string]string{}
 	var rows *sql.Rows
 	var err error
 	switch namespace {
-	case "accounts", "registration", "users":
-		rows, err = d.Query(`SELECT email, data FROM users`)
-
 	case "pending_signup":
 		rows, err = d.Query(`SELECT email, data FROM pending_signups`)
 	case "emails":
 		rows, err = d.Query(`SELECT email, created_at FROM emails`)
-	case "leaderboard":
-		rows, err = d.Query(`SELECT email, data FROM users`)
 	case "levels":
 		rows, err = d.Query(`SELECT id, data FROM levels`)
 	case "announcements":
 		rows, err = d.Query(`SELECT id, data FROM announcements`)
 	case "messages":
 		rows, err = d.Query(`SELECT id, data, created_at, read FROM messages ORDER BY created_at ASC`)
-	case "logs":
-		rows, err = d.Query(`SELECT id, namespace, key, event, data, created_at FROM logs ORDER BY created_at ASC`)
 	case "hints":
 		rows, err = d.Query(`SELECT level_id || '/' || hint_id as key, data FROM hints ORDER BY created_at ASC`)
-	case "attempt_logs":
-		rows, err = d.Query(`SELECT email, logs FROM attempt_logs`)
 	default:
 		return res, nil
 	}
@@ -381,54 +259,6 @@ func GetAll(d *sql.DB, namespace string) (map[string]string, error) {
 				return nil, err
 			}
 			res[key] = string(b)
-		case "logs":
-			var id int
-			var ns, keyCol, event, data sql.NullString
-			var createdAt sql.NullInt64
-			if err := rows.Scan(&id, &ns, &keyCol, &event, &data, &createdAt); err != nil {
-				return nil, err
-			}
-			keyLogs := fmt.Sprintf("%d", id)
-			entry := struct {
-				ID        int    `json:"id"`
-				Namespace string `json:"namespace"`
-				Key       string `json:"key"`
-				Event     string `json:"event"`
-				Data      string `json:"data"`
-				CreatedAt int64  `json:"created_at"`
-			}{
-				ID: id,
-				Namespace: func() string {
-					if ns.Valid {
-						return ns.String
-					}
-					return ""
-				}(),
-				Key: func() string {
-					if keyCol.Valid {
-						return keyCol.String
-					}
-					return ""
-				}(),
-				Event: func() string {
-					if event.Valid {
-						return event.String
-					}
-					return ""
-				}(),
-				Data: func() string {
-					if data.Valid {
-						return data.String
-					}
-					return ""
-				}(),
-				CreatedAt: createdAt.Int64,
-			}
-			b, err := json.Marshal(entry)
-			if err != nil {
-				return nil, err
-			}
-			res[keyLogs] = string(b)
 		default:
 			if err := rows.Scan(&k, &v); err != nil {
 				return nil, err
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+)
+
+type LogEntry struct {
+	ID        int64  `json:"id"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Event     string `json:"event"`
+	Data      string `json:"data"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// LogFilter selects rows from the logs table. Zero values match
+// everything. Cursor is the id of the last row already seen; pages
+// continue after it in the requested order.
+type LogFilter struct {
+	User      string
+	Namespace string
+	Event     string
+	Since     int64
+	Until     int64
+	Cursor    int64
+	Limit     int
+	Desc      bool
+}
+
+const logPageSize = 1000
+
+func (f LogFilter) query() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if f.User != "" {
+		where = append(where, "key = ?")
+		args = append(args, f.User)
+	}
+	if f.Namespace != "" {
+		where = append(where, "namespace = ?")
+		args = append(args, f.Namespace)
+	}
+	if f.Event != "" {
+		where = append(where, "event = ?")
+		args = append(args, f.Event)
+	}
+	if f.Since > 0 {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until)
+	}
+	order := "ASC"
+	if f.Cursor > 0 {
+		if f.Desc {
+			where = append(where, "id < ?")
+		} else {
+			where = append(where, "id > ?")
+		}
+		args = append(args, f.Cursor)
+	}
+	if f.Desc {
+		order = "DESC"
+	}
+	q := `SELECT id, namespace, key, event, data, created_at FROM logs`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY id " + order
+	if f.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	return q, args
+}
+
+func scanLog(rs rowScanner) (LogEntry, error) {
+	var e LogEntry
+	var ns, key, event, data sql.NullString
+	var createdAt sql.NullInt64
+	if err := rs.Scan(&e.ID, &ns, &key, &event, &data, &createdAt); err != nil {
+		return e, err
+	}
+	e.Namespace = ns.String
+	e.Key = key.String
+	e.Event = event.String
+	e.Data = data.String
+	e.CreatedAt = createdAt.Int64
+	return e, nil
+}
+
+// QueryLogs returns one page of matching log rows.
+func QueryLogs(d Queryer, f LogFilter) ([]LogEntry, error) {
+	q, args := f.query()
+	rows, err := d.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []LogEntry{}
+	for rows.Next() {
+		e, err := scanLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// StreamLogs calls fn for every matching row, reading in pages so no
+// single query holds the database for the whole export. f.Limit caps the
+// total number of rows; zero means no cap.
+func StreamLogs(d Queryer, f LogFilter, fn func(LogEntry) error) error {
+	remaining := f.Limit
+	for {
+		page := f
+		page.Limit = logPageSize
+		if remaining > 0 && remaining < logPageSize {
+			page.Limit = remaining
+		}
+		entries, err := QueryLogs(d, page)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if remaining > 0 {
+			remaining -= len(entries)
+			if remaining <= 0 {
+				return nil
+			}
+		}
+		if len(entries) < page.Limit {
+			return nil
+		}
+		f.Cursor = entries[len(entries)-1].ID
+	}
+}
+
+// NearMiss is one of a level's close patterns with how often submissions
+// hit it. The submissions themselves are not kept.
+type NearMiss struct {
+	Pattern string `json:"pattern"`
+	Count   int    `json:"count"`
+	Players int    `json:"players"`
+	LastAt  int64  `json:"last_at"`
+}
+
+// NearMisses groups the close log entries for levelID by pattern, most
+// common first.
+func NearMisses(d Queryer, levelID string, limit int) ([]NearMiss, error) {
+	rows, err := d.Query(`SELECT data, COUNT(*), COUNT(DISTINCT key), MAX(created_at) FROM logs WHERE namespace = 'close' AND event = ? GROUP BY data ORDER BY COUNT(*) DESC, MAX(created_at) DESC LIMIT ?`, levelID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []NearMiss{}
+	for rows.Next() {
+		var m NearMiss
+		var pattern sql.NullString
+		if err := rows.Scan(&pattern, &m.Count, &m.Players, &m.LastAt); err != nil {
+			return nil, err
+		}
+		m.Pattern = pattern.String
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,759 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redactAnswersVersion is the first schema without answers in solves and
+// logs; older bundles are redacted on import.
+const redactAnswersVersion = 17
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *Tx) error
+}
+
+var migrations = []migration{
+	{1, "baseline", migrateBaseline},
+	{2, "typed_accounts", migrateTypedAccounts},
+	{3, "message_columns", migrateMessageColumns},
+	{4, "account_version", migrateAccountVersion},
+	{5, "settings", migrateSettings},
+	{6, "log_indexes", migrateLogIndexes},
+	{7, "attempts", migrateAttempts},
+	{8, "otps", migrateOTPs},
+	{9, "session_metadata", migrateSessionMetadata},
+	{10, "totp", migrateTOTP},
+	{11, "roles", migrateRoles},
+	{12, "audit_log", migrateAuditLog},
+	{13, "sanctions", migrateSanctions},
+	{14, "view_as", migrateViewAs},
+	{15, "tracks", migrateTracks},
+	{16, "levels_reveal", migrateLevelsReveal},
+	{redactAnswersVersion, "redact_answers", migrateRedactAnswers},
+}
+
+func Migrate(d Store) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.ExecDDL(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT,
+	applied_at INTEGER
+)`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	applied := map[int]bool{}
+	rows, err := d.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations(version, name, applied_at) VALUES(?,?,?)`, m.version, m.name, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SchemaVersion(d Store) (int, error) {
+	var v sql.NullInt64
+	if err := d.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+func migrateBaseline(tx *Tx) error {
+	return tx.ExecDDL(`
+CREATE TABLE IF NOT EXISTS users (
+	email TEXT PRIMARY KEY,
+	data TEXT,
+	created_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS attempt_logs (
+	email TEXT PRIMARY KEY,
+	logs TEXT
+);
+CREATE TABLE IF NOT EXISTS pending_signups (
+	email TEXT PRIMARY KEY,
+	data TEXT,
+	created_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS emails (
+	email TEXT PRIMARY KEY,
+	created_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS levels (
+	id TEXT PRIMARY KEY,
+	data TEXT,
+	created_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS announcements (
+	id TEXT PRIMARY KEY,
+	data TEXT,
+	created_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS hints (
+	level_id TEXT,
+	hint_id TEXT,
+	data TEXT,
+	created_at INTEGER,
+	PRIMARY KEY (level_id, hint_id)
+);
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	data TEXT,
+	created_at INTEGER,
+	read INTEGER DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS logs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	namespace TEXT,
+	key TEXT,
+	event TEXT,
+	data TEXT,
+	created_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	session_id TEXT PRIMARY KEY,
+	email TEXT,
+	created_at INTEGER
+);
+`)
+}
+
+// migrateTypedAccounts splits the old users(email, data) JSON blobs into
+// accounts, progress, checkpoints and solves. Rows that are not player
+// accounts (settings that fell through to the users table) are left behind
+// in legacy_users.
+func migrateTypedAccounts(tx *Tx) error {
+	err := tx.ExecDDL(`
+CREATE TABLE accounts (
+	email TEXT PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT '',
+	phonenumber TEXT NOT NULL DEFAULT '',
+	password TEXT NOT NULL DEFAULT '',
+	bio TEXT NOT NULL DEFAULT '',
+	bio_public BOOLEAN NOT NULL DEFAULT FALSE,
+	admin BOOLEAN NOT NULL DEFAULT FALSE,
+	disqualified BOOLEAN NOT NULL DEFAULT FALSE,
+	points INTEGER NOT NULL DEFAULT 0,
+	last_solve_at INTEGER NOT NULL DEFAULT 0,
+	last_submit_at INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX idx_accounts_leaderboard ON accounts(points DESC, last_solve_at ASC);
+CREATE TABLE progress (
+	email TEXT NOT NULL,
+	track TEXT NOT NULL,
+	level INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (email, track)
+);
+CREATE TABLE checkpoints (
+	email TEXT NOT NULL,
+	track TEXT NOT NULL,
+	level_id TEXT NOT NULL,
+	checkpoint INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (email, track)
+);
+CREATE TABLE solves (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL,
+	track TEXT NOT NULL,
+	level_id TEXT NOT NULL,
+	answer TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (email, level_id)
+);
+CREATE INDEX idx_solves_email ON solves(email, created_at);
+CREATE INDEX idx_solves_level ON solves(level_id);
+ALTER TABLE users RENAME TO legacy_users;
+`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT email, data, created_at FROM legacy_users`)
+	if err != nil {
+		return err
+	}
+	type legacy struct {
+		email     string
+		data      map[string]interface{}
+		createdAt int64
+	}
+	var accts []legacy
+	for rows.Next() {
+		var email string
+		var data sql.NullString
+		var createdAt sql.NullInt64
+		if err := rows.Scan(&email, &data, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		var m map[string]interface{}
+		if !data.Valid || json.Unmarshal([]byte(data.String), &m) != nil || m == nil {
+			continue
+		}
+		accts = append(accts, legacy{email: email, data: m, createdAt: createdAt.Int64})
+	}
+	rows.Close()
+
+	now := time.Now().Unix()
+	for _, a := range accts {
+		m := a.data
+		created := int64(legacyNumber(m["created_at"]))
+		if created == 0 {
+			created = a.createdAt
+		}
+		levels := map[string]int{}
+		if lm, ok := m["levels"].(map[string]interface{}); ok {
+			for track, v := range lm {
+				levels[track] = int(legacyNumber(v))
+			}
+		}
+		points := 0
+		for _, n := range levels {
+			points += n
+		}
+		if len(levels) == 0 {
+			points = int(legacyNumber(m["points"]))
+		}
+		if _, err := tx.Exec(`INSERT INTO accounts(email, name, phonenumber, password, bio, bio_public, admin, disqualified, points, last_solve_at, last_submit_at, created_at, updated_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+			a.email, legacyString(m["name"]), legacyString(m["phonenumber"]), legacyString(m["password"]), legacyString(m["bio"]),
+			legacyBool(m["bio_public"]), legacyBool(m["admin"]), legacyBool(m["disqualified"]),
+			points, int64(legacyNumber(m["time"])), int64(legacyNumber(m["last_submit"])), created, now); err != nil {
+			return err
+		}
+		for track, lvl := range levels {
+			if _, err := tx.Exec(`INSERT INTO progress(email, track, level, updated_at) VALUES(?,?,?,?)`, a.email, track, lvl, now); err != nil {
+				return err
+			}
+		}
+		checkpoints := map[string][]interface{}{}
+		switch p := m["progress"].(type) {
+		case map[string]interface{}:
+			for track, v := range p {
+				if arr, ok := v.([]interface{}); ok && len(arr) >= 2 {
+					checkpoints[track] = arr
+				}
+			}
+		case []interface{}:
+			if len(p) >= 2 {
+				checkpoints["cryptic"] = p
+			}
+		}
+		for track, arr := range checkpoints {
+			levelID := legacyString(arr[0])
+			if levelID == "" {
+				continue
+			}
+			if _, err := tx.Exec(`INSERT INTO checkpoints(email, track, level_id, checkpoint, updated_at) VALUES(?,?,?,?,?)`, a.email, track, levelID, int(legacyNumber(arr[1])), now); err != nil {
+				return err
+			}
+		}
+		if err := backfillSolves(tx, a.email, levels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillSolves reconstructs solves from "submit" log rows. Levels are
+// solved in order, so the n-th correct submission on a track is level n-1.
+func backfillSolves(tx *Tx, email string, levels map[string]int) error {
+	rows, err := tx.Query(`SELECT event, data, created_at FROM logs WHERE key = ? AND namespace = 'submit' ORDER BY created_at ASC, id ASC`, email)
+	if err != nil {
+		return err
+	}
+	type solve struct {
+		track, levelID string
+		at             int64
+	}
+	var solves []solve
+	seen := map[string]int{}
+	for rows.Next() {
+		var event, data sql.NullString
+		var at sql.NullInt64
+		if err := rows.Scan(&event, &data, &at); err != nil {
+			rows.Close()
+			return err
+		}
+		if !strings.HasSuffix(data.String, "|correct") {
+			continue
+		}
+		track := event.String
+		n := seen[track]
+		if n >= levels[track] {
+			continue
+		}
+		seen[track] = n + 1
+		solves = append(solves, solve{track: track, levelID: track + "-" + strconv.Itoa(n), at: at.Int64})
+	}
+	rows.Close()
+	for _, s := range solves {
+		if _, err := tx.Exec(`INSERT INTO solves(email, track, level_id, created_at) VALUES(?,?,?,?) ON CONFLICT(email, level_id) DO NOTHING`, email, s.track, s.levelID, s.at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateMessageColumns copies the routing fields out of the messages JSON
+// so they can be queried without backend-specific JSON functions.
+func migrateMessageColumns(tx *Tx) error {
+	err := tx.ExecDDL(`
+ALTER TABLE messages ADD COLUMN from_email TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN to_email TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN level_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN type TEXT NOT NULL DEFAULT '';
+CREATE INDEX idx_messages_from ON messages(from_email, type);
+CREATE INDEX idx_messages_to ON messages(to_email, type);
+`)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT id, data FROM messages`)
+	if err != nil {
+		return err
+	}
+	type msg struct {
+		id   int64
+		data map[string]interface{}
+	}
+	var msgs []msg
+	for rows.Next() {
+		var id int64
+		var data sql.NullString
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		var m map[string]interface{}
+		if json.Unmarshal([]byte(data.String), &m) != nil {
+			continue
+		}
+		msgs = append(msgs, msg{id: id, data: m})
+	}
+	rows.Close()
+	for _, m := range msgs {
+		if _, err := tx.Exec(`UPDATE messages SET from_email = ?, to_email = ?, level_id = ?, type = ? WHERE id = ?`,
+			legacyString(m.data["from"]), legacyString(m.data["to"]), legacyString(m.data["level_id"]), legacyString(m.data["type"]), m.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAccountVersion(tx *Tx) error {
+	return tx.ExecDDL(`ALTER TABLE accounts ADD COLUMN version INTEGER NOT NULL DEFAULT 0;`)
+}
+
+// migrateSettings creates the settings store and moves the ai_leads flag
+// out of legacy_users, where the old "settings" namespace landed.
+func migrateSettings(tx *Tx) error {
+	err := tx.ExecDDL(`
+CREATE TABLE settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL DEFAULT '',
+	updated_by TEXT NOT NULL DEFAULT '',
+	updated_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE settings_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	key TEXT NOT NULL,
+	old_value TEXT NOT NULL DEFAULT '',
+	new_value TEXT NOT NULL DEFAULT '',
+	changed_by TEXT NOT NULL DEFAULT '',
+	changed_at INTEGER NOT NULL
+);
+CREATE INDEX idx_settings_history_key ON settings_history(key, id);
+`)
+	if err != nil {
+		return err
+	}
+	var data sql.NullString
+	err = tx.QueryRow(`SELECT data FROM legacy_users WHERE email = ?`, "ai_leads").Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	value := "true"
+	switch strings.ToLower(strings.Trim(strings.TrimSpace(data.String), `"`)) {
+	case "0", "false", "off":
+		value = "false"
+	}
+	now := time.Now().Unix()
+	if _, err := tx.Exec(`INSERT INTO settings(key, value, updated_by, updated_at) VALUES(?,?,?,?)`, "ai_leads", value, "migration", now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO settings_history(key, old_value, new_value, changed_by, changed_at) VALUES(?,?,?,?,?)`, "ai_leads", "", value, "migration", now); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM legacy_users WHERE email = ?`, "ai_leads")
+	return err
+}
+
+func migrateLogIndexes(tx *Tx) error {
+	return tx.ExecDDL(`
+CREATE INDEX idx_logs_key ON logs(key, id);
+CREATE INDEX idx_logs_namespace_event ON logs(namespace, event, id);
+CREATE INDEX idx_logs_created ON logs(created_at, id);
+`)
+}
+
+// migrateAttempts splits the per-user attempt_logs strings into one row
+// per attempt. The old table is kept as legacy_attempt_logs.
+func migrateAttempts(tx *Tx) error {
+	err := tx.ExecDDL(`
+CREATE TABLE attempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL,
+	track TEXT NOT NULL DEFAULT '',
+	level_id TEXT NOT NULL DEFAULT '',
+	payload TEXT NOT NULL DEFAULT '',
+	session TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX idx_attempts_email ON attempts(email, id);
+CREATE INDEX idx_attempts_level ON attempts(level_id, id);
+CREATE INDEX idx_attempts_track ON attempts(track, id);
+ALTER TABLE attempt_logs RENAME TO legacy_attempt_logs;
+`)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT email, logs FROM legacy_attempt_logs`)
+	if err != nil {
+		return err
+	}
+	var all []Attempt
+	for rows.Next() {
+		var email string
+		var raw sql.NullString
+		if err := rows.Scan(&email, &raw); err != nil {
+			rows.Close()
+			return err
+		}
+		var blob struct {
+			Logs string `json:"logs"`
+		}
+		if json.Unmarshal([]byte(raw.String), &blob) != nil {
+			continue
+		}
+		all = append(all, parseLegacyAttempts(strings.ToLower(email), blob.Logs)...)
+	}
+	rows.Close()
+	sort.SliceStable(all, func(i, j int) bool { return all[i].CreatedAt < all[j].CreatedAt })
+	for i := range all {
+		if err := AddAttempt(tx, &all[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateOTPs(tx *Tx) error {
+	return tx.ExecDDL(`
+CREATE TABLE otps (
+	email TEXT PRIMARY KEY,
+	code_hash TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE otp_sends (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL,
+	ip TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX idx_otp_sends_email ON otp_sends(email, created_at);
+CREATE INDEX idx_otp_sends_ip ON otp_sends(ip, created_at);
+`)
+}
+
+// migrateSessionMetadata adds device details and activity tracking to
+// sessions. Existing sessions count as last seen when they were created.
+func migrateSessionMetadata(tx *Tx) error {
+	return tx.ExecDDL(`
+ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN last_seen_at INTEGER NOT NULL DEFAULT 0;
+UPDATE sessions SET created_at = 0 WHERE created_at IS NULL;
+UPDATE sessions SET last_seen_at = created_at;
+CREATE INDEX idx_sessions_email ON sessions(email);
+`)
+}
+
+func migrateTOTP(tx *Tx) error {
+	return tx.ExecDDL(`
+CREATE TABLE totp (
+	email TEXT PRIMARY KEY,
+	secret TEXT NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	last_step INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL
+);
+CREATE TABLE recovery_codes (
+	email TEXT NOT NULL,
+	code_hash TEXT NOT NULL,
+	used_at INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (email, code_hash)
+);
+ALTER TABLE sessions ADD COLUMN mfa BOOLEAN NOT NULL DEFAULT FALSE;
+`)
+}
+
+// migrateRoles creates the role tables with the built-in roles and makes
+// every account flagged admin an owner.
+func migrateRoles(tx *Tx) error {
+	if err := tx.ExecDDL(`
+CREATE TABLE roles (
+	name TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE role_permissions (
+	role TEXT NOT NULL,
+	permission TEXT NOT NULL,
+	PRIMARY KEY (role, permission)
+);
+CREATE TABLE account_roles (
+	email TEXT NOT NULL,
+	role TEXT NOT NULL,
+	granted_by TEXT NOT NULL DEFAULT '',
+	granted_at INTEGER NOT NULL,
+	PRIMARY KEY (email, role)
+);
+CREATE INDEX idx_account_roles_role ON account_roles(role);
+`); err != nil {
+		return err
+	}
+	for _, r := range BuiltinRoles {
+		if _, err := tx.Exec(`INSERT INTO roles(name, description) VALUES(?,?)`, r.Name, r.Description); err != nil {
+			return err
+		}
+		for _, p := range r.Permissions {
+			if _, err := tx.Exec(`INSERT INTO role_permissions(role, permission) VALUES(?,?)`, r.Name, p); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.Exec(`INSERT INTO account_roles(email, role, granted_by, granted_at) SELECT email, ?, 'migration', ? FROM accounts WHERE admin = ?`, RoleOwner, time.Now().Unix(), true)
+	return err
+}
+
+// migrateAuditLog creates audit_log with triggers that refuse updates and
+// deletes, so not even a bug in the app can rewrite the record.
+func migrateAuditLog(tx *Tx) error {
+	if err := tx.ExecDDL(`
+CREATE TABLE audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target TEXT NOT NULL DEFAULT '',
+	before_json TEXT NOT NULL DEFAULT '',
+	after_json TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX idx_audit_log_actor ON audit_log(actor, id);
+CREATE INDEX idx_audit_log_target ON audit_log(target, id);
+CREATE INDEX idx_audit_log_action ON audit_log(action, id);
+`); err != nil {
+		return err
+	}
+	if tx.Driver() == "postgres" {
+		return tx.ExecDDL(`
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+`)
+	}
+	return tx.ExecDDL(`
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+`)
+}
+
+// migrateSanctions adds account_sanctions and gives accounts that were
+// already disqualified a row, so the admin list can show them.
+func migrateSanctions(tx *Tx) error {
+	if err := tx.ExecDDL(`
+CREATE TABLE account_sanctions (
+	email TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	expires_at INTEGER NOT NULL DEFAULT 0,
+	set_by TEXT NOT NULL DEFAULT '',
+	set_at INTEGER NOT NULL,
+	PRIMARY KEY (email, kind)
+);
+CREATE INDEX idx_account_sanctions_kind ON account_sanctions(kind);
+`); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO account_sanctions(email, kind, set_by, set_at) SELECT email, ?, 'migration', ? FROM accounts WHERE disqualified = ?`, SanctionDisqualified, time.Now().Unix(), true)
+	return err
+}
+
+// migrateViewAs lets a staff session view the site as a player, and gives
+// the built-in support role the permission to, as it has in BuiltinRoles.
+func migrateViewAs(tx *Tx) error {
+	if err := tx.ExecDDL(`ALTER TABLE sessions ADD COLUMN view_as TEXT NOT NULL DEFAULT '';`); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO role_permissions(role, permission) SELECT name, ? FROM roles WHERE name = 'support' ON CONFLICT DO NOTHING`, PermUsersImpersonate)
+	return err
+}
+
+// migrateTracks moves the cryptic and ctf tracks into the tracks table. A
+// track that was switched off with its track.<id>.enabled setting starts
+// closed, and the settings go away.
+func migrateTracks(tx *Tx) error {
+	if err := tx.ExecDDL(`
+CREATE TABLE tracks (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	match_mode TEXT NOT NULL DEFAULT 'exact',
+	weight INTEGER NOT NULL DEFAULT 1,
+	visibility TEXT NOT NULL DEFAULT 'open',
+	position INTEGER NOT NULL DEFAULT 0,
+	updated_by TEXT NOT NULL DEFAULT '',
+	updated_at INTEGER NOT NULL DEFAULT 0
+);
+`); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for i, t := range []Track{{ID: "cryptic", Name: "Cryptic", Match: MatchCaseInsensitive}, {ID: "ctf", Name: "CTF", Match: MatchExact}} {
+		visibility := TrackOpen
+		var v string
+		err := tx.QueryRow(`SELECT value FROM settings WHERE key = ?`, "track."+t.ID+".enabled").Scan(&v)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil && v == "false" {
+			visibility = TrackClosed
+		}
+		if _, err := tx.Exec(`INSERT INTO tracks(id, name, match_mode, weight, visibility, position, updated_by, updated_at) VALUES(?,?,?,?,?,?,?,?)`, t.ID, t.Name, t.Match, 1, visibility, i, "migration", now); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`DELETE FROM settings WHERE key IN (?, ?)`, "track.cryptic.enabled", "track.ctf.enabled")
+	return err
+}
+
+// migrateLevelsReveal lets level authors keep seeing answers now that
+// levels.read no longer shows them.
+func migrateLevelsReveal(tx *Tx) error {
+	_, err := tx.Exec(`INSERT INTO role_permissions(role, permission) SELECT name, ? FROM roles WHERE name = 'level-author' ON CONFLICT DO NOTHING`, PermLevelsReveal)
+	return err
+}
+
+// migrateRedactAnswers clears the answer text that solves and correct
+// submission logs kept, which gave away every level's answer. Close log
+// entries held the guess itself; they now hold the close pattern it hit, and
+// older ones are blanked since the pattern is not known here.
+func migrateRedactAnswers(tx *Tx) error {
+	if _, err := tx.Exec(`UPDATE solves SET answer = ''`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE logs SET data = '|correct' WHERE namespace = 'submit' AND data LIKE '%|correct'`); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE logs SET data = '' WHERE namespace = 'close'`)
+	return err
+}
+
+func legacyString(v interface{}) string {
+	switch tv := v.(type) {
+	case string:
+		return tv
+	case float64:
+		return strconv.FormatInt(int64(tv), 10)
+	}
+	return ""
+}
+
+func legacyNumber(v interface{}) float64 {
+	switch tv := v.(type) {
+	case float64:
+		return tv
+	case string:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(tv), 64)
+		return f
+	case bool:
+		if tv {
+			return 1
+		}
+	}
+	return 0
+}
+
+func legacyBool(v interface{}) bool {
+	switch tv := v.(type) {
+	case bool:
+		return tv
+	case float64:
+		return tv != 0
+	case string:
+		s := strings.ToLower(strings.TrimSpace(tv))
+		return s == "1" || s == "true"
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Sanction kinds. A disqualified account can no longer play and drops off
+// the leaderboard; a suspended one cannot play until the suspension runs
+// out; a muted one cannot message the admins; a hidden one is left off the
+// leaderboard for everyone but itself.
+const (
+	SanctionDisqualified = "disqualified"
+	SanctionSuspended    = "suspended"
+	SanctionMuted        = "muted"
+	SanctionHidden       = "hidden"
+)
+
+var SanctionKinds = []string{SanctionDisqualified, SanctionSuspended, SanctionMuted, SanctionHidden}
+
+func IsSanctionKind(kind string) bool {
+	for _, k := range SanctionKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Sanction is one moderation action on an account. ExpiresAt is zero for
+// sanctions that last until lifted.
+type Sanction struct {
+	Email     string `json:"email"`
+	Kind      string `json:"kind"`
+	Reason    string `json:"reason"`
+	ExpiresAt int64  `json:"expires_at"`
+	SetBy     string `json:"set_by"`
+	SetAt     int64  `json:"set_at"`
+}
+
+// Sanctions are an account's active sanctions by kind.
+type Sanctions map[string]Sanction
+
+func (s Sanctions) Has(kind string) bool {
+	_, ok := s[kind]
+	return ok
+}
+
+// Disqualification lives in accounts.disqualified, which submissions and
+// bundles already use; account_sanctions only adds who, when and why.
+const sanctionsQuery = `
+SELECT email, kind, reason, expires_at, set_by, set_at FROM account_sanctions
+	WHERE kind <> 'disqualified' AND (expires_at = 0 OR expires_at > ?)%s
+UNION ALL
+SELECT a.email, 'disqualified', COALESCE(s.reason, ''), 0, COALESCE(s.set_by, ''), COALESCE(s.set_at, a.updated_at)
+	FROM accounts a LEFT JOIN account_sanctions s ON s.email = a.email AND s.kind = 'disqualified'
+	WHERE a.disqualified = ?%s`
+
+func scanSanctions(rows *sql.Rows) ([]Sanction, error) {
+	defer rows.Close()
+	out := []Sanction{}
+	for rows.Next() {
+		var s Sanction
+		if err := rows.Scan(&s.Email, &s.Kind, &s.Reason, &s.ExpiresAt, &s.SetBy, &s.SetAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// GetSanctions returns email's active sanctions.
+func GetSanctions(d Queryer, email string) (Sanctions, error) {
+	rows, err := d.Query(fmt.Sprintf(sanctionsQuery, " AND email = ?", " AND a.email = ?"), time.Now().Unix(), email, true, email)
+	if err != nil {
+		return nil, err
+	}
+	list, err := scanSanctions(rows)
+	if err != nil {
+		return nil, err
+	}
+	out := Sanctions{}
+	for _, s := range list {
+		out[s.Kind] = s
+	}
+	return out, nil
+}
+
+// ListSanctions returns every account's active sanctions, keyed by email.
+func ListSanctions(d Queryer) (map[string]Sanctions, error) {
+	rows, err := d.Query(fmt.Sprintf(sanctionsQuery, "", ""), time.Now().Unix(), true)
+	if err != nil {
+		return nil, err
+	}
+	list, err := scanSanctions(rows)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]Sanctions{}
+	for _, s := range list {
+		if out[s.Email] == nil {
+			out[s.Email] = Sanctions{}
+		}
+		out[s.Email][s.Kind] = s
+	}
+	return out, nil
+}
+
+// SetSanction applies s, replacing an earlier sanction of the same kind.
+func SetSanction(d Store, s Sanction) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO account_sanctions(email, kind, reason, expires_at, set_by, set_at) VALUES(?,?,?,?,?,?) ON CONFLICT(email, kind) DO UPDATE SET reason = excluded.reason, expires_at = excluded.expires_at, set_by = excluded.set_by, set_at = excluded.set_at`,
+		s.Email, s.Kind, s.Reason, s.ExpiresAt, s.SetBy, s.SetAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if s.Kind == SanctionDisqualified {
+		if err := setDisqualified(tx, s.Email, true); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LiftSanction removes email's sanction of kind. It reports whether one
+// was in force.
+func LiftSanction(d Store, email, kind string) (bool, error) {
+	active, err := GetSanctions(d, email)
+	if err != nil {
+		return false, err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM account_sanctions WHERE email = ? AND kind = ?`, email, kind); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if kind == SanctionDisqualified {
+		if err := setDisqualified(tx, email, false); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	return active.Has(kind), tx.Commit()
+}
+
+func setDisqualified(tx *Tx, email string, v bool) error {
+	res, err := tx.Exec(`UPDATE accounts SET disqualified = ?, updated_at = ?, version = version + 1 WHERE email = ?`, v, time.Now().Unix(), email)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
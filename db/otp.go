@@ -0,0 +1,185 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrOTPInvalid         = errors.New("incorrect otp")
+	ErrOTPExpired         = errors.New("otp expired")
+	ErrOTPTooManyAttempts = errors.New("too many otp attempts")
+)
+
+// ThrottleError is returned when a resend is refused.
+type ThrottleError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("too many requests, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// OTPs issues and verifies one-time signup codes. Now is the clock used
+// for every expiry and throttle decision and can be replaced in tests.
+type OTPs struct {
+	d   Store
+	Now func() time.Time
+
+	TTL            time.Duration
+	MaxAttempts    int
+	ResendInterval time.Duration
+	Window         time.Duration
+	MaxPerEmail    int
+	MaxPerIP       int
+	PendingTTL     time.Duration
+}
+
+func NewOTPs(d Store) *OTPs {
+	return &OTPs{
+		d:              d,
+		Now:            time.Now,
+		TTL:            10 * time.Minute,
+		MaxAttempts:    5,
+		ResendInterval: time.Minute,
+		Window:         time.Hour,
+		MaxPerEmail:    5,
+		MaxPerIP:       20,
+		PendingTTL:     24 * time.Hour,
+	}
+}
+
+func otpHash(email, code string) string {
+	h := sha256.Sum256([]byte(email + "|" + code))
+	return hex.EncodeToString(h[:])
+}
+
+// Issue creates a fresh code for email, replacing any earlier one, unless
+// the email or ip has hit its resend limit.
+func (o *OTPs) Issue(email, ip string) (string, error) {
+	now := o.Now()
+	tx, err := o.d.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	since := now.Add(-o.Window).Unix()
+	var last sql.NullInt64
+	var n int
+	if err := tx.QueryRow(`SELECT MAX(created_at), COUNT(*) FROM otp_sends WHERE email = ? AND created_at > ?`, email, since).Scan(&last, &n); err != nil {
+		return "", err
+	}
+	if last.Valid {
+		if wait := time.Unix(last.Int64, 0).Add(o.ResendInterval).Sub(now); wait > 0 {
+			return "", &ThrottleError{RetryAfter: wait}
+		}
+	}
+	if n >= o.MaxPerEmail {
+		return "", &ThrottleError{RetryAfter: o.oldestRetry(tx, `email = ?`, email, since, now)}
+	}
+	if ip != "" {
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM otp_sends WHERE ip = ? AND created_at > ?`, ip, since).Scan(&n); err != nil {
+			return "", err
+		}
+		if n >= o.MaxPerIP {
+			return "", &ThrottleError{RetryAfter: o.oldestRetry(tx, `ip = ?`, ip, since, now)}
+		}
+	}
+	v, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", v.Int64())
+	if _, err := tx.Exec(`INSERT INTO otps(email, code_hash, created_at, expires_at, attempts) VALUES(?,?,?,?,0) ON CONFLICT(email) DO UPDATE SET code_hash = excluded.code_hash, created_at = excluded.created_at, expires_at = excluded.expires_at, attempts = 0`,
+		email, otpHash(email, code), now.Unix(), now.Add(o.TTL).Unix()); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`INSERT INTO otp_sends(email, ip, created_at) VALUES(?,?,?)`, email, ip, now.Unix()); err != nil {
+		return "", err
+	}
+	return code, tx.Commit()
+}
+
+func (o *OTPs) oldestRetry(tx *Tx, cond string, arg interface{}, since int64, now time.Time) time.Duration {
+	var oldest sql.NullInt64
+	tx.QueryRow(`SELECT MIN(created_at) FROM otp_sends WHERE `+cond+` AND created_at > ?`, arg, since).Scan(&oldest)
+	if !oldest.Valid {
+		return o.Window
+	}
+	return time.Unix(oldest.Int64, 0).Add(o.Window).Sub(now)
+}
+
+// Verify checks code for email. A correct code is consumed; a code that
+// expires or runs out of attempts is removed.
+func (o *OTPs) Verify(email, code string) error {
+	now := o.Now()
+	tx, err := o.d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var hash string
+	var expiresAt int64
+	var attempts int
+	err = tx.QueryRow(`SELECT code_hash, expires_at, attempts FROM otps WHERE email = ?`, email).Scan(&hash, &expiresAt, &attempts)
+	if err == sql.ErrNoRows {
+		return ErrOTPInvalid
+	}
+	if err != nil {
+		return err
+	}
+	var result error
+	switch {
+	case now.Unix() >= expiresAt:
+		result = ErrOTPExpired
+	case attempts >= o.MaxAttempts:
+		result = ErrOTPTooManyAttempts
+	case subtle.ConstantTimeCompare([]byte(hash), []byte(otpHash(email, code))) == 1:
+		result = nil
+	default:
+		attempts++
+		if attempts < o.MaxAttempts {
+			if _, err := tx.Exec(`UPDATE otps SET attempts = ? WHERE email = ?`, attempts, email); err != nil {
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			return ErrOTPInvalid
+		}
+		result = ErrOTPTooManyAttempts
+	}
+	if _, err := tx.Exec(`DELETE FROM otps WHERE email = ?`, email); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return result
+}
+
+// Cleanup drops expired codes, send records outside the throttle window
+// and signups that were never completed.
+func (o *OTPs) Cleanup() error {
+	now := o.Now()
+	for _, q := range []struct {
+		query string
+		arg   int64
+	}{
+		{`DELETE FROM otps WHERE expires_at <= ?`, now.Unix()},
+		{`DELETE FROM otp_sends WHERE created_at <= ?`, now.Add(-o.Window).Unix()},
+		{`DELETE FROM pending_signups WHERE created_at <= ?`, now.Add(-o.PendingTTL).Unix()},
+	} {
+		if _, err := o.d.Exec(q.query, q.arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
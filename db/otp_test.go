@@ -0,0 +1,120 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testOTPs returns OTPs on a fresh store whose clock only moves when the
+// test advances it.
+func testOTPs(t *testing.T) (*OTPs, func(time.Duration)) {
+	t.Helper()
+	o := NewOTPs(newTestStore(t))
+	now := time.Unix(1700000000, 0)
+	o.Now = func() time.Time { return now }
+	return o, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestOTPExpiry(t *testing.T) {
+	o, advance := testOTPs(t)
+	code, err := o.Issue("p@x.com", "1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	advance(o.TTL - time.Second)
+	if err := o.Verify("p@x.com", "wrong!"); !errors.Is(err, ErrOTPInvalid) {
+		t.Fatalf("wrong code before expiry: %v, want ErrOTPInvalid", err)
+	}
+	advance(time.Second)
+	if err := o.Verify("p@x.com", code); !errors.Is(err, ErrOTPExpired) {
+		t.Fatalf("code at expiry: %v, want ErrOTPExpired", err)
+	}
+	// an expired code is removed, so it stays unusable
+	if err := o.Verify("p@x.com", code); !errors.Is(err, ErrOTPInvalid) {
+		t.Fatalf("code after expiry: %v, want ErrOTPInvalid", err)
+	}
+}
+
+func TestOTPIsConsumed(t *testing.T) {
+	o, advance := testOTPs(t)
+	code, err := o.Issue("p@x.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	advance(o.TTL - time.Second)
+	if err := o.Verify("p@x.com", code); err != nil {
+		t.Fatalf("code just before expiry: %v", err)
+	}
+	if err := o.Verify("p@x.com", code); !errors.Is(err, ErrOTPInvalid) {
+		t.Fatalf("reused code: %v, want ErrOTPInvalid", err)
+	}
+}
+
+func TestOTPResendThrottle(t *testing.T) {
+	o, advance := testOTPs(t)
+	if _, err := o.Issue("p@x.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	advance(o.ResendInterval - 10*time.Second)
+	_, err := o.Issue("p@x.com", "")
+	var te *ThrottleError
+	if !errors.As(err, &te) || te.RetryAfter != 10*time.Second {
+		t.Fatalf("resend too soon: %v, want a 10s ThrottleError", err)
+	}
+	advance(10 * time.Second)
+	if _, err := o.Issue("p@x.com", ""); err != nil {
+		t.Fatalf("resend after the interval: %v", err)
+	}
+
+	// MaxPerEmail sends fill the window; the next waits for the oldest
+	for i := 2; i < o.MaxPerEmail; i++ {
+		advance(o.ResendInterval)
+		if _, err := o.Issue("p@x.com", ""); err != nil {
+			t.Fatalf("send %d: %v", i+1, err)
+		}
+	}
+	advance(o.ResendInterval)
+	if _, err := o.Issue("p@x.com", ""); !errors.As(err, &te) {
+		t.Fatalf("send past MaxPerEmail: %v, want ThrottleError", err)
+	}
+	want := o.Window - time.Duration(o.MaxPerEmail)*o.ResendInterval
+	if te.RetryAfter != want {
+		t.Fatalf("retry after %s, want %s", te.RetryAfter, want)
+	}
+	advance(te.RetryAfter)
+	if _, err := o.Issue("p@x.com", ""); err != nil {
+		t.Fatalf("send once the oldest left the window: %v", err)
+	}
+
+	// the ip limit spans emails
+	o.MaxPerIP = 2
+	for _, email := range []string{"a@x.com", "b@x.com"} {
+		if _, err := o.Issue(email, "5.6.7.8"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := o.Issue("c@x.com", "5.6.7.8"); !errors.As(err, &te) {
+		t.Fatalf("send past MaxPerIP: %v, want ThrottleError", err)
+	}
+}
+
+func TestOTPAttemptLimit(t *testing.T) {
+	o, _ := testOTPs(t)
+	code, err := o.Issue("p@x.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < o.MaxAttempts; i++ {
+		if err := o.Verify("p@x.com", "wrong!"); !errors.Is(err, ErrOTPInvalid) {
+			t.Fatalf("attempt %d: %v, want ErrOTPInvalid", i, err)
+		}
+	}
+	if err := o.Verify("p@x.com", "wrong!"); !errors.Is(err, ErrOTPTooManyAttempts) {
+		t.Fatalf("last attempt: %v, want ErrOTPTooManyAttempts", err)
+	}
+	// the code is gone, even the right one no longer works
+	if err := o.Verify("p@x.com", code); !errors.Is(err, ErrOTPInvalid) {
+		t.Fatalf("right code after the limit: %v, want ErrOTPInvalid", err)
+	}
+}
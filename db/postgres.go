@@ -0,0 +1,64 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) name() string { return "postgres" }
+
+// rebind turns "?" placeholders into "$1", "$2", ... leaving quoted
+// literals alone.
+func (postgresDialect) rebind(query string) string {
+	var sb strings.Builder
+	n := 0
+	inQuote := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			inQuote = !inQuote
+		}
+		if c == '?' && !inQuote {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+var pgIntegerRe = regexp.MustCompile(`\bINTEGER\b`)
+
+func (postgresDialect) ddl(schema string) string {
+	schema = strings.ReplaceAll(schema, "INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY")
+	return pgIntegerRe.ReplaceAllString(schema, "BIGINT")
+}
+
+func (postgresDialect) insertID(q querier, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := q.QueryRow(query+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
+
+func OpenPostgres(dsn string) (Store, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("postgres: DB_DSN is not set")
+	}
+	d, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Ping(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return &sqlStore{db: d, d: postgresDialect{}}, nil
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Permissions a role can hold. PermAll is only held by owner and matches
+// every other permission.
+const (
+	PermAll                = "*"
+	PermLevelsRead         = "levels.read"
+	PermLevelsWrite        = "levels.write"
+	PermLevelsReveal       = "levels.reveal"
+	PermLevelsPlaytest     = "levels.playtest"
+	PermHintsWrite         = "hints.write"
+	PermAnnouncementsWrite = "announcements.write"
+	PermMessagesRead       = "messages.read"
+	PermMessagesReply      = "messages.reply"
+	PermUsersRead          = "users.read"
+	PermUsersProgress      = "users.progress"
+	PermUsersSecurity      = "users.security"
+	PermUsersDisqualify    = "users.disqualify"
+	PermUsersDelete        = "users.delete"
+	PermUsersImpersonate   = "users.impersonate"
+	PermLogsRead           = "logs.read"
+	PermSettingsWrite      = "settings.write"
+	PermBackupsManage      = "backups.manage"
+	PermRolesManage        = "roles.manage"
+	PermAuditRead          = "audit.read"
+)
+
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+var Permissions = []Permission{
+	{PermLevelsRead, "See levels, without their answers"},
+	{PermLevelsWrite, "Create, edit and delete levels and their AI leads"},
+	{PermLevelsReveal, "Reveal level answers and export level files"},
+	{PermLevelsPlaytest, "Play before the event opens and on closed tracks"},
+	{PermHintsWrite, "Publish and remove hints"},
+	{PermAnnouncementsWrite, "Publish and remove announcements"},
+	{PermMessagesRead, "Read the admin inbox"},
+	{PermMessagesReply, "Answer players and mark messages read"},
+	{PermUsersRead, "List players and see their progress and attempts"},
+	{PermUsersProgress, "Move players between levels"},
+	{PermUsersSecurity, "Unlock sign-in, force password resets, end sessions and turn off 2FA"},
+	{PermUsersDisqualify, "Disqualify, suspend, mute and hide players"},
+	{PermUsersDelete, "Delete accounts"},
+	{PermUsersImpersonate, "View the site read-only as a player"},
+	{PermLogsRead, "Read everyone's logs"},
+	{PermSettingsWrite, "Change event settings"},
+	{PermBackupsManage, "Take, restore and export backups"},
+	{PermRolesManage, "Grant and revoke roles"},
+	{PermAuditRead, "Read the admin audit log"},
+}
+
+func LookupPermission(name string) (Permission, bool) {
+	for _, p := range Permissions {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Permission{}, false
+}
+
+// RoleOwner holds every permission and cannot be redefined.
+const RoleOwner = "owner"
+
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// BuiltinRoles are created by the roles migration. Their permissions can
+// be changed afterwards through DefineRole.
+var BuiltinRoles = []Role{
+	{RoleOwner, "Runs the event", []string{PermAll}},
+	{"level-author", "Writes and tests levels", []string{PermLevelsRead, PermLevelsWrite, PermLevelsReveal, PermLevelsPlaytest, PermHintsWrite}},
+	{"moderator", "Keeps play fair and talks to players", []string{PermLevelsRead, PermHintsWrite, PermAnnouncementsWrite, PermMessagesRead, PermMessagesReply, PermUsersRead, PermUsersDisqualify, PermLogsRead}},
+	{"support", "Helps players with their accounts", []string{PermMessagesRead, PermMessagesReply, PermUsersRead, PermUsersSecurity, PermUsersImpersonate, PermLogsRead}},
+	{"viewer", "Read-only access to the admin pages", []string{PermLevelsRead, PermMessagesRead, PermUsersRead, PermLogsRead}},
+}
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// RoleGrant is one role held by one account.
+type RoleGrant struct {
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	GrantedBy string `json:"granted_by"`
+	GrantedAt int64  `json:"granted_at"`
+}
+
+func ListRoles(d Queryer) ([]Role, error) {
+	rows, err := d.Query(`SELECT r.name, r.description, COALESCE(p.permission, '') FROM roles r LEFT JOIN role_permissions p ON p.role = r.name ORDER BY r.name, p.permission`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Role{}
+	for rows.Next() {
+		var name, desc, perm string
+		if err := rows.Scan(&name, &desc, &perm); err != nil {
+			return nil, err
+		}
+		if len(out) == 0 || out[len(out)-1].Name != name {
+			out = append(out, Role{Name: name, Description: desc, Permissions: []string{}})
+		}
+		if perm != "" {
+			out[len(out)-1].Permissions = append(out[len(out)-1].Permissions, perm)
+		}
+	}
+	return out, rows.Err()
+}
+
+func roleExists(d Queryer, role string) (bool, error) {
+	var n int
+	err := d.QueryRow(`SELECT 1 FROM roles WHERE name = ?`, role).Scan(&n)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DefineRole creates role or replaces its description and permissions.
+func DefineRole(d Store, role Role) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO roles(name, description) VALUES(?,?) ON CONFLICT(name) DO UPDATE SET description = excluded.description`, role.Name, role.Description); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role = ?`, role.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, p := range role.Permissions {
+		if _, err := tx.Exec(`INSERT INTO role_permissions(role, permission) VALUES(?,?) ON CONFLICT DO NOTHING`, role.Name, p); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListRoleGrants returns every grant, or only email's when email is set.
+func ListRoleGrants(d Queryer, email string) ([]RoleGrant, error) {
+	q := `SELECT email, role, granted_by, granted_at FROM account_roles`
+	args := []interface{}{}
+	if email != "" {
+		q += ` WHERE email = ?`
+		args = append(args, email)
+	}
+	rows, err := d.Query(q+` ORDER BY email, role`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []RoleGrant{}
+	for rows.Next() {
+		var g RoleGrant
+		if err := rows.Scan(&g.Email, &g.Role, &g.GrantedBy, &g.GrantedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+func AccountRoles(d Queryer, email string) ([]string, error) {
+	grants, err := ListRoleGrants(d, email)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(grants))
+	for _, g := range grants {
+		out = append(out, g.Role)
+	}
+	return out, nil
+}
+
+// AccountPermissions returns the union of the permissions of email's
+// roles, sorted.
+func AccountPermissions(d Queryer, email string) ([]string, error) {
+	rows, err := d.Query(`SELECT DISTINCT p.permission FROM account_roles a JOIN role_permissions p ON p.role = a.role WHERE a.email = ?`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out, rows.Err()
+}
+
+func HasPermission(d Queryer, email, perm string) (bool, error) {
+	var n int
+	err := d.QueryRow(`SELECT 1 FROM account_roles a JOIN role_permissions p ON p.role = a.role WHERE a.email = ? AND (p.permission = ? OR p.permission = ?) LIMIT 1`, email, perm, PermAll).Scan(&n)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func GrantRole(d Queryer, email, role, by string) error {
+	ok, err := roleExists(d, role)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUnknownRole
+	}
+	_, err = d.Exec(`INSERT INTO account_roles(email, role, granted_by, granted_at) VALUES(?,?,?,?) ON CONFLICT(email, role) DO NOTHING`, email, role, by, time.Now().Unix())
+	return err
+}
+
+// RevokeRole removes role from email. It reports whether email held it.
+func RevokeRole(d Queryer, email, role string) (bool, error) {
+	res, err := d.Exec(`DELETE FROM account_roles WHERE email = ? AND role = ?`, email, role)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CountRoleHolders is how many accounts hold role.
+func CountRoleHolders(d Queryer, role string) (int, error) {
+	var n int
+	err := d.QueryRow(`SELECT COUNT(*) FROM account_roles WHERE role = ?`, role).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Session is one signed-in device. LastSeenAt is refreshed at most once a
+// minute so that reads do not turn every request into a write. ViewAs is
+// the player a staff session is currently viewing the site as.
+type Session struct {
+	ID         string `json:"-"`
+	Email      string `json:"email"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"user_agent"`
+	CreatedAt  int64  `json:"created_at"`
+	LastSeenAt int64  `json:"last_seen_at"`
+	MFA        bool   `json:"mfa"`
+	ViewAs     string `json:"view_as,omitempty"`
+}
+
+const sessionColumns = `session_id, email, ip, user_agent, created_at, last_seen_at, mfa, view_as`
+
+func scanSession(row rowScanner) (*Session, error) {
+	var s Session
+	var email sql.NullString
+	if err := row.Scan(&s.ID, &email, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.MFA, &s.ViewAs); err != nil {
+		return nil, err
+	}
+	s.Email = email.String
+	return &s, nil
+}
+
+func CreateSession(d Queryer, s *Session) error {
+	_, err := d.Exec(`INSERT INTO sessions(`+sessionColumns+`) VALUES(?,?,?,?,?,?,?,?)`, s.ID, s.Email, s.IP, s.UserAgent, s.CreatedAt, s.LastSeenAt, s.MFA, s.ViewAs)
+	return err
+}
+
+func GetSession(d Queryer, id string) (*Session, error) {
+	return scanSession(d.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE session_id = ?`, id))
+}
+
+// TouchSession records activity on a session.
+func TouchSession(d Queryer, id string, now int64) error {
+	_, err := d.Exec(`UPDATE sessions SET last_seen_at = ? WHERE session_id = ?`, now, id)
+	return err
+}
+
+// ListSessions returns the sessions of email, most recently used first.
+func ListSessions(d Queryer, email string) ([]Session, error) {
+	rows, err := d.Query(`SELECT `+sessionColumns+` FROM sessions WHERE email = ? ORDER BY last_seen_at DESC`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *s)
+	}
+	return out, rows.Err()
+}
+
+// SetSessionViewAs starts viewing as email on session id, or stops when
+// email is empty.
+func SetSessionViewAs(d Queryer, id, email string) error {
+	res, err := d.Exec(`UPDATE sessions SET view_as = ? WHERE session_id = ?`, email, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+func DeleteSession(d Queryer, id string) error {
+	_, err := d.Exec(`DELETE FROM sessions WHERE session_id = ?`, id)
+	return err
+}
+
+// DeleteSessions signs an account out everywhere.
+func DeleteSessions(d Queryer, email string) error {
+	_, err := d.Exec(`DELETE FROM sessions WHERE email = ?`, email)
+	return err
+}
+
+// DeleteOtherSessions signs an account out everywhere except keep.
+func DeleteOtherSessions(d Queryer, email, keep string) error {
+	_, err := d.Exec(`DELETE FROM sessions WHERE email = ? AND session_id <> ?`, email, keep)
+	return err
+}
+
+// ExpireSessions drops sessions idle since before idleBefore or created
+// before createdBefore.
+func ExpireSessions(d Queryer, idleBefore, createdBefore int64) error {
+	_, err := d.Exec(`DELETE FROM sessions WHERE last_seen_at < ? OR created_at < ?`, idleBefore, createdBefore)
+	return err
+}
+
+// ChangePassword swaps the password hash only if it still equals oldHash,
+// so a reset token is spent by its first use, and revokes every session of
+// the account in the same transaction. It returns ErrConflict when the
+// hash changed underneath the caller.
+func ChangePassword(d Store, email, oldHash, newHash string) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE accounts SET password = ?, updated_at = ?, version = version + 1 WHERE email = ? AND password = ?`, newHash, time.Now().Unix(), email, oldHash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	if err := DeleteSessions(tx, email); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
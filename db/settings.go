@@ -0,0 +1,290 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FlagKind string
+
+const (
+	FlagBool   FlagKind = "bool"
+	FlagTime   FlagKind = "time"
+	FlagString FlagKind = "string"
+)
+
+// Flag describes a known setting. Env names the environment variable that
+// supplies the value when nothing is stored in the settings table.
+type Flag struct {
+	Key         string   `json:"key"`
+	Kind        FlagKind `json:"kind"`
+	Default     string   `json:"default"`
+	Env         string   `json:"env,omitempty"`
+	Description string   `json:"description"`
+}
+
+var Flags = []Flag{
+	{Key: "ai_leads", Kind: FlagBool, Default: "true", Description: "Allow players to ask the AI for leads"},
+	{Key: "timegate_start", Kind: FlagTime, Default: "2025-11-07T09:00:00+05:30", Env: "TIMEGATE_START", Description: "Event start (RFC 3339)"},
+	{Key: "timegate_end", Kind: FlagTime, Env: "TIMEGATE_END", Description: "Event end (RFC 3339), empty for no end"},
+	{Key: "admin.require_2fa", Kind: FlagBool, Default: "false", Env: "ADMIN_REQUIRE_2FA", Description: "Only let admins reach admin pages from a session that passed two-factor authentication"},
+}
+
+func LookupFlag(key string) (Flag, bool) {
+	for _, f := range Flags {
+		if f.Key == key {
+			return f, true
+		}
+	}
+	return Flag{}, false
+}
+
+func (f Flag) Validate(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch f.Kind {
+	case FlagBool:
+		switch strings.ToLower(value) {
+		case "1", "true", "on", "yes":
+			return "true", nil
+		case "0", "false", "off", "no":
+			return "false", nil
+		}
+		return "", fmt.Errorf("%s expects a boolean", f.Key)
+	case FlagTime:
+		if value == "" {
+			return "", nil
+		}
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return "", fmt.Errorf("%s expects an RFC 3339 time", f.Key)
+		}
+	}
+	return value, nil
+}
+
+type Setting struct {
+	Flag
+	Value     string `json:"value"`
+	Source    string `json:"source"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
+}
+
+type SettingChange struct {
+	ID        int64  `json:"id"`
+	Key       string `json:"key"`
+	OldValue  string `json:"old_value"`
+	NewValue  string `json:"new_value"`
+	ChangedBy string `json:"changed_by"`
+	ChangedAt int64  `json:"changed_at"`
+}
+
+type storedSetting struct {
+	value     string
+	updatedBy string
+	updatedAt int64
+}
+
+// Settings is a read-through cache over the settings table. Entries are
+// reloaded after ttl so several servers sharing a database converge.
+type Settings struct {
+	d      Store
+	ttl    time.Duration
+	mu     sync.Mutex
+	loaded time.Time
+	values map[string]storedSetting
+}
+
+func NewSettings(d Store) *Settings {
+	return &Settings{d: d, ttl: 5 * time.Second}
+}
+
+func (s *Settings) load() (map[string]storedSetting, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values != nil && time.Since(s.loaded) < s.ttl {
+		return s.values, nil
+	}
+	rows, err := s.d.Query(`SELECT key, value, updated_by, updated_at FROM settings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	vals := map[string]storedSetting{}
+	for rows.Next() {
+		var k string
+		var v storedSetting
+		if err := rows.Scan(&k, &v.value, &v.updatedBy, &v.updatedAt); err != nil {
+			return nil, err
+		}
+		vals[k] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.values = vals
+	s.loaded = time.Now()
+	return vals, nil
+}
+
+func (s *Settings) invalidate() {
+	s.mu.Lock()
+	s.values = nil
+	s.mu.Unlock()
+}
+
+func (s *Settings) resolve(f Flag, vals map[string]storedSetting) Setting {
+	out := Setting{Flag: f, Value: f.Default, Source: "default"}
+	if f.Env != "" {
+		if v := os.Getenv(f.Env); v != "" {
+			out.Value = v
+			out.Source = "env"
+		}
+	}
+	if v, ok := vals[f.Key]; ok {
+		out.Value = v.value
+		out.Source = "db"
+		out.UpdatedBy = v.updatedBy
+		out.UpdatedAt = v.updatedAt
+	}
+	return out
+}
+
+// Get returns the effective value of a setting: stored value, then
+// environment, then the flag default.
+func (s *Settings) Get(key string) string {
+	f, ok := LookupFlag(key)
+	if !ok {
+		f = Flag{Key: key, Kind: FlagString}
+	}
+	vals, err := s.load()
+	if err != nil {
+		vals = nil
+	}
+	return s.resolve(f, vals).Value
+}
+
+func (s *Settings) Bool(key string) bool {
+	v, _ := strconv.ParseBool(s.Get(key))
+	return v
+}
+
+func (s *Settings) Time(key string) (time.Time, bool) {
+	v := s.Get(key)
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func (s *Settings) List() ([]Setting, error) {
+	vals, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Setting, 0, len(Flags))
+	known := map[string]bool{}
+	for _, f := range Flags {
+		known[f.Key] = true
+		out = append(out, s.resolve(f, vals))
+	}
+	var extra []string
+	for k := range vals {
+		if !known[k] {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		out = append(out, s.resolve(Flag{Key: k, Kind: FlagString}, vals))
+	}
+	return out, nil
+}
+
+// Set validates and stores a value, recording the change in
+// settings_history.
+func (s *Settings) Set(key, value, actor string) error {
+	f, ok := LookupFlag(key)
+	if !ok {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	value, err := f.Validate(value)
+	if err != nil {
+		return err
+	}
+	return s.write(key, &value, actor)
+}
+
+// Reset removes the stored value so the environment or default applies
+// again.
+func (s *Settings) Reset(key, actor string) error {
+	if _, ok := LookupFlag(key); !ok {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return s.write(key, nil, actor)
+}
+
+func (s *Settings) write(key string, value *string, actor string) error {
+	defer s.invalidate()
+	tx, err := s.d.Begin()
+	if err != nil {
+		return err
+	}
+	var old sql.NullString
+	if err := tx.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&old); err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now().Unix()
+	newValue := ""
+	if value == nil {
+		_, err = tx.Exec(`DELETE FROM settings WHERE key = ?`, key)
+	} else {
+		newValue = *value
+		_, err = tx.Exec(`INSERT INTO settings(key, value, updated_by, updated_at) VALUES(?,?,?,?) ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_by = excluded.updated_by, updated_at = excluded.updated_at`, key, newValue, actor, now)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO settings_history(key, old_value, new_value, changed_by, changed_at) VALUES(?,?,?,?,?)`, key, old.String, newValue, actor, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Settings) History(key string, limit int) ([]SettingChange, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	var rows *sql.Rows
+	var err error
+	if key != "" {
+		rows, err = s.d.Query(`SELECT id, key, old_value, new_value, changed_by, changed_at FROM settings_history WHERE key = ? ORDER BY id DESC LIMIT ?`, key, limit)
+	} else {
+		rows, err = s.d.Query(`SELECT id, key, old_value, new_value, changed_by, changed_at FROM settings_history ORDER BY id DESC LIMIT ?`, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []SettingChange{}
+	for rows.Next() {
+		var c SettingChange
+		if err := rows.Scan(&c.ID, &c.Key, &c.OldValue, &c.NewValue, &c.ChangedBy, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string { return "sqlite" }
+
+func (sqliteDialect) rebind(query string) string { return query }
+
+func (sqliteDialect) ddl(schema string) string { return schema }
+
+func (sqliteDialect) insertID(q querier, query string, args ...interface{}) (int64, error) {
+	res, err := q.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func OpenSQLite(path string) (Store, error) {
+	dsn := path
+	if !strings.Contains(dsn, "?") {
+		// Immediate transactions take the write lock up front so concurrent
+		// read-modify-write transactions queue on the busy timeout instead of
+		// failing on lock upgrade.
+		dsn += "?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on&_txlock=immediate"
+	}
+	d, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: d, d: sqliteDialect{}}, nil
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Store is the storage backend the handlers talk to. Queries are written
+// once with "?" placeholders and portable SQL; each implementation rewrites
+// them for its driver.
+type Store interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	// InsertID runs an INSERT into a table with an "id" primary key and
+	// returns the generated id.
+	InsertID(query string, args ...interface{}) (int64, error)
+	Begin() (*Tx, error)
+	Driver() string
+	DB() *sql.DB
+	Close() error
+}
+
+type dialect interface {
+	name() string
+	rebind(query string) string
+	ddl(schema string) string
+	insertID(q querier, query string, args ...interface{}) (int64, error)
+}
+
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type sqlStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *sqlStore) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) InsertID(query string, args ...interface{}) (int64, error) {
+	return s.d.insertID(s.db, s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) Begin() (*Tx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx, d: s.d}, nil
+}
+
+func (s *sqlStore) Driver() string { return s.d.name() }
+
+func (s *sqlStore) DB() *sql.DB { return s.db }
+
+func (s *sqlStore) Close() error { return s.db.Close() }
+
+type Tx struct {
+	tx *sql.Tx
+	d  dialect
+}
+
+func (t *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.Exec(t.d.rebind(query), args...)
+}
+
+func (t *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.tx.Query(t.d.rebind(query), args...)
+}
+
+func (t *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRow(t.d.rebind(query), args...)
+}
+
+func (t *Tx) InsertID(query string, args ...interface{}) (int64, error) {
+	return t.d.insertID(t.tx, t.d.rebind(query), args...)
+}
+
+// ExecDDL runs a schema script after translating column types for the
+// backend.
+func (t *Tx) ExecDDL(schema string) error {
+	_, err := t.tx.Exec(t.d.ddl(schema))
+	return err
+}
+
+func (t *Tx) Driver() string { return t.d.name() }
+
+func (t *Tx) Commit() error { return t.tx.Commit() }
+
+func (t *Tx) Rollback() error { return t.tx.Rollback() }
+
+// Open returns a Store for the configured driver. An empty driver means
+// SQLite.
+func Open(driver, dsn string) (Store, error) {
+	switch strings.ToLower(strings.TrimSpace(driver)) {
+	case "", "sqlite", "sqlite3":
+		if dsn == "" {
+			dsn = "./data.db"
+		}
+		return OpenSQLite(dsn)
+	case "postgres", "postgresql", "pg":
+		return OpenPostgres(dsn)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// TOTP is an account's authenticator enrollment. Until Enabled is set the
+// secret is only a pending enrollment. LastStep is the newest time step
+// accepted, so a code cannot be replayed.
+type TOTP struct {
+	Email     string
+	Secret    string
+	Enabled   bool
+	LastStep  int64
+	CreatedAt int64
+}
+
+func GetTOTP(d Queryer, email string) (*TOTP, error) {
+	var t TOTP
+	err := d.QueryRow(`SELECT email, secret, enabled, last_step, created_at FROM totp WHERE email = ?`, email).Scan(&t.Email, &t.Secret, &t.Enabled, &t.LastStep, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TOTPEnabled reports whether email has finished enrolling.
+func TOTPEnabled(d Queryer, email string) (bool, error) {
+	t, err := GetTOTP(d, email)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return t.Enabled, nil
+}
+
+// BeginTOTP stores a pending secret, replacing any earlier pending one. It
+// returns ErrConflict if email already has 2FA enabled.
+func BeginTOTP(d Queryer, email, secret string) error {
+	res, err := d.Exec(`INSERT INTO totp(email, secret, enabled, last_step, created_at) VALUES(?,?,?,0,?) ON CONFLICT(email) DO UPDATE SET secret = excluded.secret, last_step = 0, created_at = excluded.created_at WHERE totp.enabled = ?`,
+		email, secret, false, time.Now().Unix(), false)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// UseTOTPStep records step as spent. It returns false if step, or a later
+// one, was already used.
+func UseTOTPStep(d Queryer, email string, step int64) (bool, error) {
+	res, err := d.Exec(`UPDATE totp SET last_step = ? WHERE email = ? AND last_step < ?`, step, email, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EnableTOTP turns on a pending enrollment and replaces the recovery codes.
+func EnableTOTP(d Store, email string, recoveryHashes []string) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE totp SET enabled = ? WHERE email = ?`, true, email); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := setRecoveryCodes(tx, email, recoveryHashes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP removes the enrollment and its recovery codes.
+func DisableTOTP(d Queryer, email string) error {
+	if _, err := d.Exec(`DELETE FROM recovery_codes WHERE email = ?`, email); err != nil {
+		return err
+	}
+	_, err := d.Exec(`DELETE FROM totp WHERE email = ?`, email)
+	return err
+}
+
+func SetRecoveryCodes(d Store, email string, hashes []string) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	if err := setRecoveryCodes(tx, email, hashes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func setRecoveryCodes(tx *Tx, email string, hashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE email = ?`, email); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes(email, code_hash, used_at) VALUES(?,?,0)`, email, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode spends the code with the given hash. It returns false if
+// there is no such unused code.
+func UseRecoveryCode(d Queryer, email, hash string) (bool, error) {
+	res, err := d.Exec(`UPDATE recovery_codes SET used_at = ? WHERE email = ? AND code_hash = ? AND used_at = 0`, time.Now().Unix(), email, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func RecoveryCodesLeft(d Queryer, email string) (int, error) {
+	var n int
+	err := d.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE email = ? AND used_at = 0`, email).Scan(&n)
+	return n, err
+}
+
+// SetSessionMFA marks a session as having passed a second factor.
+func SetSessionMFA(d Queryer, id string) error {
+	_, err := d.Exec(`UPDATE sessions SET mfa = ? WHERE session_id = ?`, true, id)
+	return err
+}
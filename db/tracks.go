@@ -0,0 +1,201 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Answer matching modes. A track's mode is how submissions on its levels
+// are compared with the answer.
+const (
+	MatchExact           = "exact"
+	MatchCaseInsensitive = "case_insensitive"
+)
+
+// Track visibility. An open track is listed and playable, a closed one is
+// listed but refuses play, and a hidden one is only there for staff who
+// playtest.
+const (
+	TrackOpen   = "open"
+	TrackClosed = "closed"
+	TrackHidden = "hidden"
+)
+
+// Track is a set of levels played in order. Level IDs are "<track>-<n>".
+// A solved level is worth Weight points.
+type Track struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Match      string `json:"match"`
+	Weight     int    `json:"weight"`
+	Visibility string `json:"visibility"`
+	Position   int    `json:"position"`
+	UpdatedBy  string `json:"updated_by,omitempty"`
+	UpdatedAt  int64  `json:"updated_at,omitempty"`
+}
+
+func (t Track) Listed() bool   { return t.Visibility != TrackHidden }
+func (t Track) Playable() bool { return t.Visibility == TrackOpen }
+
+var (
+	trackIDPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+	ErrTrackInUse  = errors.New("track has levels or player progress")
+)
+
+func (t *Track) Validate() error {
+	t.ID = strings.ToLower(strings.TrimSpace(t.ID))
+	t.Name = strings.TrimSpace(t.Name)
+	if !trackIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("track id must be lowercase letters, digits or '_', starting with a letter")
+	}
+	if t.Name == "" {
+		t.Name = t.ID
+	}
+	if t.Match == "" {
+		t.Match = MatchExact
+	}
+	if t.Match != MatchExact && t.Match != MatchCaseInsensitive {
+		return fmt.Errorf("match must be %q or %q", MatchExact, MatchCaseInsensitive)
+	}
+	if t.Weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	if t.Visibility == "" {
+		t.Visibility = TrackOpen
+	}
+	if t.Visibility != TrackOpen && t.Visibility != TrackClosed && t.Visibility != TrackHidden {
+		return fmt.Errorf("visibility must be %q, %q or %q", TrackOpen, TrackClosed, TrackHidden)
+	}
+	return nil
+}
+
+const trackColumns = `id, name, match_mode, weight, visibility, position, updated_by, updated_at`
+
+func ListTracks(d Queryer) ([]Track, error) {
+	rows, err := d.Query(`SELECT ` + trackColumns + ` FROM tracks ORDER BY position ASC, id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Track{}
+	for rows.Next() {
+		var t Track
+		if err := rows.Scan(&t.ID, &t.Name, &t.Match, &t.Weight, &t.Visibility, &t.Position, &t.UpdatedBy, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// pointsQuery totals a player's progress, weighted by track.
+const pointsQuery = `SELECT COALESCE(SUM(p.level * COALESCE(t.weight, 1)), 0) FROM progress p LEFT JOIN tracks t ON t.id = p.track WHERE p.email = ?`
+
+// SaveTrack creates or updates t. Changing the weight rescores every
+// account.
+func SaveTrack(d Store, t Track, actor string) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	var weight int
+	err = tx.QueryRow(`SELECT weight FROM tracks WHERE id = ?`, t.ID).Scan(&weight)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	rescore := err == nil && weight != t.Weight
+	if _, err := tx.Exec(`INSERT INTO tracks(`+trackColumns+`) VALUES(?,?,?,?,?,?,?,?) ON CONFLICT(id) DO UPDATE SET name = excluded.name, match_mode = excluded.match_mode, weight = excluded.weight, visibility = excluded.visibility, position = excluded.position, updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		t.ID, t.Name, t.Match, t.Weight, t.Visibility, t.Position, actor, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rescore {
+		if _, err := tx.Exec(`UPDATE accounts SET points = (` + strings.Replace(pointsQuery, "p.email = ?", "p.email = accounts.email", 1) + `), version = version + 1`); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteTrack removes a track nobody has played and that has no levels.
+// Levels are matched on the exact "<id>-" prefix rather than LIKE, where an
+// underscore in id would match any character.
+func DeleteTrack(d Store, id string) error {
+	var n int
+	if err := d.QueryRow(`SELECT (SELECT COUNT(*) FROM levels WHERE substr(id, 1, length(?) + 1) = ? || '-') + (SELECT COUNT(*) FROM progress WHERE track = ? AND level > 0)`, id, id, id).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrTrackInUse
+	}
+	res, err := d.Exec(`DELETE FROM tracks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// Tracks caches the tracks table, reloading after ttl like Settings.
+type Tracks struct {
+	d      Store
+	ttl    time.Duration
+	mu     sync.Mutex
+	loaded time.Time
+	list   []Track
+}
+
+func NewTracks(d Store) *Tracks {
+	return &Tracks{d: d, ttl: 5 * time.Second}
+}
+
+// List returns every track in display order. If the table cannot be read
+// the last list loaded is kept.
+func (t *Tracks) List() []Track {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.list != nil && time.Since(t.loaded) < t.ttl {
+		return t.list
+	}
+	list, err := ListTracks(t.d)
+	if err != nil {
+		return t.list
+	}
+	t.list = list
+	t.loaded = time.Now()
+	return list
+}
+
+func (t *Tracks) Get(id string) (Track, bool) {
+	for _, tr := range t.List() {
+		if tr.ID == id {
+			return tr, true
+		}
+	}
+	return Track{}, false
+}
+
+func (t *Tracks) Save(tr Track, actor string) error {
+	defer t.invalidate()
+	return SaveTrack(t.d, tr, actor)
+}
+
+func (t *Tracks) Delete(id string) error {
+	defer t.invalidate()
+	return DeleteTrack(t.d, id)
+}
+
+func (t *Tracks) invalidate() {
+	t.mu.Lock()
+	t.list = nil
+	t.mu.Unlock()
+}
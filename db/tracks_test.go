@@ -0,0 +1,25 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeleteTrackMatchesOnlyItsOwnLevels(t *testing.T) {
+	d := newTestStore(t)
+	for _, id := range []string{"a_b", "axb"} {
+		if err := SaveTrack(d, Track{ID: id}, "admin@x.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "a_b-%" as a LIKE pattern would match this level
+	if err := Set(d, "levels", "axb-0", `{}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteTrack(d, "axb"); !errors.Is(err, ErrTrackInUse) {
+		t.Fatalf("deleting a track with levels: %v, want ErrTrackInUse", err)
+	}
+	if err := DeleteTrack(d, "a_b"); err != nil {
+		t.Fatalf("deleting an empty track: %v", err)
+	}
+}
@@ -3,7 +3,13 @@ module sudocrypt25
 go 1.24
 
 require github.com/mattn/go-sqlite3 v1.14.16
-require google.golang.org/genai v1.33.0 
+
+require (
+	github.com/lib/pq v1.12.3
+	golang.org/x/crypto v0.27.0
+	golang.org/x/text v0.18.0
+	google.golang.org/genai v1.33.0
+)
 
 require (
 	cloud.google.com/go v0.116.0 // indirect
@@ -15,10 +21,8 @@ require (
 	github.com/googleapis/enterprise-certificate-proxy v0.3.4 // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
 	go.opencensus.io v0.24.0 // indirect
-	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/net v0.29.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
-	golang.org/x/text v0.18.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
 	google.golang.org/grpc v1.66.2 // indirect
 	google.golang.org/protobuf v1.34.2 // indirect
@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
 	"strconv"
@@ -11,95 +10,144 @@ import (
 	dbpkg "sudocrypt25/db"
 )
 
-func AttemptLog(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+func noStore(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+}
 
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if r.Method == "POST" {
+// AttemptLog records client-side answer attempts (POST) and lists them
+// (GET). Players see their own attempts; admins see everyone's unless they
+// filter by email, may filter by track, level and time range, and pass
+// aggregate=level for per-level counts.
+func AttemptLog(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFromContext(r.Context())
+		email := p.Email
+		isAdmin := p.Can(dbpkg.PermLogsRead)
+		switch r.Method {
+		case http.MethodPost:
 			var req struct {
 				Log   string `json:"logs"`
 				Typpe string `json:"type"`
+				Level string `json:"level"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 				http.Error(w, "Invalid request", http.StatusBadRequest)
 				return
 			}
-
-			acctRaw, err := dbpkg.Get(dbConn, "attempt_logs", email)
-			if err != nil {
-				acctRaw = `{"email":"` + email + `","logs":""}`
+			a := dbpkg.Attempt{
+				Email:     email,
+				Payload:   req.Log,
+				Session:   sessionHandle(p.Session.ID),
+				CreatedAt: time.Now().Unix(),
 			}
-
-			var acct map[string]interface{}
-			if err := json.Unmarshal([]byte(acctRaw), &acct); err != nil {
-				http.Error(w, "Error loading account", http.StatusInternalServerError)
-				return
+			levelID := strings.TrimSpace(req.Level)
+			if levelID == "" && isValidLevelID(req.Typpe) {
+				levelID = req.Typpe
 			}
-
-			acct["logs"] = acct["logs"].(string) + "\n" + req.Log + "+" + req.Typpe + "+" + strconv.FormatInt(time.Now().Unix(), 10)
-
-			acctBytes, _ := json.Marshal(acct)
-			if err := dbpkg.Set(dbConn, "attempt_logs", email, string(acctBytes)); err != nil {
+			if levelID != "" {
+				if !isValidLevelID(levelID) {
+					http.Error(w, "invalid level", http.StatusBadRequest)
+					return
+				}
+				a.LevelID = levelID
+				a.Track = levelID[:strings.LastIndex(levelID, "-")]
+			} else {
+				a.Track = strings.TrimSpace(req.Typpe)
+				if a.Track == "" {
+					a.Track = DefaultTrack()
+				}
+				if !isValidLevelID(a.Track + "-0") {
+					http.Error(w, "invalid type", http.StatusBadRequest)
+					return
+				}
+				if acct, err := dbpkg.GetAccount(dbConn, email); err == nil {
+					a.LevelID = a.Track + "-" + strconv.Itoa(acct.Level(a.Track))
+				}
+			}
+			if err := dbpkg.AddAttempt(dbConn, &a); err != nil {
 				http.Error(w, "Failed to update", http.StatusInternalServerError)
 				return
 			}
-
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-			w.Header().Set("Pragma", "no-cache")
-			w.Header().Set("Expires", "0")
+			noStore(w)
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"success": true,
-				"message": "Bio updated successfully",
+				"message": "Attempt logged",
 			})
-		}
-		if r.Method == "GET" {
-			target := strings.TrimSpace(r.URL.Query().Get("email"))
-			if target != "" {
-				if admins == nil || !admins.IsAdmin(email) {
+		case http.MethodGet:
+			q := r.URL.Query()
+			f := dbpkg.AttemptFilter{
+				Email:   email,
+				Track:   strings.TrimSpace(q.Get("track")),
+				LevelID: strings.TrimSpace(q.Get("level")),
+				Desc:    strings.EqualFold(q.Get("order"), "desc"),
+			}
+			target := strings.ToLower(strings.TrimSpace(q.Get("email")))
+			switch {
+			case isAdmin:
+				// without email, admins see every player's attempts
+				f.Email = target
+			case target != "" && target != email:
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			var ok bool
+			if f.Since, ok = parseLogTime(q.Get("since")); !ok {
+				http.Error(w, "invalid since", http.StatusBadRequest)
+				return
+			}
+			if f.Until, ok = parseLogTime(q.Get("until")); !ok {
+				http.Error(w, "invalid until", http.StatusBadRequest)
+				return
+			}
+			if q.Get("aggregate") == "level" {
+				if !isAdmin {
 					http.Error(w, "forbidden", http.StatusForbidden)
 					return
 				}
-				email = target
+				stats, err := dbpkg.AttemptStatsByLevel(dbConn, f)
+				if err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				noStore(w)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "levels": stats})
+				return
 			}
-			acctRaw, err := dbpkg.Get(dbConn, "attempt_logs", email)
+			if v := q.Get("cursor"); v != "" {
+				var err error
+				f.Cursor, err = strconv.ParseInt(v, 10, 64)
+				if err != nil || f.Cursor < 0 {
+					http.Error(w, "invalid cursor", http.StatusBadRequest)
+					return
+				}
+			}
+			f.Limit, _ = strconv.Atoi(q.Get("limit"))
+			if f.Limit <= 0 {
+				f.Limit = defaultLogLimit
+			}
+			if f.Limit > maxLogLimit {
+				f.Limit = maxLogLimit
+			}
+			attempts, err := dbpkg.QueryAttempts(dbConn, f)
 			if err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-				w.Header().Set("Pragma", "no-cache")
-				w.Header().Set("Expires", "0")
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"success": true,
-					"message": "Bio updated successfully",
-					"data":    "",
-				})
+				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
-
-			var acct map[string]interface{}
-			if err := json.Unmarshal([]byte(acctRaw), &acct); err != nil {
-				http.Error(w, "Error loading account", http.StatusInternalServerError)
-				return
+			next := ""
+			if len(attempts) == f.Limit {
+				next = strconv.FormatInt(attempts[len(attempts)-1].ID, 10)
 			}
-
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-			w.Header().Set("Pragma", "no-cache")
-			w.Header().Set("Expires", "0")
+			noStore(w)
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": true,
-				"message": "Bio updated successfully",
-				"data":    acct["logs"].(string),
+				"success":     true,
+				"attempts":    attempts,
+				"next_cursor": next,
 			})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
 	}
 }
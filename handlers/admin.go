@@ -1,13 +1,21 @@
 package handlers
 
-import "strings"
+import (
+	"strings"
 
+	dbpkg "sudocrypt25/db"
+)
+
+// Admins answers what staff may do. Emails listed in ADMIN_EMAILS are
+// always owners so there is a way in before any role is granted; everyone
+// else holds the roles stored in account_roles.
 type Admins struct {
 	set map[string]struct{}
+	d   dbpkg.Store
 }
 
-func NewAdmins(raw string) *Admins {
-	a := &Admins{set: make(map[string]struct{})}
+func NewAdmins(d dbpkg.Store, raw string) *Admins {
+	a := &Admins{set: make(map[string]struct{}), d: d}
 	raw = strings.TrimSpace(raw)
 	if raw == "" {
 		return a
@@ -26,7 +34,8 @@ func NewAdmins(raw string) *Admins {
 	return a
 }
 
-func (a *Admins) IsAdmin(email string) bool {
+// bootstrap reports whether email is an owner through ADMIN_EMAILS.
+func (a *Admins) bootstrap(email string) bool {
 	if a == nil || len(a.set) == 0 {
 		return false
 	}
@@ -34,3 +43,54 @@ func (a *Admins) IsAdmin(email string) bool {
 	_, ok := a.set[e]
 	return ok
 }
+
+// Roles lists email's roles, including the owner role ADMIN_EMAILS implies.
+func (a *Admins) Roles(email string) []string {
+	if a == nil || email == "" {
+		return []string{}
+	}
+	roles, err := dbpkg.AccountRoles(a.d, email)
+	if err != nil {
+		roles = []string{}
+	}
+	if a.bootstrap(email) {
+		for _, r := range roles {
+			if r == dbpkg.RoleOwner {
+				return roles
+			}
+		}
+		roles = append([]string{dbpkg.RoleOwner}, roles...)
+	}
+	return roles
+}
+
+func (a *Admins) Permissions(email string) []string {
+	if a == nil || email == "" {
+		return []string{}
+	}
+	if a.bootstrap(email) {
+		return []string{dbpkg.PermAll}
+	}
+	perms, err := dbpkg.AccountPermissions(a.d, email)
+	if err != nil {
+		return []string{}
+	}
+	return perms
+}
+
+// Staff is the set of emails holding any role.
+func (a *Admins) Staff() map[string]bool {
+	out := map[string]bool{}
+	if a == nil {
+		return out
+	}
+	for e := range a.set {
+		out[e] = true
+	}
+	if grants, err := dbpkg.ListRoleGrants(a.d, ""); err == nil {
+		for _, g := range grants {
+			out[g.Email] = true
+		}
+	}
+	return out
+}
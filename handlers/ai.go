@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -85,22 +84,13 @@ func pickGeminiKey() string {
 	return k
 }
 
-func AILeadHandler(dbConn *sql.DB) http.HandlerFunc {
+func AILeadHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		emailC, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || emailC == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
+		emailC := PrincipalFromContext(r.Context()).Email
 		var payload map[string]string
 		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
 			defer r.Body.Close()
@@ -109,12 +99,13 @@ func AILeadHandler(dbConn *sql.DB) http.HandlerFunc {
 			r.ParseForm()
 			payload = map[string]string{"level": r.FormValue("level"), "question": r.FormValue("question")}
 		}
-		// check global ai leads setting
-		if v, err := dbpkg.Get(dbConn, "settings", "ai_leads"); err == nil {
-			if strings.TrimSpace(strings.ToLower(v)) == "0" || strings.TrimSpace(strings.ToLower(v)) == "false" {
-				http.Error(w, "ai leads disabled", http.StatusForbidden)
-				return
-			}
+		if !settings.Bool("ai_leads") {
+			http.Error(w, "ai leads disabled", http.StatusForbidden)
+			return
+		}
+		// a muted player's question would reach the admin inbox as a message
+		if refuseSanctioned(w, dbConn, emailC, dbpkg.SanctionDisqualified, dbpkg.SanctionSuspended, dbpkg.SanctionMuted) {
+			return
 		}
 
 		lvlID := strings.TrimSpace(payload["level"])
@@ -122,11 +113,20 @@ func AILeadHandler(dbConn *sql.DB) http.HandlerFunc {
 			http.Error(w, "missing level", http.StatusBadRequest)
 			return
 		}
+		typ, _, ok := splitLevelID(lvlID)
+		if !ok {
+			http.Error(w, "invalid level id", http.StatusBadRequest)
+			return
+		}
 		lvl, err := GetLevel(dbConn, lvlID)
 		if err != nil || lvl == nil {
 			http.Error(w, "no level", http.StatusNotFound)
 			return
 		}
+		if !TrackEnabled(typ) {
+			http.Error(w, "track closed", http.StatusForbidden)
+			return
+		}
 		if strings.TrimSpace(lvl.Walkthrough) == "" {
 			http.Error(w, "no walkthrough", http.StatusNotFound)
 			return
@@ -296,30 +296,9 @@ func AILeadHandler(dbConn *sql.DB) http.HandlerFunc {
 					_ = dbpkg.Set(dbConn, "messages", userEmail, aiVal)
 
 					if val {
-						acctRaw, err := dbpkg.Get(dbConn, "accounts", userEmail)
-						var acct map[string]interface{}
-						if err == nil {
-							json.Unmarshal([]byte(acctRaw), &acct)
-						} else {
-							acct = map[string]interface{}{"levels": map[string]float64{"cryptic": 0, "ctf": 0}}
-						}
-						progMap := map[string][]interface{}{}
-						if pm, ok := acct["progress"].(map[string]interface{}); ok {
-							for k, v := range pm {
-								if arr2, ok2 := v.([]interface{}); ok2 && len(arr2) >= 2 {
-									progMap[k] = []interface{}{arr2[0], arr2[1]}
-								}
-							}
-						} else if p, ok := acct["progress"].([]interface{}); ok && len(p) >= 2 {
-							progMap["cryptic"] = []interface{}{p[0], p[1]}
-						}
-						levelsMap := map[string]float64{}
-						if lm, ok := acct["levels"].(map[string]interface{}); ok {
-							for k, v := range lm {
-								if vf, ok2 := v.(float64); ok2 {
-									levelsMap[k] = vf
-								}
-							}
+						acct, err := dbpkg.GetAccount(dbConn, userEmail)
+						if err != nil {
+							acct = &dbpkg.Account{Email: userEmail}
 						}
 						partsArr := arr
 						partsLower := make([]string, 0)
@@ -355,44 +334,19 @@ func AILeadHandler(dbConn *sql.DB) http.HandlerFunc {
 						partsIdx := matchedIdx
 						partsCount := len(partsLower)
 						partsIdxValid := partsIdx >= 0 && partsIdx < partsCount
-						parts := strings.SplitN(lvlID, "-", 2)
-						typ := "cryptic"
-						if len(parts) == 2 {
-							typ = parts[0]
-						}
-						curr := 0
-						if v, ok := levelsMap[typ]; ok {
-							curr = int(v)
-						}
-						expectedLevel := fmt.Sprintf("%s-%d", typ, curr)
-						var progLevel string
-						var progCheckpoint float64
-						if pr, ok := progMap[typ]; ok && len(pr) >= 2 {
-							if s, ok2 := pr[0].(string); ok2 {
-								progLevel = s
-							}
-							if n, ok2 := pr[1].(float64); ok2 {
-								progCheckpoint = n
-							}
-						} else {
-							progLevel = expectedLevel
-							progCheckpoint = 0
-						}
-						if progLevel != expectedLevel {
-							progLevel = expectedLevel
-							progCheckpoint = 0
+						expectedLevel := fmt.Sprintf("%s-%d", typ, acct.Level(typ))
+						progCheckpoint := 0
+						if cp, ok := acct.Checkpoints[typ]; ok && cp.LevelID == expectedLevel {
+							progCheckpoint = cp.Checkpoint
 						}
 						if partsIdxValid {
-							nextCheckpoint := int(progCheckpoint) + 1
+							nextCheckpoint := progCheckpoint + 1
 							if partsIdx == nextCheckpoint {
-								progCheckpoint = float64(partsIdx)
+								progCheckpoint = partsIdx
 								if progCheckpoint > 9 {
 									progCheckpoint = 9
 								}
-								progMap[typ] = []interface{}{progLevel, progCheckpoint}
-								acct["progress"] = progMap
-								b, _ := json.Marshal(acct)
-								_ = dbpkg.Set(dbConn, "accounts", userEmail, string(b))
+								_ = dbpkg.SetCheckpoint(dbConn, userEmail, typ, expectedLevel, progCheckpoint)
 							}
 						}
 					}
@@ -414,17 +368,13 @@ func AILeadHandler(dbConn *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ToggleAILeadsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func ToggleAILeadsHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" || admins == nil || !admins.IsAdmin(email) {
-			http.Error(w, "forbidden", http.StatusForbidden)
-			return
-		}
+		email := PrincipalFromContext(r.Context()).Email
 		var payload map[string]interface{}
 		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
 			defer r.Body.Close()
@@ -449,14 +399,12 @@ func ToggleAILeadsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				enabled = int(tv) != 0
 			}
 		}
-		val := "1"
-		if !enabled {
-			val = "0"
-		}
-		if err := dbpkg.Set(dbConn, "settings", "ai_leads", val); err != nil {
+		before := settings.Get("ai_leads")
+		if err := settings.Set("ai_leads", strconv.FormatBool(enabled), email); err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
+		audit(dbConn, r, "setting.set", "ai_leads", map[string]string{"value": before}, map[string]string{"value": settings.Get("ai_leads")})
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "enabled": enabled})
 	}
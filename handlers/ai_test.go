@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sudocrypt25/db"
+)
+
+func TestAILeadRefusesMutedPlayers(t *testing.T) {
+	const email = "p@x.com"
+	d := newTestStore(t, email)
+	prevSettings, prevTracks := settings, tracks
+	settings = db.NewSettings(d)
+	InitTracks(d)
+	t.Cleanup(func() { settings, tracks = prevSettings, prevTracks })
+
+	ask := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/api/ai/lead", strings.NewReader(`{"level":"cryptic-0","question":"is it in the title?"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r = r.WithContext(context.WithValue(r.Context(), principalContextKey, &Principal{Email: email}))
+		w := httptest.NewRecorder()
+		AILeadHandler(d).ServeHTTP(w, r)
+		return w.Code
+	}
+	// with no level stored, a player who gets past the sanction check is
+	// told so
+	if code := ask(); code != http.StatusNotFound {
+		t.Fatalf("unsanctioned player: %d, want 404", code)
+	}
+	if err := db.SetSanction(d, db.Sanction{Email: email, Kind: db.SanctionMuted, SetBy: "admin@x.com", SetAt: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if code := ask(); code != http.StatusForbidden {
+		t.Fatalf("muted player: %d, want 403", code)
+	}
+	msgs, err := db.GetAll(d, "messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("%d messages saved for a muted player, want 0", len(msgs))
+	}
+}
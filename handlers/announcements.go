@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"crypto/sha256"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -14,7 +13,7 @@ import (
 	"sudocrypt25/db"
 )
 
-func AnnouncementsHandler(dbConn *sql.DB) http.HandlerFunc {
+func AnnouncementsHandler(dbConn db.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		items, err := db.GetAll(dbConn, "announcements")
@@ -80,38 +79,33 @@ func AnnouncementsHandler(dbConn *sql.DB) http.HandlerFunc {
 	}
 }
 
-func SetAnnouncementHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func SetAnnouncementHandler(dbConn db.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		acctRaw, _ := db.Get(dbConn, "accounts", email)
-		var acct map[string]interface{}
-		if acctRaw != "" {
-			json.Unmarshal([]byte(acctRaw), &acct)
-		}
-		isAdmin := false
-		if admins != nil && admins.IsAdmin(email) {
-			isAdmin = true
-		}
-		if adm, _ := acct["admin"].(bool); adm {
-			isAdmin = true
-		}
-		if !isAdmin {
-			http.Error(w, "forbidden", http.StatusForbidden)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		id := r.FormValue("id")
-		content := r.FormValue("content")
-		t := r.FormValue("time")
+		var req struct {
+			ID      string      `json:"id"`
+			Content string      `json:"content"`
+			Time    interface{} `json:"time"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+		id := req.ID
+		content := req.Content
+		t := ""
+		switch v := req.Time.(type) {
+		case json.Number:
+			t = v.String()
+		case string:
+			t = v
+		}
 		if id == "" || content == "" {
 			http.Error(w, "missing id or content", http.StatusBadRequest)
 			return
@@ -126,86 +120,53 @@ func SetAnnouncementHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				timeVal = t
 			}
 		}
+		before := storedAnnouncement(dbConn, id)
 		val := map[string]interface{}{"content": content, "time": timeVal}
 		b, _ := json.Marshal(val)
 		if err := db.Set(dbConn, "announcements", id, string(b)); err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
+		audit(dbConn, r, "announcement.set", id, before, val)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]bool{"success": true})
 	}
 }
 
-func DeleteAnnouncementHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func DeleteAnnouncementHandler(dbConn db.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		acctRaw, _ := db.Get(dbConn, "accounts", email)
-		var acct map[string]interface{}
-		if acctRaw != "" {
-			json.Unmarshal([]byte(acctRaw), &acct)
-		}
-		isAdmin := false
-		if admins != nil && admins.IsAdmin(email) {
-			isAdmin = true
-		}
-		if adm, _ := acct["admin"].(bool); adm {
-			isAdmin = true
+
+		var req struct {
+			ID string `json:"id"`
 		}
-		if !isAdmin {
-			http.Error(w, "forbidden", http.StatusForbidden)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
 			return
 		}
-
-		id := r.FormValue("id")
+		id := req.ID
 		if id == "" {
 			http.Error(w, "missing id", http.StatusBadRequest)
 			return
 		}
+		before := storedAnnouncement(dbConn, id)
 		if err := db.Delete(dbConn, "announcements", id); err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
+		audit(dbConn, r, "announcement.delete", id, before, nil)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]bool{"success": true})
 	}
 }
 
-func AdminCreateAnnouncementFormHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func AdminCreateAnnouncementFormHandler(dbConn db.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Redirect(w, r, "/auth?toast=1&from=/admin", http.StatusFound)
-			return
-		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Redirect(w, r, "/auth?toast=1&from=/admin", http.StatusFound)
-			return
-		}
-		acctRaw, _ := db.Get(dbConn, "accounts", email)
-		var acct map[string]interface{}
-		if acctRaw != "" {
-			json.Unmarshal([]byte(acctRaw), &acct)
-		}
-		isAdmin := false
-		if admins != nil && admins.IsAdmin(email) {
-			isAdmin = true
-		}
-		if adm, _ := acct["admin"].(bool); adm {
-			isAdmin = true
-		}
-		if !isAdmin {
-			http.Redirect(w, r, "/timegate?toast=1&from=/admin", http.StatusFound)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -230,39 +191,20 @@ func AdminCreateAnnouncementFormHandler(dbConn *sql.DB, admins *Admins) http.Han
 				timeVal = t
 			}
 		}
+		before := storedAnnouncement(dbConn, id)
 		val := map[string]interface{}{"content": content, "time": timeVal}
 		b, _ := json.Marshal(val)
-		_ = db.Set(dbConn, "announcements", id, string(b))
+		if db.Set(dbConn, "announcements", id, string(b)) == nil {
+			audit(dbConn, r, "announcement.set", id, before, val)
+		}
 		http.Redirect(w, r, "/admin", http.StatusFound)
 	}
 }
 
-func AdminDeleteAnnouncementFormHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func AdminDeleteAnnouncementFormHandler(dbConn db.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Redirect(w, r, "/auth?toast=1&from=/admin", http.StatusFound)
-			return
-		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Redirect(w, r, "/auth?toast=1&from=/admin", http.StatusFound)
-			return
-		}
-		acctRaw, _ := db.Get(dbConn, "accounts", email)
-		var acct map[string]interface{}
-		if acctRaw != "" {
-			json.Unmarshal([]byte(acctRaw), &acct)
-		}
-		isAdmin := false
-		if admins != nil && admins.IsAdmin(email) {
-			isAdmin = true
-		}
-		if adm, _ := acct["admin"].(bool); adm {
-			isAdmin = true
-		}
-		if !isAdmin {
-			http.Redirect(w, r, "/timegate?toast=1&from=/admin", http.StatusFound)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		if err := r.ParseForm(); err != nil {
@@ -271,8 +213,23 @@ func AdminDeleteAnnouncementFormHandler(dbConn *sql.DB, admins *Admins) http.Han
 		}
 		id := r.FormValue("id")
 		if id != "" {
-			_ = db.Delete(dbConn, "announcements", id)
+			before := storedAnnouncement(dbConn, id)
+			if db.Delete(dbConn, "announcements", id) == nil {
+				audit(dbConn, r, "announcement.delete", id, before, nil)
+			}
 		}
 		http.Redirect(w, r, "/admin", http.StatusFound)
 	}
 }
+
+func storedAnnouncement(dbConn db.Store, id string) map[string]interface{} {
+	s, err := db.Get(dbConn, "announcements", id)
+	if err != nil {
+		return nil
+	}
+	var val map[string]interface{}
+	if json.Unmarshal([]byte(s), &val) != nil {
+		return nil
+	}
+	return val
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	dbpkg "sudocrypt25/db"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization steps an AnswerSpec can list. They run in order on both the
+// accepted answers and the submission, after trimming.
+const (
+	NormNFKC        = "nfkc"
+	NormCaseFold    = "casefold"
+	NormStripSpaces = "strip_spaces"
+	NormStripPunct  = "strip_punct"
+)
+
+// Answer formats. A flag level only accepts submissions wrapped as
+// flag{...}; the text inside is what gets compared.
+const (
+	FormatPlain = "plain"
+	FormatFlag  = "flag"
+)
+
+// AnswerSpec says which submissions solve a level: Level.Answer, any of
+// Accept, or anything Regex matches in full, compared after Normalize. With
+// no Normalize the level's track decides: case-insensitive tracks fold case.
+// A wrong submission that Close matches gets that pattern's message.
+type AnswerSpec struct {
+	Accept    []string       `json:"accept,omitempty"`
+	Regex     string         `json:"regex,omitempty"`
+	Normalize []string       `json:"normalize,omitempty"`
+	Format    string         `json:"format,omitempty"`
+	Close     []ClosePattern `json:"close,omitempty"`
+}
+
+// ClosePattern is a regex for near misses, matched in full against the
+// normalized submission like AnswerSpec.Regex.
+type ClosePattern struct {
+	Pattern string `json:"pattern"`
+	Message string `json:"message,omitempty"`
+}
+
+const defaultCloseMessage = "You're close"
+
+var (
+	flagPattern = regexp.MustCompile(`^(?i:flag)\{(.*)\}$`)
+	caseFolder  = cases.Fold()
+)
+
+func (s *AnswerSpec) isZero() bool {
+	return s == nil || (len(s.Accept) == 0 && s.Regex == "" && len(s.Normalize) == 0 && (s.Format == "" || s.Format == FormatPlain) && len(s.Close) == 0)
+}
+
+func (s *AnswerSpec) Validate() error {
+	if s == nil {
+		return nil
+	}
+	for _, n := range s.Normalize {
+		switch n {
+		case NormNFKC, NormCaseFold, NormStripSpaces, NormStripPunct:
+		default:
+			return fmt.Errorf("unknown normalization %q", n)
+		}
+	}
+	switch s.Format {
+	case "", FormatPlain, FormatFlag:
+	default:
+		return fmt.Errorf("unknown answer format %q", s.Format)
+	}
+	if s.Regex != "" {
+		if _, err := regexp.Compile(s.Regex); err != nil {
+			return fmt.Errorf("bad regex: %v", err)
+		}
+	}
+	for _, a := range s.Accept {
+		if strings.TrimSpace(a) == "" {
+			return fmt.Errorf("empty accepted answer")
+		}
+	}
+	for i, c := range s.Close {
+		if strings.TrimSpace(c.Pattern) == "" {
+			return fmt.Errorf("close pattern %d is empty", i+1)
+		}
+		if _, err := regexp.Compile(c.Pattern); err != nil {
+			return fmt.Errorf("bad close pattern %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func normalizeAnswer(s string, steps []string) string {
+	s = strings.TrimSpace(s)
+	for _, step := range steps {
+		switch step {
+		case NormNFKC:
+			s = norm.NFKC.String(s)
+		case NormCaseFold:
+			s = caseFolder.String(s)
+		case NormStripSpaces:
+			s = strings.Map(func(r rune) rune {
+				if unicode.IsSpace(r) {
+					return -1
+				}
+				return r
+			}, s)
+		case NormStripPunct:
+			s = strings.Map(func(r rune) rune {
+				if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+					return -1
+				}
+				return r
+			}, s)
+		}
+	}
+	return s
+}
+
+// unwrapFlag returns the inside of flag{...}, or false if s is not wrapped.
+func unwrapFlag(s string) (string, bool) {
+	m := flagPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// AnswerCheck is the outcome of checking one submission against a level.
+// Normalized is the submission as compared; Reason explains a miss that is
+// not simply a wrong answer. Close is set when the miss hit a close pattern,
+// and Pattern is that pattern.
+type AnswerCheck struct {
+	Correct    bool   `json:"correct"`
+	Close      bool   `json:"close,omitempty"`
+	Pattern    string `json:"pattern,omitempty"`
+	Normalized string `json:"normalized"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+func fullMatch(pattern, s string) bool {
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	return err == nil && re.MatchString(s)
+}
+
+func (l *Level) normalization(track string) []string {
+	if l.sealed() {
+		return l.AnswerNorm
+	}
+	if l.Answers != nil && len(l.Answers.Normalize) > 0 {
+		return l.Answers.Normalize
+	}
+	if t, ok := lookupTrack(track); ok && t.Match == dbpkg.MatchCaseInsensitive {
+		return []string{NormCaseFold}
+	}
+	return nil
+}
+
+// CheckAnswer tests submitted against l, a level on track.
+func (l *Level) CheckAnswer(track, submitted string) AnswerCheck {
+	spec := l.Answers
+	if spec == nil {
+		spec = &AnswerSpec{}
+	}
+	if spec.Format == FormatFlag {
+		inner, ok := unwrapFlag(submitted)
+		if !ok {
+			return AnswerCheck{Normalized: strings.TrimSpace(submitted), Reason: "Answers to this level are written flag{...}"}
+		}
+		submitted = inner
+	}
+	steps := l.normalization(track)
+	got := normalizeAnswer(submitted, steps)
+	out := AnswerCheck{Normalized: got}
+	if got == "" {
+		return out
+	}
+	regex := spec.Regex
+	if l.sealed() {
+		if matchesAnswerHash(got, l.AnswerHashes) {
+			out.Correct = true
+			return out
+		}
+		if l.RegexSealed {
+			if v, err := openAnswerText(l.SealedAnswers, l.ID); err == nil {
+				regex = v.Regex
+			}
+		}
+	} else {
+		for _, a := range append([]string{l.Answer}, spec.Accept...) {
+			if spec.Format == FormatFlag {
+				if inner, ok := unwrapFlag(a); ok {
+					a = inner
+				}
+			}
+			if strings.TrimSpace(a) != "" && normalizeAnswer(a, steps) == got {
+				out.Correct = true
+				return out
+			}
+		}
+	}
+	if regex != "" && fullMatch(regex, got) {
+		out.Correct = true
+		return out
+	}
+	for _, c := range spec.Close {
+		if fullMatch(c.Pattern, got) {
+			out.Close, out.Pattern, out.Reason = true, c.Pattern, c.Message
+			if out.Reason == "" {
+				out.Reason = defaultCloseMessage
+			}
+			break
+		}
+	}
+	return out
+}
+
+// AdminLevelAnswerTestHandler serves /api/admin/levels/test. POST {level,
+// candidates} checks each candidate against the stored level. Passing answer
+// or answer_spec as well checks against that draft instead, merged like the
+// level form merges it, so authors can try a spec before saving it.
+func AdminLevelAnswerTestHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Level      string          `json:"level"`
+			Candidates []string        `json:"candidates"`
+			Answer     string          `json:"answer"`
+			Spec       json.RawMessage `json:"answer_spec"`
+		}
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+		typ, _, ok := splitLevelID(req.Level)
+		if !ok {
+			http.Error(w, "invalid level id", http.StatusBadRequest)
+			return
+		}
+		draft := strings.TrimSpace(req.Answer) != "" || (len(req.Spec) > 0 && string(req.Spec) != "null")
+		lvl, err := GetLevel(dbConn, req.Level)
+		if err != nil && !draft {
+			http.Error(w, "no such level", http.StatusNotFound)
+			return
+		}
+		if draft {
+			var plain *Level
+			if lvl != nil {
+				if plain, err = lvl.unsealed(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			answer, spec, err := draftAnswers(plain, req.Answer, req.Spec)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			lvl = &Level{ID: req.Level, Answer: answer, Answers: spec}
+		}
+		type result struct {
+			Candidate string `json:"candidate"`
+			AnswerCheck
+		}
+		out := []result{}
+		for _, c := range req.Candidates {
+			out = append(out, result{c, lvl.CheckAnswer(typ, c)})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"level": req.Level, "results": out})
+	}
+}
+
+// AdminNearMissHandler serves /api/admin/levels/close. GET ?level= lists
+// the level's close patterns by how often submissions hit them, most common
+// first.
+func AdminNearMissHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		level := r.URL.Query().Get("level")
+		if !isValidLevelID(level) {
+			http.Error(w, "invalid level id", http.StatusBadRequest)
+			return
+		}
+		misses, err := dbpkg.NearMisses(dbConn, level, defaultLogLimit)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"level": level, "near_misses": misses})
+	}
+}
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	dbpkg "sudocrypt25/db"
+)
+
+const minAnswerSecret = 16
+
+var (
+	answerSecretOnce  sync.Once
+	answerSecretKey   []byte
+	errSealedAnswer   = errors.New("cannot open sealed answers; was ANSWER_SECRET changed?")
+	errNoAnswerSecret = fmt.Errorf("ANSWER_SECRET must be set to at least %d characters", minAnswerSecret)
+)
+
+// answerSecret keys the answer hashes and seals the plaintext kept for
+// reveal. There is no fallback: with a key anyone could guess, the sealed
+// copy would be as good as plaintext. Changing it makes every stored answer
+// unverifiable.
+func answerSecret() ([]byte, error) {
+	answerSecretOnce.Do(func() {
+		if v := os.Getenv("ANSWER_SECRET"); len(v) >= minAnswerSecret {
+			answerSecretKey = []byte("level-answers|" + v)
+		}
+	})
+	if answerSecretKey == nil {
+		return nil, errNoAnswerSecret
+	}
+	return answerSecretKey, nil
+}
+
+// CheckAnswerSecret reports whether answers can be hashed and sealed. The
+// server does not start without it.
+func CheckAnswerSecret() error {
+	_, err := answerSecret()
+	return err
+}
+
+func answerMAC(label, s string) ([]byte, error) {
+	key, err := answerSecret()
+	if err != nil {
+		return nil, err
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label))
+	m.Write([]byte{0})
+	m.Write([]byte(s))
+	return m.Sum(nil), nil
+}
+
+func answerHash(normalized string) (string, error) {
+	mac, err := answerMAC("hash", normalized)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(mac), nil
+}
+
+// matchesAnswerHash compares against every hash so the time taken does not
+// say which one matched.
+func matchesAnswerHash(normalized string, hashes []string) bool {
+	h, err := answerHash(normalized)
+	if err != nil {
+		return false
+	}
+	got := []byte(h)
+	match := 0
+	for _, h := range hashes {
+		match |= subtle.ConstantTimeCompare(got, []byte(h))
+	}
+	return match == 1
+}
+
+type sealedAnswers struct {
+	Answer string   `json:"answer"`
+	Accept []string `json:"accept,omitempty"`
+	Regex  string   `json:"regex,omitempty"`
+}
+
+func answerCipher() (cipher.AEAD, error) {
+	key, err := answerMAC("seal", "")
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealAnswerText(v sealedAnswers, levelID string) (string, error) {
+	aead, err := answerCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	b, _ := json.Marshal(v)
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, b, []byte(levelID))), nil
+}
+
+func openAnswerText(s, levelID string) (sealedAnswers, error) {
+	var v sealedAnswers
+	aead, err := answerCipher()
+	if err != nil {
+		return v, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return v, errSealedAnswer
+	}
+	b, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(levelID))
+	if err != nil {
+		return v, errSealedAnswer
+	}
+	return v, json.Unmarshal(b, &v)
+}
+
+// sealed reports whether l keeps its answers as hashes rather than
+// plaintext.
+func (l *Level) sealed() bool {
+	return l.SealedAnswers != ""
+}
+
+// sealAnswers replaces l's plaintext answer and accepted answers with keyed
+// hashes of their normalized forms, plus a sealed copy for reveal. The regex
+// cannot be hashed, so it only lives in the sealed copy. The normalization
+// is fixed at this point, so later changes to the track's match mode do not
+// break stored hashes.
+func sealAnswers(l *Level, track string) error {
+	if l.sealed() {
+		return nil
+	}
+	var spec AnswerSpec
+	if l.Answers != nil {
+		spec = *l.Answers
+	}
+	steps := l.normalization(track)
+	hashes := []string{}
+	for _, a := range append([]string{l.Answer}, spec.Accept...) {
+		if spec.Format == FormatFlag {
+			if inner, ok := unwrapFlag(a); ok {
+				a = inner
+			}
+		}
+		if n := normalizeAnswer(a, steps); n != "" {
+			h, err := answerHash(n)
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, h)
+		}
+	}
+	s, err := sealAnswerText(sealedAnswers{Answer: l.Answer, Accept: spec.Accept, Regex: spec.Regex}, l.ID)
+	if err != nil {
+		return err
+	}
+	l.AnswerHashes = hashes
+	l.AnswerNorm = append([]string{}, steps...)
+	l.SealedAnswers = s
+	l.RegexSealed = spec.Regex != ""
+	l.Answer = ""
+	if l.Answers != nil {
+		spec.Accept, spec.Regex = nil, ""
+		if spec.isZero() {
+			l.Answers = nil
+		} else {
+			l.Answers = &spec
+		}
+	}
+	return nil
+}
+
+// unsealed returns a copy of l with its answers in plaintext again, as an
+// author wrote them. Levels stored before hashing are returned as they are.
+func (l *Level) unsealed() (*Level, error) {
+	out := *l
+	if !l.sealed() {
+		return &out, nil
+	}
+	v, err := openAnswerText(l.SealedAnswers, l.ID)
+	if err != nil {
+		return nil, err
+	}
+	out.Answer = v.Answer
+	if len(v.Accept) > 0 || v.Regex != "" {
+		spec := AnswerSpec{}
+		if l.Answers != nil {
+			spec = *l.Answers
+		}
+		spec.Accept, spec.Regex = v.Accept, v.Regex
+		out.Answers = &spec
+	}
+	out.AnswerHashes, out.AnswerNorm, out.SealedAnswers, out.RegexSealed = nil, nil, "", false
+	return &out, nil
+}
+
+// forAuthors is l as the admin page gets it: everything but the answers.
+func (l Level) forAuthors() Level {
+	l.Answer = ""
+	l.AnswerHashes, l.AnswerNorm, l.SealedAnswers, l.RegexSealed = nil, nil, "", false
+	return l
+}
+
+// answerSummary says what a level accepts without saying what it is.
+func answerSummary(l *Level) string {
+	if !l.sealed() {
+		if l.Answer == "" {
+			return "none"
+		}
+		return "not sealed"
+	}
+	s := fmt.Sprintf("sealed, %d accepted", len(l.AnswerHashes))
+	if l.RegexSealed {
+		s += " and a regex"
+	}
+	return s
+}
+
+// draftAnswers applies an author's edit to prev, a level's plaintext answers
+// or nil for a new level. The admin page never has the answers unless they
+// were revealed, so an empty answer keeps the old one, a null spec keeps the
+// old spec, and a spec without "accept" or "regex" keeps those.
+func draftAnswers(prev *Level, answer string, raw json.RawMessage) (string, *AnswerSpec, error) {
+	if prev == nil {
+		prev = &Level{}
+	}
+	if strings.TrimSpace(answer) == "" {
+		answer = prev.Answer
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return answer, prev.Answers, nil
+	}
+	var spec AnswerSpec
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(raw, &spec) != nil || json.Unmarshal(raw, &keys) != nil {
+		return "", nil, errors.New("bad answer_spec")
+	}
+	if prev.Answers != nil {
+		if _, ok := keys["accept"]; !ok {
+			spec.Accept = prev.Answers.Accept
+		}
+		if _, ok := keys["regex"]; !ok {
+			spec.Regex = prev.Answers.Regex
+		}
+	}
+	if err := spec.Validate(); err != nil {
+		return "", nil, err
+	}
+	if spec.isZero() {
+		return answer, nil, nil
+	}
+	return answer, &spec, nil
+}
+
+// sealStoredLevels hashes the answers of levels saved before answers were
+// hashed at rest, and drops the unkeyed public_hash older levels carry.
+func sealStoredLevels(dbConn dbpkg.Store) {
+	data, err := dbpkg.GetAll(dbConn, "levels")
+	if err != nil {
+		log.Println("[levels] sealing:", err)
+		return
+	}
+	for id, raw := range data {
+		var lvl Level
+		typ, _, ok := splitLevelID(id)
+		if !ok || json.Unmarshal([]byte(raw), &lvl) != nil {
+			continue
+		}
+		if lvl.sealed() && !strings.Contains(raw, `"public_hash"`) {
+			continue
+		}
+		lvl.ID = id
+		if err := sealAnswers(&lvl, typ); err != nil {
+			log.Println("[levels] sealing", id+":", err)
+			continue
+		}
+		b, _ := json.Marshal(lvl)
+		if err := dbpkg.Set(dbConn, "levels", id, string(b)); err != nil {
+			log.Println("[levels] sealing", id+":", err)
+		}
+	}
+}
+
+// AdminLevelRevealHandler serves /api/admin/levels/reveal. POST {level}
+// returns the level's answer and accepted answers so its author can edit
+// them. Every reveal is audited.
+func AdminLevelRevealHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Level string `json:"level"`
+		}
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+		lvl, err := GetLevel(dbConn, req.Level)
+		if err != nil {
+			http.Error(w, "no such level", http.StatusNotFound)
+			return
+		}
+		plain, err := lvl.unsealed()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(dbConn, r, "level.reveal", req.Level, nil, nil)
+		out := map[string]interface{}{"level": req.Level, "answer": plain.Answer}
+		if plain.Answers != nil {
+			out["accept"] = plain.Answers.Accept
+			out["regex"] = plain.Answers.Regex
+		}
+		noStore(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	dbpkg "sudocrypt25/db"
+)
+
+// audit records a privileged action by the request's principal. before and
+// after are stored as JSON; pass nil for a side that does not exist. A
+// failed write is printed rather than failing the action it describes.
+func audit(dbConn dbpkg.Store, r *http.Request, action, target string, before, after interface{}) {
+	e := &dbpkg.AuditEntry{Action: action, Target: target, IP: clientIP(r), CreatedAt: time.Now().Unix()}
+	if p := PrincipalFromContext(r.Context()).Actor(); p != nil {
+		e.Actor = p.Email
+	}
+	e.Before = auditSnapshot(before)
+	e.After = auditSnapshot(after)
+	if err := dbpkg.AddAudit(dbConn, e); err != nil {
+		fmt.Println("audit:", action, target, err)
+	}
+}
+
+// auditSnapshot marshals v, treating nil and typed nils alike as absent.
+func auditSnapshot(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return nil
+	}
+	return b
+}
+
+// AdminAuditHandler serves GET /api/admin/audit. Filters: actor, action
+// (a trailing "." matches a prefix), target, since/until (unix seconds or
+// RFC 3339), cursor, limit and order=desc. Each entry carries the fields
+// that changed between its before and after snapshots.
+func AdminAuditHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		f := dbpkg.AuditFilter{
+			Actor:  strings.ToLower(strings.TrimSpace(q.Get("actor"))),
+			Action: strings.TrimSpace(q.Get("action")),
+			Target: strings.TrimSpace(q.Get("target")),
+			Desc:   strings.EqualFold(q.Get("order"), "desc"),
+		}
+		var ok bool
+		var err error
+		if f.Since, ok = parseLogTime(q.Get("since")); !ok {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		if f.Until, ok = parseLogTime(q.Get("until")); !ok {
+			http.Error(w, "invalid until", http.StatusBadRequest)
+			return
+		}
+		if v := q.Get("cursor"); v != "" {
+			f.Cursor, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || f.Cursor < 0 {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			f.Limit, err = strconv.Atoi(v)
+			if err != nil || f.Limit < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		if f.Limit == 0 {
+			f.Limit = defaultLogLimit
+		}
+		if f.Limit > maxLogLimit {
+			f.Limit = maxLogLimit
+		}
+		entries, err := dbpkg.QueryAudit(dbConn, f)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		out := make([]map[string]interface{}, 0, len(entries))
+		for _, e := range entries {
+			out = append(out, map[string]interface{}{
+				"id":         e.ID,
+				"actor":      e.Actor,
+				"action":     e.Action,
+				"target":     e.Target,
+				"before":     e.Before,
+				"after":      e.After,
+				"changes":    e.Changes(),
+				"ip":         e.IP,
+				"created_at": e.CreatedAt,
+			})
+		}
+		next := ""
+		if len(entries) == f.Limit {
+			next = strconv.FormatInt(entries[len(entries)-1].ID, 10)
+		}
+		noStore(w)
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": out, "next_cursor": next})
+	}
+}
@@ -2,25 +2,53 @@ package handlers
 
 import (
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/smtp"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"sudocrypt25/db"
 	tplt "sudocrypt25/template"
 )
 
-func InitHandlers() {
+func InitHandlers(dbConn db.Store) {
+	settings = db.NewSettings(dbConn)
+	InitTracks(dbConn)
+	sealStoredLevels(dbConn)
+	otps = db.NewOTPs(dbConn)
+	initLoginLimits()
+	go cleanupLoop(dbConn)
+	initBackups(dbConn)
 	tplt.InitTemplates()
 }
 
+var otps *db.OTPs
+
+func cleanupLoop(dbConn db.Store) {
+	for {
+		if err := otps.Cleanup(); err != nil {
+			fmt.Println("cleanup:", err)
+		}
+		pruneMFAChallenges()
+		loginLimits.ip.Prune()
+		loginLimits.email.Prune()
+		now := time.Now()
+		if err := db.ExpireSessions(dbConn, now.Add(-sessionIdleTimeout()).Unix(), now.Add(-sessionMaxAge()).Unix()); err != nil {
+			fmt.Println("cleanup:", err)
+		}
+		time.Sleep(10 * time.Minute)
+	}
+}
+
 func isValidEmail(email string) bool {
 	re := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 	return re.MatchString(email)
@@ -65,34 +93,28 @@ func SendMail(to, subject, body string) error {
 	return nil
 }
 
-func getOTP(email string) int {
-	salt := os.Getenv("AUTH_SALT")
-	if salt == "" {
-		salt = "default_salt"
+// clientIP is the address of the direct peer; the server terminates TLS
+// itself so there is no proxy header to trust.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
-	h := sha256.Sum256([]byte(email + salt))
-	n := int64(0)
-	for i := 0; i < 8; i++ {
-		n = (n << 8) + int64(h[i])
-	}
-	if n < 0 {
-		n = -n
-	}
-	return int(n % 1000000)
+	return host
 }
 
-func SendOtpHandler(dbConn *sql.DB) http.HandlerFunc {
+func SendOtpHandler(dbConn db.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 		var payload map[string]string
-		if r.Method == http.MethodPost {
-			defer r.Body.Close()
-			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				json.NewEncoder(w).Encode(map[string]string{"error": "invalid payload"})
-				return
-			}
-		} else {
-			payload = map[string]string{"email": r.URL.Query().Get("email")}
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid payload"})
+			return
 		}
 		email := strings.TrimSpace(strings.ToLower(payload["email"]))
 		if !isValidEmail(email) {
@@ -101,9 +123,9 @@ func SendOtpHandler(dbConn *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		regVal, regErr := db.Get(dbConn, "registration", email)
-		fmt.Println("SendOtpHandler: checking registration for", email, "err=", regErr, "valLen=", len(regVal))
-		if regErr == nil {
+		exists, regErr := db.AccountExists(dbConn, email)
+		fmt.Println("SendOtpHandler: checking registration for", email, "err=", regErr, "exists=", exists)
+		if exists {
 			fmt.Println("SendOtpHandler: registration exists for", email)
 			w.WriteHeader(http.StatusConflict)
 			json.NewEncoder(w).Encode(map[string]string{"error": "email already exists as a user"})
@@ -117,11 +139,30 @@ func SendOtpHandler(dbConn *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		otp := getOTP(email)
-		s := fmt.Sprintf("%06d", otp)
+		if pw := payload["password"]; pw != "" {
+			if err := CheckPasswordPolicy(pw, email); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+		}
+
+		otp, err := otps.Issue(email, clientIP(r))
+		if err != nil {
+			var te *db.ThrottleError
+			if errors.As(err, &te) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(te.RetryAfter.Seconds())+1))
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]string{"error": te.Error()})
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "db error"})
+			return
+		}
 		digits := make([]string, 6)
 		for i := 0; i < 6; i++ {
-			digits[i] = string(s[i])
+			digits[i] = string(otp[i])
 		}
 		b, err := os.ReadFile("components/otp.html")
 		if err == nil {
@@ -134,10 +175,19 @@ func SendOtpHandler(dbConn *sql.DB) http.HandlerFunc {
 			html = strings.ReplaceAll(html, "{digit6}", digits[5])
 			go SendMail(email, "Sudocrypt OTP", html)
 		} else {
-			go SendMail(email, "Your OTP", fmt.Sprintf("Your verification code is: %06d", otp))
+			go SendMail(email, "Your OTP", "Your verification code is: "+otp)
 		}
 		if name, ok := payload["name"]; ok {
-			pending := map[string]string{"name": name, "phonenumber": payload["phonenumber"], "email": email, "password": payload["password"]}
+			pending := map[string]string{"name": name, "phonenumber": payload["phonenumber"], "email": email}
+			if pw := payload["password"]; pw != "" {
+				hash, err := HashPassword(pw)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]string{"error": "hash error"})
+					return
+				}
+				pending["password_hash"] = hash
+			}
 			pb, _ := json.Marshal(pending)
 			db.Set(dbConn, "pending_signup", email, string(pb))
 		}
@@ -146,23 +196,43 @@ func SendOtpHandler(dbConn *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ApiAuthHandler(dbConn *sql.DB) http.HandlerFunc {
+func ApiAuthHandler(dbConn db.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		q := r.URL.Query()
-		method := q.Get("method")
-		emailRaw := q.Get("email")
-		email := strings.TrimSpace(strings.ToLower(emailRaw))
-		password := q.Get("password")
-		ph := q.Get("phonenumber")
-		name := q.Get("name")
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Method      string `json:"method"`
+			Email       string `json:"email"`
+			Password    string `json:"password"`
+			PhoneNumber string `json:"phonenumber"`
+			Name        string `json:"name"`
+			OTP         string `json:"otp"`
+			Token       string `json:"token"`
+			MFAToken    string `json:"mfa_token"`
+			Code        string `json:"code"`
+		}
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid payload"})
+			return
+		}
+		method := req.Method
+		email := strings.TrimSpace(strings.ToLower(req.Email))
+		password := req.Password
+		ph := req.PhoneNumber
+		name := req.Name
 
-		otp := q.Get("otp")
+		otp := req.OTP
 		if method == "signup" {
 			if email == "" || otp == "" {
 				w.WriteHeader(http.StatusBadRequest)
 				json.NewEncoder(w).Encode(map[string]string{"error": "missing fields"})
 				return
 			}
+			passwordHash := ""
 			if name == "" || password == "" || ph == "" {
 				v, err := db.Get(dbConn, "pending_signup", email)
 				if err == nil {
@@ -175,10 +245,11 @@ func ApiAuthHandler(dbConn *sql.DB) http.HandlerFunc {
 						ph = pending["phonenumber"]
 					}
 					if password == "" {
+						passwordHash = pending["password_hash"]
 						password = pending["password"]
 					}
 				}
-				if name == "" || password == "" || ph == "" {
+				if name == "" || (password == "" && passwordHash == "") || ph == "" {
 					w.WriteHeader(http.StatusBadRequest)
 					json.NewEncoder(w).Encode(map[string]string{"error": "missing fields"})
 					return
@@ -194,43 +265,80 @@ func ApiAuthHandler(dbConn *sql.DB) http.HandlerFunc {
 				json.NewEncoder(w).Encode(map[string]string{"error": "invalid phone"})
 				return
 			}
-			expected := fmt.Sprintf("%06d", getOTP(email))
-			if otp != expected {
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(map[string]string{"error": "incorrect otp"})
-				return
-			}
-			_, err := db.Get(dbConn, "registration", email)
-			if err == nil {
+			if exists, _ := db.AccountExists(dbConn, email); exists {
 				w.WriteHeader(http.StatusConflict)
 				json.NewEncoder(w).Encode(map[string]string{"error": "account exists"})
 				return
 			}
-			user := map[string]interface{}{"email": email, "name": name, "phonenumber": ph, "password": hashHex(password), "created_at": time.Now().Unix()}
-			b, _ := json.Marshal(user)
-			err = db.Set(dbConn, "registration", email, string(b))
-
-			if err != nil {
+			if password != "" {
+				if err := CheckPasswordPolicy(password, email); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+					return
+				}
+				hash, err := HashPassword(password)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]string{"error": "hash error"})
+					return
+				}
+				passwordHash = hash
+			}
+			if err := otps.Verify(email, otp); err != nil {
+				status := http.StatusUnauthorized
+				if err != db.ErrOTPInvalid && err != db.ErrOTPExpired && err != db.ErrOTPTooManyAttempts {
+					status = http.StatusInternalServerError
+				}
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			now := time.Now().Unix()
+			user := &db.Account{Email: email, Name: name, PhoneNumber: ph, Password: passwordHash, LastSolveAt: now, CreatedAt: now}
+			if err := db.CreateAccount(dbConn, user); err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				json.NewEncoder(w).Encode(map[string]string{"error": "db error"})
 				return
 			}
-			sid, err := CreateSession(dbConn, email)
-			if err == nil {
-				SetSessionCookie(w, sid)
+			if err := StartSession(dbConn, w, r, email, false); err != nil {
+				fmt.Println("session error for", email, err)
 			}
 			db.Set(dbConn, "emails", email, fmt.Sprintf("%d", time.Now().Unix()))
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
-			lb := map[string]interface{}{"email": email, "time": float64(time.Now().Unix()), "points": 0, "name": name}
-			lbB, _ := json.Marshal(lb)
-			db.Set(dbConn, "leaderboard", email, string(lbB))
-			if pend, err := db.GetAll(dbConn, "pending_signup"); err == nil {
-				for k := range pend {
-					if k == email || strings.Contains(k, email) {
-						db.Delete(dbConn, "pending_signup", k)
-					}
+			db.Delete(dbConn, "pending_signup", email)
+			return
+		}
+		if method == "reset_request" {
+			if !isValidEmail(email) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid email"})
+				return
+			}
+			if acct, err := db.GetAccount(dbConn, email); err == nil {
+				sendResetMail(r, acct, true)
+			}
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+			return
+		}
+		if method == "reset" {
+			token := req.Token
+			if token == "" || password == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "missing fields"})
+				return
+			}
+			if err := resetPassword(dbConn, token, password); err != nil {
+				status := http.StatusBadRequest
+				if err != errResetToken && !isPolicyError(err) {
+					fmt.Println("Password reset failed:", err)
+					status = http.StatusInternalServerError
+					err = errors.New("db error")
 				}
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
 			}
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
 		}
 		if method == "login" {
@@ -239,26 +347,76 @@ func ApiAuthHandler(dbConn *sql.DB) http.HandlerFunc {
 				json.NewEncoder(w).Encode(map[string]string{"error": "missing fields"})
 				return
 			}
-			v, err := db.Get(dbConn, "registration", email)
-			fmt.Println("Login attempt for", email, "dbGetErr=", err, "valLen=", len(v))
+			if wait, locked := loginWait(clientIP(r), email); wait > 0 {
+				msg := fmt.Sprintf("too many login attempts, retry in %s", wait.Round(time.Second))
+				if locked {
+					msg = fmt.Sprintf("account temporarily locked, retry in %s", wait.Round(time.Second))
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]string{"error": msg})
+				return
+			}
+			account, err := db.GetAccount(dbConn, email)
 			if err != nil {
-				fmt.Println("Login failed: no account for", email)
+				loginFailed(dbConn, r, email)
 				w.WriteHeader(http.StatusUnauthorized)
 				json.NewEncoder(w).Encode(map[string]string{"error": "no account"})
 				return
 			}
-			var account map[string]interface{}
-			json.Unmarshal([]byte(v), &account)
-			stored, _ := account["password"].(string)
-			if stored != hashHex(password) {
-				fmt.Println("Login failed: password mismatch for", email)
+			ok, rehash := VerifyPassword(account.Password, password)
+			if !ok {
+				loginFailed(dbConn, r, email)
 				w.WriteHeader(http.StatusUnauthorized)
 				json.NewEncoder(w).Encode(map[string]string{"error": "incorrect password"})
 				return
 			}
-			sid, err := CreateSession(dbConn, email)
-			if err == nil {
-				SetSessionCookie(w, sid)
+			loginSucceeded(email)
+			mfa, err := db.TOTPEnabled(dbConn, email)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "db error"})
+				return
+			}
+			if rehash {
+				if hash, err := HashPassword(password); err == nil {
+					if err := db.SetPassword(dbConn, email, hash); err != nil {
+						fmt.Println("Login: password rehash failed for", email, err)
+					}
+				}
+			}
+			if mfa {
+				token, err := startMFAChallenge(email)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]string{"error": "db error"})
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"mfa_required": true, "mfa_token": token})
+				return
+			}
+			if err := StartSession(dbConn, w, r, email, false); err != nil {
+				fmt.Println("session error for", email, err)
+			}
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+			return
+		}
+		if method == "login_mfa" {
+			c, ok := lookupMFAChallenge(req.MFAToken)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "login expired, please sign in again"})
+				return
+			}
+			ok, err := checkSecondFactor(dbConn, r, c.email, req.Code)
+			if err != nil || !ok {
+				atomic.AddInt32(&c.attempts, 1)
+				writeSecondFactorError(w, err)
+				return
+			}
+			mfaChallenges.Delete(req.MFAToken)
+			if err := StartSession(dbConn, w, r, c.email, true); err != nil {
+				fmt.Println("session error for", c.email, err)
 			}
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
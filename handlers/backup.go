@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	dbpkg "sudocrypt25/db"
+)
+
+var backups *dbpkg.Backups
+
+// initBackups reads BACKUP_DIR, BACKUP_KEEP and BACKUP_INTERVAL. An empty
+// interval leaves scheduled backups off.
+func initBackups(dbConn dbpkg.Store) {
+	keep, _ := strconv.Atoi(os.Getenv("BACKUP_KEEP"))
+	backups = dbpkg.NewBackups(dbConn, os.Getenv("BACKUP_DIR"), keep)
+	v := os.Getenv("BACKUP_INTERVAL")
+	if v == "" || dbConn.Driver() != "sqlite" {
+		return
+	}
+	every, err := time.ParseDuration(v)
+	if err != nil || every <= 0 {
+		log.Println("backup: invalid BACKUP_INTERVAL", v)
+		return
+	}
+	go backups.Schedule(every, nil)
+}
+
+func AdminBackupHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := PrincipalFromContext(r.Context()).Email
+		switch r.Method {
+		case http.MethodGet:
+			list, err := backups.List()
+			if err != nil {
+				http.Error(w, "backup error", http.StatusInternalServerError)
+				return
+			}
+			resp := map[string]interface{}{"backups": list, "dir": backups.Dir, "keep": backups.Keep}
+			if r.URL.Query().Get("check") != "" {
+				if err := dbpkg.CheckIntegrity(dbConn); err != nil {
+					resp["integrity"] = err.Error()
+				} else {
+					resp["integrity"] = "ok"
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		case http.MethodPost:
+			info, err := backups.Run()
+			if err != nil {
+				log.Println("backup:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Println("backup: wrote", info.Path, "for", email)
+			audit(dbConn, r, "backup.run", info.Path, nil, info)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "backup": info})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	dbpkg "sudocrypt25/db"
+)
+
+const maxBundleSize = 1 << 30
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// AdminExportHandler streams an event bundle. ?sections= takes a comma
+// separated subset of dbpkg.BundleSections. Every export is audited, since
+// a bundle can hold every account and message. Levels are exported as
+// stored, with answers sealed to this install's ANSWER_SECRET: another
+// install can only use them if it runs with the same secret. Use level
+// files to move levels between installs.
+func AdminExportHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := PrincipalFromContext(r.Context()).Email
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sections, err := dbpkg.ParseSections(splitList(r.URL.Query().Get("sections")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit(dbConn, r, "bundle.export", strings.Join(sections, ","), nil, map[string]interface{}{"sections": sections})
+		name := "sudocrypt-event-" + time.Now().UTC().Format("20060102T150405Z") + ".zip"
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		if err := dbpkg.ExportBundle(dbConn, w, sections); err != nil {
+			// headers are already out; the truncated zip will fail to open
+			log.Println("export:", err)
+			return
+		}
+		log.Println("export: bundle", sections, "downloaded by", email)
+	}
+}
+
+// AdminImportHandler applies an uploaded bundle, either as the raw request
+// body or as the "file" field of a multipart form. ?mode= is skip,
+// overwrite or fail.
+func AdminImportHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := PrincipalFromContext(r.Context()).Email
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBundleSize)
+		var body io.Reader = r.Body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "missing file", http.StatusBadRequest)
+				return
+			}
+			defer f.Close()
+			body = f
+		}
+		tmp, err := os.CreateTemp("", "sudocrypt-import-*.zip")
+		if err != nil {
+			http.Error(w, "import error", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		size, err := io.Copy(tmp, body)
+		if err != nil {
+			http.Error(w, "upload failed", http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		opts := dbpkg.ImportOptions{Mode: dbpkg.ImportMode(q.Get("mode")), Sections: splitList(q.Get("sections"))}
+		res, err := dbpkg.ImportBundle(dbConn, tmp, size, opts)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, dbpkg.ErrImportConflict) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		log.Println("import: bundle applied by", email)
+		audit(dbConn, r, "bundle.import", string(opts.Mode), nil, map[string]interface{}{"sections": opts.Sections, "result": res})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": res})
+	}
+}
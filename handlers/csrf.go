@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// CSRFMiddleware implements the double-submit cookie pattern. Every
+// response carries a csrf_token cookie readable by page scripts, and any
+// request other than GET, HEAD or OPTIONS must echo it in the X-CSRF-Token
+// header (or a csrf_token field for plain HTML forms).
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if c, err := r.Cookie(csrfCookieName); err == nil && len(c.Value) == 64 {
+			token = c.Value
+		} else {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				http.Error(w, "csrf error", http.StatusInternalServerError)
+				return
+			}
+			token = hex.EncodeToString(b)
+			http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Value: token, Path: "/", Secure: true, SameSite: http.SameSiteLaxMode})
+			// a freshly minted token cannot have been echoed back
+			if !safeMethod(r.Method) {
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+		}
+		if safeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sent := r.Header.Get(csrfHeaderName)
+		if sent == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			sent = r.PostFormValue(csrfFormField)
+		}
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -19,13 +19,8 @@ type HintEntry struct {
 	Type    string  `json:"type"`
 }
 
-func HintsHandler(dbConn *sql.DB) http.HandlerFunc {
+func HintsHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
 		q := r.URL.Query()
 		level := q.Get("level")
 		if level == "" {
@@ -59,18 +54,8 @@ func HintsHandler(dbConn *sql.DB) http.HandlerFunc {
 	}
 }
 
-func AdminHintsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func AdminHintsHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" || admins == nil || !admins.IsAdmin(email) {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
 		switch r.Method {
 		case http.MethodPost:
 			var payload map[string]string
@@ -85,7 +70,7 @@ func AdminHintsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			content := payload["content"]
 			typ := payload["type"]
 			if typ == "" {
-				typ = "cryptic"
+				typ = DefaultTrack()
 			}
 			id := strconv.FormatInt(time.Now().UnixNano(), 10)
 			he := HintEntry{Time: float64(time.Now().Unix()), Content: content, ID: id, Author: "Exun Clan", Type: typ}
@@ -94,6 +79,7 @@ func AdminHintsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			audit(dbConn, r, "hint.create", level+"/"+id, nil, he)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": id})
 			return
@@ -109,12 +95,14 @@ func AdminHintsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				http.Error(w, "missing id or level", http.StatusBadRequest)
 				return
 			}
+			before := storedHint(dbConn, level+"/"+id)
 			he := HintEntry{Time: float64(time.Now().Unix()), Content: content, ID: id, Author: "Exun Clan", Type: typ}
 			b, _ := json.Marshal(he)
 			if err := dbpkg.Set(dbConn, "hints", level+"/"+id, string(b)); err != nil {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			audit(dbConn, r, "hint.update", level+"/"+id, before, he)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
@@ -126,10 +114,12 @@ func AdminHintsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				http.Error(w, "missing level or id", http.StatusBadRequest)
 				return
 			}
+			before := storedHint(dbConn, level+"/"+id)
 			if err := dbpkg.Delete(dbConn, "hints", level+"/"+id); err != nil {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			audit(dbConn, r, "hint.delete", level+"/"+id, before, nil)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
@@ -139,3 +129,15 @@ func AdminHintsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 		}
 	}
 }
+
+func storedHint(dbConn dbpkg.Store, key string) *HintEntry {
+	s, err := dbpkg.Get(dbConn, "hints", key)
+	if err != nil {
+		return nil
+	}
+	var he HintEntry
+	if json.Unmarshal([]byte(s), &he) != nil {
+		return nil
+	}
+	return &he
+}
@@ -1,16 +1,13 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"os"
 	"sort"
 	"strings"
-	"time"
 
 	dbpkg "sudocrypt25/db"
 )
@@ -22,30 +19,39 @@ type leaderboard struct {
 	Time   float64 `json:"time"`
 }
 
-func ProcessLeaderboard(dbConn *sql.DB) error {
-	sample := leaderboard{
-		Email:  "exun@dpsrkp.net",
-		Name:   "Exun",
-		Points: 9999,
-		Time:   float64(time.Now().Unix()),
+func loadLeaderboard(dbConn dbpkg.Store) ([]leaderboard, error) {
+	accts, err := dbpkg.ListAccounts(dbConn)
+	if err != nil {
+		return nil, err
 	}
-	b, _ := json.Marshal(sample)
-	if err := dbpkg.Set(dbConn, "leaderboard", sample.Email, string(b)); err != nil {
-		return err
+	entries := []leaderboard{}
+	for _, a := range accts {
+		entries = append(entries, leaderboard{Email: a.Email, Name: a.Name, Points: a.Points, Time: float64(a.LastSolveAt)})
 	}
+	return entries, nil
+}
 
-	data, err := dbpkg.GetAll(dbConn, "leaderboard")
+// leaderboardHidden is who the leaderboard leaves out for viewer: staff,
+// disqualified players and shadow-hidden players other than viewer, who
+// should not notice being hidden.
+func leaderboardHidden(dbConn dbpkg.Store, admins *Admins, viewer string) (map[string]bool, error) {
+	sanctions, err := dbpkg.ListSanctions(dbConn)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	entries := []leaderboard{}
-	for _, v := range data {
-		var e leaderboard
-		if err := json.Unmarshal([]byte(v), &e); err != nil {
-			log.Println("skip", err)
-			continue
+	hidden := admins.Staff()
+	for email, s := range sanctions {
+		if s.Has(dbpkg.SanctionDisqualified) || (s.Has(dbpkg.SanctionHidden) && email != viewer) {
+			hidden[email] = true
 		}
-		entries = append(entries, e)
+	}
+	return hidden, nil
+}
+
+func ProcessLeaderboard(dbConn dbpkg.Store) error {
+	entries, err := loadLeaderboard(dbConn)
+	if err != nil {
+		return err
 	}
 	sort.Slice(entries, func(i, j int) bool {
 		if entries[i].Points == entries[j].Points {
@@ -60,19 +66,11 @@ func ProcessLeaderboard(dbConn *sql.DB) error {
 	return nil
 }
 
-func GenerateLeaderboardHTML(dbConn *sql.DB, admins *Admins) (string, error) {
-	data, err := dbpkg.GetAll(dbConn, "leaderboard")
+func GenerateLeaderboardHTML(dbConn dbpkg.Store, admins *Admins, viewer string) (string, error) {
+	entries, err := loadLeaderboard(dbConn)
 	if err != nil {
 		return "", err
 	}
-	entries := []leaderboard{}
-	for _, v := range data {
-		var e leaderboard
-		if err := json.Unmarshal([]byte(v), &e); err != nil {
-			continue
-		}
-		entries = append(entries, e)
-	}
 	sort.Slice(entries, func(i, j int) bool {
 		if entries[i].Points == entries[j].Points {
 			return entries[i].Time < entries[j].Time
@@ -85,10 +83,14 @@ func GenerateLeaderboardHTML(dbConn *sql.DB, admins *Admins) (string, error) {
 		return "", err
 	}
 	cardTpl := string(cardBytes)
+	hidden, err := leaderboardHidden(dbConn, admins, viewer)
+	if err != nil {
+		return "", err
+	}
 	var sb strings.Builder
 	rankCounter := 1
 	for _, e := range entries {
-		if admins != nil && admins.IsAdmin(e.Email) {
+		if hidden[e.Email] {
 			continue
 		}
 		rank := fmt.Sprintf("%d", rankCounter)
@@ -107,7 +109,7 @@ func GenerateLeaderboardHTML(dbConn *sql.DB, admins *Admins) (string, error) {
 	return sb.String(), nil
 }
 
-func LeaderboardAPIHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func LeaderboardAPIHandler(dbConn dbpkg.Store, admins *Admins) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
 		sortBy := q.Get("sort")
@@ -116,18 +118,23 @@ func LeaderboardAPIHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			order = "desc"
 		}
 
-		data, err := dbpkg.GetAll(dbConn, "leaderboard")
+		all, err := loadLeaderboard(dbConn)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		viewer := ""
+		if p := PrincipalFromContext(r.Context()); p != nil {
+			viewer = p.Email
+		}
+		hidden, err := leaderboardHidden(dbConn, admins, viewer)
 		if err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
 		entries := []leaderboard{}
-		for _, v := range data {
-			var e leaderboard
-			if err := json.Unmarshal([]byte(v), &e); err != nil {
-				continue
-			}
-			if admins != nil && admins.IsAdmin(e.Email) {
+		for _, e := range all {
+			if hidden[e.Email] {
 				continue
 			}
 			entries = append(entries, e)
@@ -0,0 +1,517 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dbpkg "sudocrypt25/db"
+)
+
+// A level file declares one track: every level with its answer, markup,
+// source hint, walkthrough checkpoints, lead setting and hints. Authors can
+// keep it in git and sync it with SyncLevelFile.
+const (
+	LevelFileFormat  = "sudocrypt-levels"
+	LevelFileVersion = 1
+)
+
+type LevelFile struct {
+	Format  string      `json:"format"`
+	Version int         `json:"version"`
+	Track   string      `json:"track"`
+	Levels  []LevelSpec `json:"levels"`
+}
+
+type LevelSpec struct {
+	Number       int         `json:"number"`
+	Answer       string      `json:"answer"`
+	AnswerSpec   *AnswerSpec `json:"answer_spec,omitempty"`
+	Markup       string      `json:"markup"`
+	SourceHint   string      `json:"source_hint,omitempty"`
+	Walkthrough  []string    `json:"walkthrough,omitempty"`
+	LeadsEnabled bool        `json:"leads_enabled"`
+	Hints        []HintSpec  `json:"hints,omitempty"`
+}
+
+// HintSpec is a hint as written in a level file. ID must stay the same
+// across edits so the hint is updated rather than replaced. Time orders
+// the hints and defaults to the time of the sync.
+type HintSpec struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	Author  string `json:"author,omitempty"`
+	Time    int64  `json:"time,omitempty"`
+}
+
+// LevelFileErrors lists everything wrong with a level file at once, so an
+// author can fix it in one pass.
+type LevelFileErrors []string
+
+func (e LevelFileErrors) Error() string {
+	return "invalid level file: " + strings.Join(e, "; ")
+}
+
+var hintIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ParseLevelFile decodes and validates a level file.
+func ParseLevelFile(r io.Reader) (*LevelFile, error) {
+	var lf LevelFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&lf); err != nil {
+		return nil, LevelFileErrors{err.Error()}
+	}
+	if err := lf.Validate(); err != nil {
+		return nil, err
+	}
+	return &lf, nil
+}
+
+func (lf *LevelFile) Validate() error {
+	var errs LevelFileErrors
+	if lf.Format != LevelFileFormat {
+		errs = append(errs, fmt.Sprintf("format must be %q", LevelFileFormat))
+	}
+	if lf.Version < 1 || lf.Version > LevelFileVersion {
+		errs = append(errs, fmt.Sprintf("unsupported version %d", lf.Version))
+	}
+	if !isValidLevelID(lf.Track + "-0") {
+		errs = append(errs, fmt.Sprintf("unknown track %q", lf.Track))
+	}
+	seen := map[int]bool{}
+	for i, l := range lf.Levels {
+		at := fmt.Sprintf("levels[%d]", i)
+		if l.Number < 0 {
+			errs = append(errs, at+": number must not be negative")
+		} else if seen[l.Number] {
+			errs = append(errs, fmt.Sprintf("%s: level %d appears twice", at, l.Number))
+		}
+		seen[l.Number] = true
+		if strings.TrimSpace(l.Answer) == "" {
+			errs = append(errs, at+": missing answer")
+		}
+		if strings.TrimSpace(l.Markup) == "" {
+			errs = append(errs, at+": missing markup")
+		}
+		if err := l.AnswerSpec.Validate(); err != nil {
+			errs = append(errs, at+".answer_spec: "+err.Error())
+		}
+		for j, c := range l.Walkthrough {
+			if strings.TrimSpace(c) == "" {
+				errs = append(errs, fmt.Sprintf("%s.walkthrough[%d]: empty checkpoint", at, j))
+			}
+		}
+		hints := map[string]bool{}
+		for j, h := range l.Hints {
+			hat := fmt.Sprintf("%s.hints[%d]", at, j)
+			if !hintIDPattern.MatchString(h.ID) {
+				errs = append(errs, hat+": id must be letters, digits, '.', '_' or '-'")
+			} else if hints[h.ID] {
+				errs = append(errs, fmt.Sprintf("%s: hint %q appears twice", hat, h.ID))
+			}
+			hints[h.ID] = true
+			if strings.TrimSpace(h.Content) == "" {
+				errs = append(errs, hat+": missing content")
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (l LevelSpec) level(track string) Level {
+	lvl := Level{ID: fmt.Sprintf("%s-%d", track, l.Number), Answer: l.Answer, Markup: l.Markup, SourceHint: l.SourceHint, LeadsEnabled: l.LeadsEnabled}
+	if len(l.Walkthrough) > 0 {
+		b, _ := json.Marshal(l.Walkthrough)
+		lvl.Walkthrough = string(b)
+	}
+	if !l.AnswerSpec.isZero() {
+		lvl.Answers = l.AnswerSpec
+	}
+	return lvl
+}
+
+// walkthroughCheckpoints reads a stored walkthrough, which is a JSON array
+// of checkpoints or, for levels set by hand, plain text.
+func walkthroughCheckpoints(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var arr []string
+	if json.Unmarshal([]byte(s), &arr) == nil {
+		return arr
+	}
+	return []string{s}
+}
+
+// LevelChange is what a sync does to one level. Action is create, update,
+// delete or unchanged; Fields names what an update changes.
+type LevelChange struct {
+	Level  string       `json:"level"`
+	Action string       `json:"action"`
+	Fields []string     `json:"fields,omitempty"`
+	Hints  []HintChange `json:"hints,omitempty"`
+}
+
+type HintChange struct {
+	ID     string   `json:"id"`
+	Action string   `json:"action"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+type LevelSyncOptions struct {
+	// Prune deletes levels and hints of the track that the file leaves out.
+	Prune  bool
+	DryRun bool
+}
+
+type LevelSyncResult struct {
+	Track   string        `json:"track"`
+	DryRun  bool          `json:"dry_run"`
+	Changes []LevelChange `json:"changes"`
+}
+
+var ErrLevelGap = errors.New("levels would not be numbered consecutively from 0")
+
+type storedLevels struct {
+	levels map[string]Level
+	hints  map[string]map[string]HintEntry
+}
+
+func loadTrack(q dbpkg.Queryer, track string) (*storedLevels, error) {
+	out := &storedLevels{levels: map[string]Level{}, hints: map[string]map[string]HintEntry{}}
+	rows, err := q.Query(`SELECT id, data FROM levels WHERE substr(id, 1, length(?) + 1) = ? || '-'`, track, track)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		var data sql.NullString
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var lvl Level
+		if !strings.HasPrefix(id, track+"-") || !isValidLevelID(id) || json.Unmarshal([]byte(data.String), &lvl) != nil {
+			continue
+		}
+		lvl.ID = id
+		plain, err := lvl.unsealed()
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		out.levels[id] = *plain
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = q.Query(`SELECT level_id, hint_id, data, created_at FROM hints WHERE substr(level_id, 1, length(?) + 1) = ? || '-'`, track, track)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var levelID, hintID string
+		var data sql.NullString
+		var createdAt sql.NullInt64
+		if err := rows.Scan(&levelID, &hintID, &data, &createdAt); err != nil {
+			return nil, err
+		}
+		var he HintEntry
+		if json.Unmarshal([]byte(data.String), &he) != nil {
+			he = HintEntry{Content: data.String, Time: float64(createdAt.Int64)}
+		}
+		he.ID = hintID
+		if out.hints[levelID] == nil {
+			out.hints[levelID] = map[string]HintEntry{}
+		}
+		out.hints[levelID][hintID] = he
+	}
+	return out, rows.Err()
+}
+
+func levelFields(old, new Level) []string {
+	var f []string
+	if old.Answer != new.Answer {
+		f = append(f, "answer")
+	}
+	if a, b := answerSpecJSON(old.Answers), answerSpecJSON(new.Answers); a != b {
+		f = append(f, "answer_spec")
+	}
+	if old.Markup != new.Markup {
+		f = append(f, "markup")
+	}
+	if old.SourceHint != new.SourceHint {
+		f = append(f, "source_hint")
+	}
+	if strings.Join(walkthroughCheckpoints(old.Walkthrough), "\x00") != strings.Join(walkthroughCheckpoints(new.Walkthrough), "\x00") {
+		f = append(f, "walkthrough")
+	}
+	if old.LeadsEnabled != new.LeadsEnabled {
+		f = append(f, "leads_enabled")
+	}
+	return f
+}
+
+func answerSpecJSON(s *AnswerSpec) string {
+	if s.isZero() {
+		return ""
+	}
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func hintFields(old HintEntry, h HintSpec) []string {
+	var f []string
+	if old.Content != h.Content {
+		f = append(f, "content")
+	}
+	if h.Author != "" && old.Author != h.Author {
+		f = append(f, "author")
+	}
+	if h.Time != 0 && int64(old.Time) != h.Time {
+		f = append(f, "time")
+	}
+	return f
+}
+
+// SyncLevelFile makes the track in the database match lf in one
+// transaction and reports what changed. A dry run reports the same changes
+// and writes nothing.
+func SyncLevelFile(dbConn dbpkg.Store, lf *LevelFile, opts LevelSyncOptions) (*LevelSyncResult, error) {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := syncLevelFile(tx, lf, opts)
+	if err != nil || opts.DryRun {
+		tx.Rollback()
+		return res, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func syncLevelFile(tx *dbpkg.Tx, lf *LevelFile, opts LevelSyncOptions) (*LevelSyncResult, error) {
+	stored, err := loadTrack(tx, lf.Track)
+	if err != nil {
+		return nil, err
+	}
+	res := &LevelSyncResult{Track: lf.Track, DryRun: opts.DryRun, Changes: []LevelChange{}}
+	now := time.Now().Unix()
+	keep := map[string]bool{}
+	specs := append([]LevelSpec(nil), lf.Levels...)
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Number < specs[j].Number })
+	for _, spec := range specs {
+		lvl := spec.level(lf.Track)
+		keep[lvl.ID] = true
+		ch := LevelChange{Level: lvl.ID, Action: "unchanged"}
+		if old, ok := stored.levels[lvl.ID]; !ok {
+			ch.Action = "create"
+		} else if ch.Fields = levelFields(old, lvl); len(ch.Fields) > 0 {
+			ch.Action = "update"
+		}
+		if ch.Action != "unchanged" {
+			if err := sealAnswers(&lvl, lf.Track); err != nil {
+				return nil, err
+			}
+			b, _ := json.Marshal(lvl)
+			if err := dbpkg.Set(tx, "levels", lvl.ID, string(b)); err != nil {
+				return nil, err
+			}
+		}
+		hints := stored.hints[lvl.ID]
+		inFile := map[string]bool{}
+		for i, h := range spec.Hints {
+			inFile[h.ID] = true
+			hc := HintChange{ID: h.ID, Action: "create"}
+			old, ok := hints[h.ID]
+			if ok {
+				if hc.Fields = hintFields(old, h); len(hc.Fields) == 0 {
+					continue
+				}
+				hc.Action = "update"
+			}
+			ch.Hints = append(ch.Hints, hc)
+			at := h.Time
+			if at == 0 && ok {
+				at = int64(old.Time)
+			}
+			if at == 0 {
+				// keep the file's order among hints synced together
+				at = now + int64(i)
+			}
+			author := h.Author
+			if author == "" {
+				author = "Exun Clan"
+			}
+			b, _ := json.Marshal(HintEntry{Time: float64(at), Content: h.Content, ID: h.ID, Author: author, Type: lf.Track})
+			if _, err := tx.Exec(`INSERT INTO hints(level_id, hint_id, data, created_at) VALUES(?,?,?,?) ON CONFLICT(level_id, hint_id) DO UPDATE SET data = excluded.data, created_at = excluded.created_at`, lvl.ID, h.ID, string(b), at); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Prune {
+			for id := range hints {
+				if inFile[id] {
+					continue
+				}
+				ch.Hints = append(ch.Hints, HintChange{ID: id, Action: "delete"})
+				if err := dbpkg.Delete(tx, "hints", lvl.ID+"/"+id); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if ch.Action == "unchanged" && len(ch.Hints) > 0 {
+			ch.Action = "update"
+		}
+		res.Changes = append(res.Changes, ch)
+	}
+	remaining := map[int]bool{}
+	for id := range stored.levels {
+		if keep[id] {
+			continue
+		}
+		if !opts.Prune {
+			remaining[levelNumber(id)] = true
+			continue
+		}
+		res.Changes = append(res.Changes, LevelChange{Level: id, Action: "delete"})
+		if err := dbpkg.Delete(tx, "levels", id); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`DELETE FROM hints WHERE level_id = ?`, id); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range specs {
+		remaining[s.Number] = true
+	}
+	for n := 0; n < len(remaining); n++ {
+		if !remaining[n] {
+			return res, fmt.Errorf("%w: %s-%d is missing", ErrLevelGap, lf.Track, n)
+		}
+	}
+	sort.SliceStable(res.Changes, func(i, j int) bool {
+		return levelNumber(res.Changes[i].Level) < levelNumber(res.Changes[j].Level)
+	})
+	return res, nil
+}
+
+func levelNumber(id string) int {
+	n, _ := strconv.Atoi(id[strings.LastIndex(id, "-")+1:])
+	return n
+}
+
+// ExportLevelFile writes track as a level file.
+func ExportLevelFile(dbConn dbpkg.Store, track string) (*LevelFile, error) {
+	if !isValidLevelID(track + "-0") {
+		return nil, fmt.Errorf("unknown track %q", track)
+	}
+	stored, err := loadTrack(dbConn, track)
+	if err != nil {
+		return nil, err
+	}
+	lf := &LevelFile{Format: LevelFileFormat, Version: LevelFileVersion, Track: track, Levels: []LevelSpec{}}
+	for id, lvl := range stored.levels {
+		spec := LevelSpec{Number: levelNumber(id), Answer: lvl.Answer, AnswerSpec: lvl.Answers, Markup: lvl.Markup, SourceHint: lvl.SourceHint, Walkthrough: walkthroughCheckpoints(lvl.Walkthrough), LeadsEnabled: lvl.LeadsEnabled}
+		for _, he := range stored.hints[id] {
+			spec.Hints = append(spec.Hints, HintSpec{ID: he.ID, Content: he.Content, Author: he.Author, Time: int64(he.Time)})
+		}
+		sort.Slice(spec.Hints, func(i, j int) bool {
+			if spec.Hints[i].Time == spec.Hints[j].Time {
+				return spec.Hints[i].ID < spec.Hints[j].ID
+			}
+			return spec.Hints[i].Time < spec.Hints[j].Time
+		})
+		lf.Levels = append(lf.Levels, spec)
+	}
+	sort.Slice(lf.Levels, func(i, j int) bool { return lf.Levels[i].Number < lf.Levels[j].Number })
+	return lf, nil
+}
+
+// WriteLevelFile encodes lf the way it is meant to be kept in git:
+// indented, with markup left readable.
+func WriteLevelFile(w io.Writer, lf *LevelFile) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(lf)
+}
+
+// AdminLevelFileHandler serves /api/admin/levels/file. GET ?track= downloads
+// the track as a level file, answers included, so it needs levels.reveal and
+// is audited. POST uploads one; ?dry_run=1 only reports the changes and
+// ?prune=1 also deletes what the file leaves out.
+func AdminLevelFileHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if !PrincipalFromContext(r.Context()).Can(dbpkg.PermLevelsReveal) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			track := r.URL.Query().Get("track")
+			lf, err := ExportLevelFile(dbConn, track)
+			if err != nil {
+				if !isValidLevelID(track + "-0") {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			audit(dbConn, r, "level.reveal", track, nil, map[string]int{"levels": len(lf.Levels)})
+			noStore(w)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+track+`.levels.json"`)
+			WriteLevelFile(w, lf)
+		case http.MethodPost:
+			r.Body = http.MaxBytesReader(w, r.Body, maxBundleSize)
+			lf, err := ParseLevelFile(r.Body)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid level file", "problems": err})
+				return
+			}
+			q := r.URL.Query()
+			opts := LevelSyncOptions{Prune: queryBool(q.Get("prune")), DryRun: queryBool(q.Get("dry_run"))}
+			res, err := SyncLevelFile(dbConn, lf, opts)
+			if errors.Is(err, ErrLevelGap) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			if !opts.DryRun {
+				audit(dbConn, r, "level.sync", lf.Track, nil, res)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": res})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func queryBool(v string) bool {
+	b, _ := strconv.ParseBool(v)
+	return b
+}
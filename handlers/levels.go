@@ -1,61 +1,119 @@
 package handlers
 
 import (
-	"crypto/sha256"
-	"database/sql"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"net/http"
 	"os"
-	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
 	dbpkg "sudocrypt25/db"
 )
 
+// Level is a level as stored. Once saved its answers are sealed: Answer and
+// the spec's accept and regex are empty, AnswerHashes holds keyed hashes of
+// the accepted answers normalized with AnswerNorm, and SealedAnswers keeps
+// an encrypted copy for authors to reveal.
 type Level struct {
+	ID            string      `json:"id"`
+	Answer        string      `json:"answer,omitempty"`
+	Answers       *AnswerSpec `json:"answer_spec,omitempty"`
+	AnswerHashes  []string    `json:"answer_hashes,omitempty"`
+	AnswerNorm    []string    `json:"answer_norm,omitempty"`
+	SealedAnswers string      `json:"sealed_answers,omitempty"`
+	RegexSealed   bool        `json:"regex_sealed,omitempty"`
+	Markup        string      `json:"markup"`
+	SourceHint    string      `json:"sourcehint"`
+	Walkthrough   string      `json:"walkthrough,omitempty"`
+	LeadsEnabled  bool        `json:"leads_enabled"`
+}
+
+// PlayerLevel is what players are sent of a level.
+type PlayerLevel struct {
 	ID           string `json:"id"`
-	Answer       string `json:"answer"`
 	Markup       string `json:"markup"`
 	SourceHint   string `json:"sourcehint"`
-	PublicHash   string `json:"public_hash,omitempty"`
-	Walkthrough  string `json:"walkthrough,omitempty"`
 	LeadsEnabled bool   `json:"leads_enabled"`
 }
 
-func isValidLevelID(id string) bool {
-	re := regexp.MustCompile(`^(ctf|cryptic)-([0-9]+)$`)
-	return re.MatchString(id)
+func (l *Level) ForPlayer() *PlayerLevel {
+	if l == nil {
+		return nil
+	}
+	return &PlayerLevel{ID: l.ID, Markup: l.Markup, SourceHint: l.SourceHint, LeadsEnabled: l.LeadsEnabled}
 }
 
-func SetLevelHandler(dbConn *sql.DB) http.HandlerFunc {
+var (
+	errDisqualified  = errors.New("disqualified")
+	errSubmitTooFast = errors.New("submitting too fast")
+	errNoLevel       = errors.New("no such level")
+)
+
+func SetLevelHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		q := r.URL.Query()
-		levelid := q.Get("levelid")
-		answer := q.Get("answer")
-		markup := q.Get("markup")
-		source := q.Get("source")
-		if !isValidLevelID(levelid) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			LevelID     string          `json:"levelid"`
+			Answer      string          `json:"answer"`
+			Markup      string          `json:"markup"`
+			Source      string          `json:"source"`
+			Walkthrough string          `json:"walkthrough"`
+			Spec        json.RawMessage `json:"answer_spec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+		levelid := req.LevelID
+		markup := req.Markup
+		source := req.Source
+		typ, _, ok := splitLevelID(levelid)
+		if !ok {
 			http.Error(w, "invalid level id", http.StatusBadRequest)
 			return
 		}
-		walkthrough := q.Get("walkthrough")
-		lvl := Level{ID: levelid, Answer: answer, Markup: markup, SourceHint: source, Walkthrough: walkthrough, PublicHash: ComputePublicHash(answer)}
-		if existing, err := dbpkg.Get(dbConn, "levels", levelid); err == nil {
-			var prev Level
-			if json.Unmarshal([]byte(existing), &prev) == nil {
-				lvl.LeadsEnabled = prev.LeadsEnabled
+		walkthrough := req.Walkthrough
+		lvl := Level{ID: levelid, Markup: markup, SourceHint: source, Walkthrough: walkthrough}
+		var before, plain *Level
+		if prev, err := GetLevel(dbConn, levelid); err == nil {
+			if plain, err = prev.unsealed(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+			lvl.LeadsEnabled = prev.LeadsEnabled
+			before = prev
+		}
+		answer, spec, err := draftAnswers(plain, req.Answer, req.Spec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(answer) == "" {
+			http.Error(w, "answer is required", http.StatusBadRequest)
+			return
+		}
+		lvl.Answer, lvl.Answers = answer, spec
+		if err := sealAnswers(&lvl, typ); err != nil {
+			http.Error(w, "could not seal answers", http.StatusInternalServerError)
+			return
 		}
 		b, _ := json.Marshal(lvl)
 		if err := dbpkg.Set(dbConn, "levels", levelid, string(b)); err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
+		if before == nil {
+			audit(dbConn, r, "level.create", levelid, nil, lvl)
+		} else {
+			audit(dbConn, r, "level.update", levelid, before, lvl)
+		}
 		go func(id string) {
 			_ = id
 		}(levelid)
@@ -64,24 +122,38 @@ func SetLevelHandler(dbConn *sql.DB) http.HandlerFunc {
 	}
 }
 
-func DeleteLevelHandler(dbConn *sql.DB) http.HandlerFunc {
+func DeleteLevelHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		q := r.URL.Query()
-		level := q.Get("level")
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+		level := req.Level
 		if !isValidLevelID(level) {
 			http.Error(w, "invalid level id", http.StatusBadRequest)
 			return
 		}
+		before, _ := GetLevel(dbConn, level)
 		if err := dbpkg.Delete(dbConn, "levels", level); err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
+		if before != nil {
+			audit(dbConn, r, "level.delete", level, before, nil)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]bool{"success": true})
 	}
 }
 
-func GetLevel(dbConn *sql.DB, id string) (*Level, error) {
+func GetLevel(dbConn dbpkg.Store, id string) (*Level, error) {
 	if !isValidLevelID(id) {
 		return nil, fmt.Errorf("invalid id")
 	}
@@ -96,7 +168,7 @@ func GetLevel(dbConn *sql.DB, id string) (*Level, error) {
 	return &lvl, nil
 }
 
-func GetAllLevels(dbConn *sql.DB) (map[string]Level, error) {
+func GetAllLevels(dbConn dbpkg.Store) (map[string]Level, error) {
 	out := map[string]Level{}
 	data, err := dbpkg.GetAll(dbConn, "levels")
 	if err != nil {
@@ -111,7 +183,7 @@ func GetAllLevels(dbConn *sql.DB) (map[string]Level, error) {
 	return out, nil
 }
 
-func GenerateAdminLevelsHTML(dbConn *sql.DB) (string, string, error) {
+func GenerateAdminLevelsHTML(dbConn dbpkg.Store) (string, string, error) {
 	levels, err := GetAllLevels(dbConn)
 	if err != nil {
 		return "", "", err
@@ -127,27 +199,14 @@ func GenerateAdminLevelsHTML(dbConn *sql.DB) (string, string, error) {
 		n   int
 		t   string
 	}
-	var cryptic []kv
-	var ctf []kv
+	byTrack := map[string][]kv{}
 	for id, lvl := range levels {
-		parts := strings.SplitN(id, "-", 2)
-		if len(parts) != 2 {
+		typ, num, ok := splitLevelID(id)
+		if !ok {
 			continue
 		}
-		typ := parts[0]
-		num, err := strconv.Atoi(parts[1])
-		if err != nil {
-			continue
-		}
-		e := kv{id: id, lvl: lvl, n: num, t: typ}
-		if typ == "cryptic" {
-			cryptic = append(cryptic, e)
-		} else if typ == "ctf" {
-			ctf = append(ctf, e)
-		}
+		byTrack[typ] = append(byTrack[typ], kv{id: id, lvl: lvl, n: num, t: typ})
 	}
-	sort.Slice(cryptic, func(i, j int) bool { return cryptic[i].n < cryptic[j].n })
-	sort.Slice(ctf, func(i, j int) bool { return ctf[i].n < ctf[j].n })
 
 	var sb strings.Builder
 	dataMap := map[string]Level{}
@@ -157,25 +216,24 @@ func GenerateAdminLevelsHTML(dbConn *sql.DB) (string, string, error) {
 		s = strings.ReplaceAll(s, "{{end}}", "")
 		s = strings.ReplaceAll(s, "{{.ID}}", item.lvl.ID)
 		s = strings.ReplaceAll(s, "{{.SourceHint}}", item.lvl.SourceHint)
-		s = strings.ReplaceAll(s, "{{.Answer}}", item.lvl.Answer)
+		s = strings.ReplaceAll(s, "{{.Answer}}", answerSummary(&item.lvl))
 		if item.lvl.LeadsEnabled {
 			s = strings.ReplaceAll(s, "</div>", "<div class=\"level-controls\"><button class=\"btn-primary small toggle-leads on\" data-level=\""+item.lvl.ID+"\">On</button></div></div>")
 		} else {
 			s = strings.ReplaceAll(s, "</div>", "<div class=\"level-controls\"><button class=\"btn-primary small toggle-leads off\" data-level=\""+item.lvl.ID+"\">Off</button></div></div>")
 		}
 		sb.WriteString(s)
-		dataMap[item.id] = item.lvl
+		dataMap[item.id] = item.lvl.forAuthors()
 	}
 
-	if len(cryptic) > 0 {
-		sb.WriteString("<h1 class=\"levels-heading\"><span style=\"color: #9722e5\">Cryptic</span> Levels</h1>\n")
-		for _, it := range cryptic {
-			render(it)
+	for _, t := range tracks.List() {
+		list := byTrack[t.ID]
+		if len(list) == 0 {
+			continue
 		}
-	}
-	if len(ctf) > 0 {
-		sb.WriteString("<h1 class=\"levels-heading\"><span style=\"color: #9722e5\">CTF</span> Levels</h1>\n")
-		for _, it := range ctf {
+		sort.Slice(list, func(i, j int) bool { return list[i].n < list[j].n })
+		sb.WriteString("<h1 class=\"levels-heading\"><span style=\"color: #9722e5\">" + html.EscapeString(t.Name) + "</span> Levels</h1>\n")
+		for _, it := range list {
 			render(it)
 		}
 	}
@@ -184,47 +242,36 @@ func GenerateAdminLevelsHTML(dbConn *sql.DB) (string, string, error) {
 	return sb.String(), string(jsb), nil
 }
 
-func ComputePublicHash(answer string) string {
-	salt := os.Getenv("AUTH_SALT")
-	if salt == "" {
-		salt = "public_salt_to_prevent_rainbow_tables"
-	}
-	h := sha256.Sum256([]byte(salt + answer))
-	return hex.EncodeToString(h[:])
-}
-
-func SubmitHandler(dbConn *sql.DB) http.HandlerFunc {
+func SubmitHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		q := r.URL.Query()
-		answer := q.Get("answer")
-		typ := q.Get("type")
-		if typ == "" {
-			typ = "cryptic"
-		}
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		var req struct {
+			Answer string `json:"answer"`
+			Type   string `json:"type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
 			return
 		}
+		answer := req.Answer
+		typ := req.Type
+		if typ == "" {
+			typ = DefaultTrack()
+		}
+		p := PrincipalFromContext(r.Context())
+		email := p.Email
 
-		acctRaw, err := dbpkg.Get(dbConn, "accounts", email)
-		var acct map[string]interface{}
-		if err == nil {
-			json.Unmarshal([]byte(acctRaw), &acct)
-		} else {
-			acct = map[string]interface{}{"levels": map[string]float64{"cryptic": 0, "ctf": 0}}
+		if _, err := dbpkg.GetAccount(dbConn, email); err != nil {
+			http.Error(w, "no account", http.StatusUnauthorized)
+			return
 		}
-		now := time.Now().Unix()
-		if dq, ok := acct["disqualified"].(bool); ok && dq {
-			http.Error(w, "disqualified", http.StatusForbidden)
+		if refuseSanctioned(w, dbConn, email, dbpkg.SanctionDisqualified, dbpkg.SanctionSuspended) {
 			return
 		}
-		if admin, _ := acct["admin"].(bool); !admin {
+		if !p.Can(dbpkg.PermLevelsPlaytest) {
 			phase := EventPhase()
 			if phase == -1 {
 				w.Header().Set("Content-Type", "application/json")
@@ -238,109 +285,91 @@ func SubmitHandler(dbConn *sql.DB) http.HandlerFunc {
 				json.NewEncoder(w).Encode(map[string]string{"error": "The event has concluded", "when": "after"})
 				return
 			}
-		}
-		if last, ok := acct["last_submit"].(float64); ok {
-			if now-int64(last) < 1 {
-				json.NewEncoder(w).Encode(map[string]bool{"success": false})
+			if !TrackEnabled(typ) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"error": "This track is currently closed", "when": "closed"})
 				return
 			}
 		}
 
-		levelsMap := map[string]float64{}
-		if lm, ok := acct["levels"].(map[string]interface{}); ok {
-			for k, v := range lm {
-				if vf, ok := v.(float64); ok {
-					levelsMap[k] = vf
-				}
+		now := time.Now().Unix()
+		trimmed := strings.TrimSpace(answer)
+		var correct, near bool
+		var reason string
+		var curr int
+		err := dbpkg.UpdateAccount(dbConn, email, func(tx *dbpkg.Tx, acct *dbpkg.Account) error {
+			if acct.Disqualified {
+				return errDisqualified
+			}
+			if now-acct.LastSubmitAt < 1 {
+				return errSubmitTooFast
+			}
+			curr = acct.Level(typ)
+			levelID := fmt.Sprintf("%s-%d", typ, curr)
+			lvl, err := GetLevel(dbConn, levelID)
+			if err != nil {
+				return errNoLevel
 			}
-		}
-		curr := int(levelsMap[typ])
-		levelID := fmt.Sprintf("%s-%d", typ, curr)
-		lvl, err := GetLevel(dbConn, levelID)
-		if err != nil {
-			json.NewEncoder(w).Encode(map[string]bool{"success": false})
-			return
-		}
-
-		correctAns := strings.TrimSpace(lvl.Answer)
-		submittedAns := strings.TrimSpace(answer)
-		if typ == "cryptic" {
-			correctAns = strings.ToLower(correctAns)
-			submittedAns = strings.ToLower(submittedAns)
-		}
-		correct := correctAns == submittedAns
-		if correct {
-			levelsMap[typ] = float64(curr + 1)
 
-			progMap := map[string][]interface{}{}
-			if pm, ok := acct["progress"].(map[string]interface{}); ok {
-				for k, v := range pm {
-					if arr, ok2 := v.([]interface{}); ok2 && len(arr) >= 2 {
-						progMap[k] = []interface{}{arr[0], arr[1]}
-					}
+			check := lvl.CheckAnswer(typ, trimmed)
+			correct, near, reason = check.Correct, check.Close, check.Reason
+			if !correct {
+				acct.LastSubmitAt = now
+				if err := dbpkg.Set(tx, "logs", email, fmt.Sprintf("submit|%s|%s|incorrect", typ, trimmed)); err != nil {
+					return err
 				}
-			} else if p, ok := acct["progress"].([]interface{}); ok && len(p) >= 2 {
-				progMap["cryptic"] = []interface{}{p[0], p[1]}
+				if !check.Close {
+					return nil
+				}
+				// kept apart so the common near misses per level can be counted;
+				// the pattern, not the guess, which may be one typo off the answer
+				return dbpkg.Set(tx, "logs", email, fmt.Sprintf("close|%s|%s", levelID, check.Pattern))
 			}
-			progMap[typ] = []interface{}{fmt.Sprintf("%s-%d", typ, curr+1), float64(0)}
-			acct["progress"] = progMap
-
-			acct["levels"] = levelsMap
-			b, _ := json.Marshal(acct)
-			dbpkg.Set(dbConn, "accounts", email, string(b))
-
-			total := 0
-			if v, ok := levelsMap["cryptic"]; ok {
-				total += int(v)
+			if err := dbpkg.RecordSolve(tx, acct, typ, levelID, now); err != nil {
+				return err
 			}
-			if v, ok := levelsMap["ctf"]; ok {
-				total += int(v)
+			if err := dbpkg.Delete(tx, "messages/"+email, typ); err != nil {
+				return err
 			}
-			name := email
-			if n, ok := acct["name"].(string); ok && n != "" {
-				name = n
+			// the level, never the answer
+			return dbpkg.Set(tx, "logs", email, fmt.Sprintf("submit|%s|%s|correct", typ, levelID))
+		})
+		switch err {
+		case nil:
+		case errDisqualified:
+			if !refuseSanctioned(w, dbConn, email, dbpkg.SanctionDisqualified) {
+				http.Error(w, "disqualified", http.StatusForbidden)
 			}
-			lb := map[string]interface{}{"email": email, "name": name, "points": total, "time": float64(now)}
-			lbB, _ := json.Marshal(lb)
-			dbpkg.Set(dbConn, "leaderboard", email, string(lbB))
-
-			dbpkg.Delete(dbConn, "messages/"+email, typ)
-
-			lval := fmt.Sprintf("submit|%s|%s|correct", typ, strings.TrimSpace(answer))
-			dbpkg.Set(dbConn, "logs", email, lval)
-
-			nextCurr := curr + 1
-			nextLevelID := fmt.Sprintf("%s-%d", typ, nextCurr)
-			nextLvl, _ := GetLevel(dbConn, nextLevelID)
-			if nextLvl != nil {
-				nextLvl.Answer = ""
+			return
+		case errSubmitTooFast, errNoLevel, dbpkg.ErrAlreadySolved:
+			json.NewEncoder(w).Encode(map[string]bool{"success": false})
+			return
+		default:
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !correct {
+			resp := map[string]interface{}{"success": false}
+			if reason != "" {
+				resp["message"] = reason
+			}
+			if near {
+				resp["close"] = true
 			}
-			resp := map[string]interface{}{"success": true, "next_level": nextLvl}
 			json.NewEncoder(w).Encode(resp)
 			return
 		}
-		acct["last_submit"] = float64(now)
-		b, _ := json.Marshal(acct)
-		dbpkg.Set(dbConn, "accounts", email, string(b))
 
-		lval := fmt.Sprintf("submit|%s|%s|incorrect", typ, strings.TrimSpace(answer))
-		dbpkg.Set(dbConn, "logs", email, lval)
-		json.NewEncoder(w).Encode(map[string]bool{"success": false})
+		nextLevelID := fmt.Sprintf("%s-%d", typ, curr+1)
+		nextLvl, _ := GetLevel(dbConn, nextLevelID)
+		resp := map[string]interface{}{"success": true, "next_level": nextLvl.ForPlayer()}
+		json.NewEncoder(w).Encode(resp)
 	}
 }
 
-func AdminLevelLeadsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func AdminLevelLeadsHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" || admins == nil || !admins.IsAdmin(email) {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -386,12 +415,14 @@ func AdminLevelLeadsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			was := lvl.LeadsEnabled
 			lvl.LeadsEnabled = enabled
 			b, _ := json.Marshal(lvl)
 			if err := dbpkg.Set(dbConn, "levels", lvlID, string(b)); err != nil {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			audit(dbConn, r, "level.leads", lvlID, map[string]bool{"leads_enabled": was}, map[string]bool{"leads_enabled": enabled})
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
@@ -401,11 +432,19 @@ func AdminLevelLeadsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			before := map[string]bool{}
+			after := map[string]bool{}
 			for id, lvl := range levels {
+				before[id] = lvl.LeadsEnabled
 				lvl.LeadsEnabled = enabled
 				b, _ := json.Marshal(lvl)
-				_ = dbpkg.Set(dbConn, "levels", id, string(b))
+				if dbpkg.Set(dbConn, "levels", id, string(b)) == nil {
+					after[id] = enabled
+				} else {
+					after[id] = before[id]
+				}
 			}
+			audit(dbConn, r, "level.leads", "*", before, after)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
@@ -416,16 +455,22 @@ func AdminLevelLeadsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 	}
 }
 
-func LevelsListHandler(dbConn *sql.DB) http.HandlerFunc {
+func LevelsListHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		levels, err := GetAllLevels(dbConn)
 		if err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
+		visible := map[string]bool{}
+		for _, t := range VisibleTracks(PrincipalFromContext(r.Context())) {
+			visible[t.ID] = true
+		}
 		ids := make([]string, 0, len(levels))
 		for id := range levels {
-			ids = append(ids, id)
+			if typ, _, ok := splitLevelID(id); ok && visible[typ] {
+				ids = append(ids, id)
+			}
 		}
 		sort.Strings(ids)
 		w.Header().Set("Content-Type", "application/json")
@@ -433,53 +478,34 @@ func LevelsListHandler(dbConn *sql.DB) http.HandlerFunc {
 	}
 }
 
-func CurrentLevelHandler(dbConn *sql.DB) http.HandlerFunc {
+func CurrentLevelHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
+		p := PrincipalFromContext(r.Context())
 
-		acctRaw, err := dbpkg.Get(dbConn, "accounts", email)
-		var acct map[string]interface{}
-		if err == nil {
-			json.Unmarshal([]byte(acctRaw), &acct)
-		} else {
-			acct = map[string]interface{}{"levels": map[string]float64{"cryptic": 0, "ctf": 0}}
-		}
+		acct, _ := dbpkg.GetAccount(dbConn, p.Email)
 
 		typ := r.URL.Query().Get("type")
 		if typ == "" {
-			typ = "cryptic"
+			typ = DefaultTrack()
 		}
 
-		levelsMap := map[string]float64{}
-		if lm, ok := acct["levels"].(map[string]interface{}); ok {
-			for k, v := range lm {
-				if vf, ok := v.(float64); ok {
-					levelsMap[k] = vf
-				}
-			}
+		if !TrackEnabled(typ) && !p.Can(dbpkg.PermLevelsPlaytest) {
+			placeholder := &PlayerLevel{Markup: "<p>This track is currently closed.</p>"}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(placeholder)
+			return
 		}
-		curr := int(levelsMap[typ])
+
+		curr := acct.Level(typ)
 		levelID := fmt.Sprintf("%s-%d", typ, curr)
 		lvl, err := GetLevel(dbConn, levelID)
 		if err != nil {
-			placeholder := &Level{ID: "", Markup: "<p>No further are levels available currently. Thank you for playing!.</p>", LeadsEnabled: false}
-			placeholder.Answer = ""
+			placeholder := &PlayerLevel{Markup: "<p>No further are levels available currently. Thank you for playing!.</p>"}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(placeholder)
 			return
 		}
-		lvl.Answer = ""
-		lvl.Walkthrough = ""
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(lvl)
+		json.NewEncoder(w).Encode(lvl.ForPlayer())
 	}
 }
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sync"
+	"time"
+
+	"sudocrypt25/db"
+)
+
+// attemptLimiter counts consecutive failures per key. The first Free
+// failures cost nothing; after that each failure doubles the wait before
+// the next attempt, starting at Base and capped at Max. When LockAfter is
+// set, reaching that many failures locks the key for LockFor instead. Keys
+// with no failure for Forget are dropped.
+type attemptLimiter struct {
+	mu        sync.Mutex
+	Now       func() time.Time
+	Free      int
+	Base      time.Duration
+	Max       time.Duration
+	LockAfter int
+	LockFor   time.Duration
+	Forget    time.Duration
+	keys      map[string]*attemptState
+}
+
+type attemptState struct {
+	failures int
+	last     time.Time
+	retryAt  time.Time
+	locked   bool
+}
+
+// Wait reports how long key must wait before its next attempt and whether
+// that wait is a lockout.
+func (l *attemptLimiter) Wait(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.keys[key]
+	if !ok {
+		return 0, false
+	}
+	now := l.Now()
+	if wait := st.retryAt.Sub(now); wait > 0 {
+		return wait, st.locked
+	}
+	if st.locked || now.Sub(st.last) > l.Forget {
+		delete(l.keys, key)
+	}
+	return 0, false
+}
+
+// Fail records a failure for key and reports whether it caused a lockout.
+func (l *attemptLimiter) Fail(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Now()
+	st, ok := l.keys[key]
+	if !ok || now.Sub(st.last) > l.Forget {
+		st = &attemptState{}
+		l.keys[key] = st
+	}
+	st.failures++
+	st.last = now
+	if l.LockAfter > 0 && st.failures >= l.LockAfter {
+		st.locked = true
+		st.retryAt = now.Add(l.LockFor)
+		return true
+	}
+	if n := st.failures - l.Free; n > 0 {
+		wait := l.Max
+		if n < 32 && l.Base<<uint(n-1) < l.Max {
+			wait = l.Base << uint(n-1)
+		}
+		st.retryAt = now.Add(wait)
+	}
+	return false
+}
+
+func (l *attemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	delete(l.keys, key)
+	l.mu.Unlock()
+}
+
+func (l *attemptLimiter) Prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Now()
+	for k, st := range l.keys {
+		if now.After(st.retryAt) && now.Sub(st.last) > l.Forget {
+			delete(l.keys, k)
+		}
+	}
+}
+
+// loginLimits throttles password logins per client IP and per email. Only
+// emails are locked out: many players share a school network, so an IP
+// only ever slows down. LOGIN_LOCKOUT_THRESHOLD and LOGIN_LOCKOUT_DURATION
+// tune the email lockout.
+var loginLimits struct {
+	ip    *attemptLimiter
+	email *attemptLimiter
+}
+
+func initLoginLimits() {
+	loginLimits.ip = &attemptLimiter{Now: time.Now, Free: 20, Base: time.Second, Max: time.Minute, Forget: 15 * time.Minute, keys: map[string]*attemptState{}}
+	loginLimits.email = &attemptLimiter{
+		Now:       time.Now,
+		Free:      3,
+		Base:      time.Second,
+		Max:       5 * time.Minute,
+		LockAfter: int(envUint("LOGIN_LOCKOUT_THRESHOLD", 10)),
+		LockFor:   envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		Forget:    time.Hour,
+		keys:      map[string]*attemptState{},
+	}
+}
+
+// loginWait is how long a login for email from ip has to wait.
+func loginWait(ip, email string) (time.Duration, bool) {
+	wait, locked := loginLimits.email.Wait(email)
+	if w, _ := loginLimits.ip.Wait(ip); w > wait {
+		wait = w
+	}
+	return wait, locked
+}
+
+// loginFailed records a bad password or second factor. On lockout the
+// event is logged and the account owner, if there is one, is told by email.
+func loginFailed(dbConn db.Store, r *http.Request, email string) {
+	ip := clientIP(r)
+	loginLimits.ip.Fail(ip)
+	if !loginLimits.email.Fail(email) {
+		return
+	}
+	db.Set(dbConn, "logs", email, "auth|lockout|ip="+ip)
+	acct, err := db.GetAccount(dbConn, email)
+	if err != nil {
+		return
+	}
+	mins := int(loginLimits.email.LockFor.Minutes())
+	link := html.EscapeString(publicURL(r) + "/auth")
+	body := fmt.Sprintf(`<p>Hi %s,</p><p>There were %d failed sign-in attempts on your Sudocrypt account, the last from %s. Sign-in is paused for %d minutes.</p><p>If this was not you, consider resetting your password: <a href="%s">%s</a></p>`,
+		html.EscapeString(acct.DisplayName()), loginLimits.email.LockAfter, html.EscapeString(ip), mins, link, link)
+	go SendMail(acct.Email, "Sudocrypt sign-in locked", body)
+}
+
+func loginSucceeded(email string) {
+	loginLimits.email.Reset(email)
+}
+
+// unlockLogin lifts a lockout early.
+func unlockLogin(dbConn db.Store, email, by string) error {
+	loginLimits.email.Reset(email)
+	return db.Set(dbConn, "logs", email, "auth|unlock|by="+by)
+}
@@ -1,68 +1,120 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
-	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	dbpkg "sudocrypt25/db"
 )
 
-type LogEntry struct {
-	ID        int    `json:"id"`
-	Namespace string `json:"namespace"`
-	Key       string `json:"key"`
-	Event     string `json:"event"`
-	Data      string `json:"data"`
-	CreatedAt int64  `json:"created_at"`
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+func parseLogTime(s string) (int64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, true
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), true
+	}
+	return 0, false
 }
 
-func LogsHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+// LogsHandler serves GET /api/logs. Filters: user, namespace, event,
+// since/until (unix seconds or RFC 3339), cursor, limit and order=desc.
+// format=ndjson streams every match as one JSON object per line.
+func LogsHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		p := PrincipalFromContext(r.Context())
+		requester := strings.ToLower(strings.TrimSpace(p.Email))
+
+		q := r.URL.Query()
+		f := dbpkg.LogFilter{
+			User:      strings.ToLower(strings.TrimSpace(q.Get("user"))),
+			Namespace: strings.TrimSpace(q.Get("namespace")),
+			Event:     strings.TrimSpace(q.Get("event")),
+			Desc:      strings.EqualFold(q.Get("order"), "desc"),
+		}
+
+		if !p.Can(dbpkg.PermLogsRead) {
+			if f.User != "" && f.User != requester {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			f.User = requester
+		}
+
+		var ok bool
+		var err error
+		if f.Since, ok = parseLogTime(q.Get("since")); !ok {
+			http.Error(w, "invalid since", http.StatusBadRequest)
 			return
 		}
-		requester, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || requester == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		if f.Until, ok = parseLogTime(q.Get("until")); !ok {
+			http.Error(w, "invalid until", http.StatusBadRequest)
 			return
 		}
-		requester = strings.ToLower(strings.TrimSpace(requester))
-
-		q := r.URL.Query()
-		user := strings.ToLower(strings.TrimSpace(q.Get("user")))
-		ns := strings.TrimSpace(q.Get("namespace"))
+		if v := q.Get("cursor"); v != "" {
+			f.Cursor, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || f.Cursor < 0 {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			f.Limit, err = strconv.Atoi(v)
+			if err != nil || f.Limit < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
 
-		isAdmin := admins != nil && admins.IsAdmin(requester)
-		if user != "" && user != requester && !isAdmin {
-			http.Error(w, "forbidden", http.StatusForbidden)
+		if q.Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			enc := json.NewEncoder(w)
+			flusher, _ := w.(http.Flusher)
+			n := 0
+			err := dbpkg.StreamLogs(dbConn, f, func(e dbpkg.LogEntry) error {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+				n++
+				if flusher != nil && n%500 == 0 {
+					flusher.Flush()
+				}
+				return nil
+			})
+			if err != nil && n == 0 {
+				http.Error(w, "db error", http.StatusInternalServerError)
+			}
 			return
 		}
 
-		all, err := dbpkg.GetAll(dbConn, "logs")
+		if f.Limit == 0 {
+			f.Limit = defaultLogLimit
+		}
+		if f.Limit > maxLogLimit {
+			f.Limit = maxLogLimit
+		}
+		entries, err := dbpkg.QueryLogs(dbConn, f)
 		if err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
-		out := []LogEntry{}
-		for _, v := range all {
-			var e LogEntry
-			if err := json.Unmarshal([]byte(v), &e); err == nil {
-				if user != "" && strings.ToLower(e.Key) != user {
-					continue
-				}
-				if ns != "" && e.Namespace != ns {
-					continue
-				}
-				out = append(out, e)
-			}
+		next := ""
+		if len(entries) == f.Limit {
+			next = strconv.FormatInt(entries[len(entries)-1].ID, 10)
 		}
-		sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt < out[j].CreatedAt })
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(out)
+		json.NewEncoder(w).Encode(map[string]interface{}{"logs": entries, "next_cursor": next})
 	}
 }
@@ -1,37 +1,35 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
 
 	dbpkg "sudocrypt25/db"
 )
 
-func MeHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func MeHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		acctRaw, _ := dbpkg.Get(dbConn, "accounts", email)
-		var acct map[string]interface{}
-		if acctRaw != "" {
-			json.Unmarshal([]byte(acctRaw), &acct)
-		}
+		p := PrincipalFromContext(r.Context())
+		email := p.Email
+		acct, _ := dbpkg.GetAccount(dbConn, email)
 		name := ""
-		if n, ok := acct["name"].(string); ok {
-			name = n
+		if acct != nil {
+			name = acct.Name
 		}
-		isAdmin := false
-		if admins != nil && admins.IsAdmin(email) {
-			isAdmin = true
+		// shadow-hiding is left out on purpose
+		restrictions := []map[string]interface{}{}
+		if active, err := dbpkg.GetSanctions(dbConn, email); err == nil {
+			for _, k := range []string{dbpkg.SanctionDisqualified, dbpkg.SanctionSuspended, dbpkg.SanctionMuted} {
+				if s, ok := active[k]; ok {
+					restrictions = append(restrictions, map[string]interface{}{"kind": k, "message": sanctionMessage(s), "until": s.ExpiresAt})
+				}
+			}
 		}
-		if adm, _ := acct["admin"].(bool); adm {
-			isAdmin = true
+		resp := map[string]interface{}{"email": email, "name": name, "admin": p.IsStaff(), "roles": p.Roles, "permissions": p.Permissions, "restrictions": restrictions}
+		if p.Impersonator != nil {
+			resp["viewed_by"] = p.Impersonator.Email
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"email": email, "name": name, "admin": isAdmin})
+		json.NewEncoder(w).Encode(resp)
 	}
 }
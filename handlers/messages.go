@@ -26,7 +26,7 @@ type Message struct {
 	Read      int64  `json:"read"`
 }
 
-func SendMessageHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func SendMessageHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -46,12 +46,9 @@ func SendMessageHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			}
 		}
 
-		from, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || from == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		isAdmin := admins != nil && admins.IsAdmin(from)
+		p := PrincipalFromContext(r.Context())
+		from := p.Email
+		isAdmin := p.Can(dbpkg.PermMessagesReply)
 		displayFrom := from
 		to := strings.TrimSpace(payload["to"])
 		toLower := strings.ToLower(to)
@@ -64,6 +61,9 @@ func SendMessageHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			return
 		}
 		if !isAdmin {
+			if refuseSanctioned(w, dbConn, from, dbpkg.SanctionSuspended, dbpkg.SanctionMuted) {
+				return
+			}
 			phase := EventPhase()
 			if phase == -1 {
 				w.Header().Set("Content-Type", "application/json")
@@ -102,18 +102,10 @@ func SendMessageHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 	}
 }
 
-func ListMessagesHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func ListMessagesHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		requesterRaw, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || requesterRaw == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
+		p := PrincipalFromContext(r.Context())
+		requesterRaw := p.Email
 		requester := strings.ToLower(requesterRaw)
 
 		all, err := dbpkg.GetAll(dbConn, "messages")
@@ -124,7 +116,7 @@ func ListMessagesHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 		q := r.URL.Query()
 		userParam := strings.TrimSpace(q.Get("user"))
 		adminMode := false
-		if admins != nil && admins.IsAdmin(requesterRaw) && strings.EqualFold(q.Get("mode"), "admin") {
+		if p.Can(dbpkg.PermMessagesRead) && strings.EqualFold(q.Get("mode"), "admin") {
 			adminMode = true
 		}
 		user := requester
@@ -173,18 +165,8 @@ func ListMessagesHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 		typ := r.URL.Query().Get("type")
 		leadsEnabledForType := true
 		if typ != "" {
-			acctRaw, err := dbpkg.Get(dbConn, "accounts", requesterRaw)
-			curr := 0
-			if err == nil {
-				var acct map[string]interface{}
-				if json.Unmarshal([]byte(acctRaw), &acct) == nil {
-					if lm, ok := acct["levels"].(map[string]interface{}); ok {
-						if v, ok := lm[typ].(float64); ok {
-							curr = int(v)
-						}
-					}
-				}
-			}
+			acct, _ := dbpkg.GetAccount(dbConn, requesterRaw)
+			curr := acct.Level(typ)
 			levelID := fmt.Sprintf("%s-%d", typ, curr)
 			if levelID != "" {
 				levelSet[levelID] = struct{}{}
@@ -278,13 +260,12 @@ func ListMessagesHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				last   string
 				ts     int64
 				unread bool
-				ctf    bool
+				track  string
 			}
 			mmap := map[string]*sumObj{}
 			me := requesterRaw
 			for _, m := range msgs {
-				lvl := strings.TrimSpace(m.LevelID)
-				isCTF := strings.HasPrefix(strings.ToLower(lvl), "ctf")
+				track, _, _ := splitLevelID(strings.TrimSpace(m.LevelID))
 				var other string
 				if strings.EqualFold(m.From, adminAddress) {
 					other = m.To
@@ -303,15 +284,10 @@ func ListMessagesHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 				key := strings.ToLower(other)
 				s, ok := mmap[key]
 				if !ok {
-					s = &sumObj{email: other, name: "", last: m.Content, ts: m.CreatedAt, unread: false, ctf: isCTF}
+					s = &sumObj{email: other, name: "", last: m.Content, ts: m.CreatedAt, unread: false, track: track}
 					// try to get name
-					if acctRaw, err := dbpkg.Get(dbConn, "accounts", key); err == nil {
-						var acct map[string]interface{}
-						if json.Unmarshal([]byte(acctRaw), &acct) == nil {
-							if n, ok := acct["name"].(string); ok && n != "" {
-								s.name = n
-							}
-						}
+					if acct, err := dbpkg.GetAccount(dbConn, key); err == nil {
+						s.name = acct.Name
 					}
 					// unread if incoming to admin and read == 0 and from == other
 					if m.Read == 0 && strings.EqualFold(m.To, adminAddress) && strings.EqualFold(m.From, other) {
@@ -340,7 +316,9 @@ func ListMessagesHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			outSumm := make([]map[string]interface{}, 0, len(keys))
 			for _, k := range keys {
 				s := mmap[k]
-				outSumm = append(outSumm, map[string]interface{}{"email": s.email, "name": s.name, "last": s.last, "ts": s.ts, "unread": s.unread, "ctf": s.ctf})
+				t, _ := lookupTrack(s.track)
+				// ctf feeds the dashboard's separate list for that track
+				outSumm = append(outSumm, map[string]interface{}{"email": s.email, "name": s.name, "last": s.last, "ts": s.ts, "unread": s.unread, "track": s.track, "track_name": t.Name, "ctf": s.track == "ctf"})
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{"checksum": checksum, "announcements_checksum": annChecksum, "summaries": outSumm})
@@ -385,53 +363,28 @@ func ListMessagesHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			}
 
 			fromEmail := strings.ToLower(displayFrom)
-			if acctRaw, err := dbpkg.Get(dbConn, "accounts", fromEmail); err == nil {
-				var acct map[string]interface{}
-				if json.Unmarshal([]byte(acctRaw), &acct) == nil {
-					if n, ok := acct["name"].(string); ok && n != "" {
-						entry["from_name"] = n
-					}
-				}
+			if acct, err := dbpkg.GetAccount(dbConn, fromEmail); err == nil && acct.Name != "" {
+				entry["from_name"] = acct.Name
 			}
 			toEmail := strings.ToLower(m.To)
-			if acctRaw, err := dbpkg.Get(dbConn, "accounts", toEmail); err == nil {
-				var acct map[string]interface{}
-				if json.Unmarshal([]byte(acctRaw), &acct) == nil {
-					if n, ok := acct["name"].(string); ok && n != "" {
-						entry["to_name"] = n
-					}
-				}
+			if acct, err := dbpkg.GetAccount(dbConn, toEmail); err == nil && acct.Name != "" {
+				entry["to_name"] = acct.Name
 			}
 
 			out = append(out, entry)
 		}
-		aiLeadsEnabled := true
-		if v, err := dbpkg.Get(dbConn, "settings", "ai_leads"); err == nil {
-			s := strings.TrimSpace(strings.ToLower(v))
-			if s == "0" || s == "false" || s == "off" {
-				aiLeadsEnabled = false
-			}
-		}
+		aiLeadsEnabled := settings.Bool("ai_leads")
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{"checksum": checksum, "announcements_checksum": annChecksum, "messages": out, "hints": hintsList, "leads_enabled": leadsEnabledForType, "ai_leads": aiLeadsEnabled})
 	}
 }
 
-func MarkMessagesReadHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func MarkMessagesReadHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		requester, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || requester == "" {
-			http.Error(w, "unauthenticated", http.StatusUnauthorized)
-			return
-		}
-		if admins == nil || !admins.IsAdmin(requester) {
-			http.Error(w, "forbidden", http.StatusForbidden)
-			return
-		}
 
 		var payload map[string]interface{}
 		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
@@ -466,9 +419,9 @@ func MarkMessagesReadHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 		var res sql.Result
 		var execErr error
 		if uptoVal > 0 {
-			res, execErr = dbConn.Exec(`UPDATE messages SET read = 1 WHERE json_extract(data, '$.from') = ? AND json_extract(data, '$.to') = ? AND id <= ? AND read = 0`, email, adminInbox, uptoVal)
+			res, execErr = dbConn.Exec(`UPDATE messages SET read = 1 WHERE from_email = ? AND to_email = ? AND id <= ? AND read = 0`, email, adminInbox, uptoVal)
 		} else {
-			res, execErr = dbConn.Exec(`UPDATE messages SET read = 1 WHERE json_extract(data, '$.from') = ? AND json_extract(data, '$.to') = ? AND read = 0`, email, adminInbox)
+			res, execErr = dbConn.Exec(`UPDATE messages SET read = 1 WHERE from_email = ? AND to_email = ? AND read = 0`, email, adminInbox)
 		}
 		if execErr != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
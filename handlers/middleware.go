@@ -2,9 +2,9 @@ package handlers
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"time"
 
@@ -13,114 +13,167 @@ import (
 
 type contextKey string
 
-const userContextKey contextKey = "user"
+const principalContextKey contextKey = "principal"
 
-func AuthMiddleware(dbConn *sql.DB) func(http.Handler) http.Handler {
+// Principal is the signed-in account a request acts for, with the session
+// it came in on and what its roles allow. On a view-as session it is the
+// player being viewed and Impersonator is the staff member behind it.
+type Principal struct {
+	Email        string
+	Session      *dbpkg.Session
+	Roles        []string
+	Permissions  []string
+	Impersonator *Principal
+}
+
+// Actor is who is really making the request: the impersonator when there
+// is one.
+func (p *Principal) Actor() *Principal {
+	if p != nil && p.Impersonator != nil {
+		return p.Impersonator
+	}
+	return p
+}
+
+// Can reports whether the principal's roles grant perm.
+func (p *Principal) Can(perm string) bool {
+	if p == nil {
+		return false
+	}
+	for _, have := range p.Permissions {
+		if have == perm || have == dbpkg.PermAll {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff reports whether the principal holds any role.
+func (p *Principal) IsStaff() bool {
+	return p != nil && len(p.Roles) > 0
+}
+
+// NeedsMFA reports whether the principal is staff who must pass a second
+// factor, because admin.require_2fa is on, and has not. Such a principal
+// holds no permissions until it does.
+func (p *Principal) NeedsMFA() bool {
+	return p.IsStaff() && !p.Session.MFA && settings != nil && settings.Bool("admin.require_2fa")
+}
+
+// PrincipalFromContext returns the principal Authenticate stored, or nil
+// for an anonymous request.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalContextKey).(*Principal)
+	return p
+}
+
+// viewAsWritable are the only paths a view-as session may change anything
+// through: leaving view-as and signing out.
+var viewAsWritable = map[string]bool{"/api/admin/view_as": true, "/logout": true}
+
+// Authenticate resolves the request's session, if it has a live one, and
+// puts its principal in the context. It only rejects writes from a view-as
+// session; pair it with RequireUser or RequireRole for the rest.
+func Authenticate(dbConn dbpkg.Store, admins *Admins) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			c, err := r.Cookie("session_id")
-			if err != nil || c.Value == "" {
-				accept := r.Header.Get("Accept")
-				if strings.Contains(accept, "application/json") {
+			s, err := CurrentSession(dbConn, r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p := &Principal{Email: s.Email, Session: s, Roles: admins.Roles(s.Email), Permissions: []string{}}
+			if !p.NeedsMFA() {
+				p.Permissions = admins.Permissions(s.Email)
+			}
+			if s.ViewAs != "" && p.Can(dbpkg.PermUsersImpersonate) {
+				if r.Method != http.MethodGet && r.Method != http.MethodHead && !viewAsWritable[r.URL.Path] {
 					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusUnauthorized)
-					w.Write([]byte(`{"error":"unauthenticated"}`))
+					w.WriteHeader(http.StatusForbidden)
+					json.NewEncoder(w).Encode(map[string]string{"error": "read-only while viewing as " + s.ViewAs})
 					return
 				}
-				http.Redirect(w, r, "/auth", http.StatusFound)
+				p = &Principal{Email: s.ViewAs, Session: s, Roles: []string{}, Permissions: []string{}, Impersonator: p}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey, p)))
+		})
+	}
+}
+
+// isPage tells browser navigations and form posts, which get redirects,
+// from API calls, which get status codes.
+func isPage(r *http.Request) bool {
+	return !strings.HasPrefix(r.URL.Path, "/api/") && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// RequireUser only lets signed-in requests through.
+func RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if PrincipalFromContext(r.Context()) == nil {
+			if isPage(r) {
+				http.Redirect(w, r, "/auth?toast=1&from="+url.QueryEscape(r.URL.Path), http.StatusFound)
 				return
 			}
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-			sid := c.Value
-			if sid == "" {
-				accept := r.Header.Get("Accept")
-				if strings.Contains(accept, "application/json") {
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusUnauthorized)
-					w.Write([]byte(`{"error":"invalid_session"}`))
+// RequireRole only lets through principals whose roles grant perm. Staff
+// held back by NeedsMFA are told so; pages send them to their profile to
+// enroll.
+func RequireRole(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := PrincipalFromContext(r.Context())
+			if p.NeedsMFA() {
+				if isPage(r) {
+					http.Redirect(w, r, "/profile/"+url.PathEscape(p.Email)+"?toast=2fa", http.StatusFound)
 					return
 				}
-				http.Redirect(w, r, "/auth", http.StatusFound)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication required"})
 				return
 			}
-			email, err := dbpkg.Get(dbConn, "sessions", sid)
-			if err != nil || email == "" {
-				accept := r.Header.Get("Accept")
-				if strings.Contains(accept, "application/json") {
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusUnauthorized)
-					w.Write([]byte(`{"error":"invalid_session"}`))
+			if !p.Can(perm) {
+				if isPage(r) {
+					http.Redirect(w, r, "/timegate?toast=1&from="+url.QueryEscape(r.URL.Path), http.StatusFound)
 					return
 				}
-				http.Redirect(w, r, "/auth", http.StatusFound)
+				http.Error(w, "forbidden", http.StatusForbidden)
 				return
 			}
-			ctx := context.WithValue(r.Context(), userContextKey, map[string]interface{}{"session_id": sid, "email": email})
-			next.ServeHTTP(w, r.WithContext(ctx))
-		})
+			next.ServeHTTP(w, r)
+		}))
 	}
 }
 
-func UserFromContext(ctx context.Context) (map[string]interface{}, bool) {
-	u := ctx.Value(userContextKey)
-	if u == nil {
-		return nil, false
-	}
-	m, ok := u.(map[string]interface{})
-	return m, ok
+var settings *dbpkg.Settings
+
+func Settings() *dbpkg.Settings {
+	return settings
 }
 
 func IsTimeGateOpen() bool {
-	ds := os.Getenv("TIMEGATE_START")
-	if ds == "" {
-		ds = "2025-11-07T09:00:00+05:30"
-	}
-	start, err := time.Parse(time.RFC3339, ds)
-	if err != nil {
-		return true
-	}
-	de := os.Getenv("TIMEGATE_END")
-	var end time.Time
-	var endSet bool
-	if de != "" {
-		if e, err2 := time.Parse(time.RFC3339, de); err2 == nil {
-			end = e
-			endSet = true
-		}
-	}
-	now := time.Now()
-	if now.Before(start) {
-		return false
-	}
-	if endSet && now.After(end) {
-		return false
-	}
-	return true
+	return EventPhase() == 0
 }
 
 func EventPhase() int {
-	ds := os.Getenv("TIMEGATE_START")
-	if ds == "" {
-		ds = "2025-11-07T09:00:00+05:30"
-	}
-	start, err := time.Parse(time.RFC3339, ds)
-	if err != nil {
+	if settings == nil {
 		return 0
 	}
-	de := os.Getenv("TIMEGATE_END")
-	var end time.Time
-	var endSet bool
-	if de != "" {
-		if e, err2 := time.Parse(time.RFC3339, de); err2 == nil {
-			end = e
-			endSet = true
-		}
+	start, ok := settings.Time("timegate_start")
+	if !ok {
+		return 0
 	}
 	now := time.Now()
 	if now.Before(start) {
 		return -1
 	}
-	if endSet && now.After(end) {
+	if end, ok := settings.Time("timegate_end"); ok && now.After(end) {
 		return 1
 	}
 	return 0
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	dbpkg "sudocrypt25/db"
+)
+
+// sanctionActions maps the admin user actions that apply or lift a
+// sanction to its kind.
+var sanctionActions = map[string]struct {
+	kind string
+	lift bool
+}{
+	"disqualify": {dbpkg.SanctionDisqualified, false},
+	"reinstate":  {dbpkg.SanctionDisqualified, true},
+	"suspend":    {dbpkg.SanctionSuspended, false},
+	"unsuspend":  {dbpkg.SanctionSuspended, true},
+	"mute":       {dbpkg.SanctionMuted, false},
+	"unmute":     {dbpkg.SanctionMuted, true},
+	"hide":       {dbpkg.SanctionHidden, false},
+	"unhide":     {dbpkg.SanctionHidden, true},
+}
+
+func sanctionMessage(s dbpkg.Sanction) string {
+	msg := ""
+	switch s.Kind {
+	case dbpkg.SanctionDisqualified:
+		msg = "Your account has been disqualified"
+	case dbpkg.SanctionSuspended:
+		msg = "Your account is suspended until " + time.Unix(s.ExpiresAt, 0).UTC().Format("2 Jan 2006 15:04 MST")
+	case dbpkg.SanctionMuted:
+		msg = "You can no longer send messages to the admins"
+		if s.ExpiresAt > 0 {
+			msg = "You cannot send messages to the admins until " + time.Unix(s.ExpiresAt, 0).UTC().Format("2 Jan 2006 15:04 MST")
+		}
+	}
+	if s.Reason != "" {
+		msg += ": " + s.Reason
+	}
+	return msg
+}
+
+// refuseSanctioned answers 403 and returns true if email is under any of
+// kinds. The body carries a message meant for the player.
+func refuseSanctioned(w http.ResponseWriter, dbConn dbpkg.Store, email string, kinds ...string) bool {
+	active, err := dbpkg.GetSanctions(dbConn, email)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return true
+	}
+	for _, k := range kinds {
+		s, ok := active[k]
+		if !ok {
+			continue
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": sanctionMessage(s), "sanction": s.Kind, "reason": s.Reason, "until": s.ExpiresAt})
+		return true
+	}
+	return false
+}
+
+// applySanction handles the sanction actions of AdminUserActionHandler.
+// payload may carry a reason and, for suspend, mute and hide, an expiry as
+// until (unix seconds or RFC 3339) or duration (e.g. 48h). A suspension
+// must expire.
+func applySanction(w http.ResponseWriter, r *http.Request, dbConn dbpkg.Store, email, action string, payload map[string]string) {
+	sa := sanctionActions[action]
+	before, err := dbpkg.GetSanctions(dbConn, email)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if sa.lift {
+		ok, err := dbpkg.LiftSanction(dbConn, email, sa.kind)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "not "+sa.kind, http.StatusNotFound)
+			return
+		}
+		audit(dbConn, r, "user."+action, email, before[sa.kind], nil)
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	}
+	if _, err := dbpkg.GetAccount(dbConn, email); err != nil {
+		http.Error(w, "no account", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	s := dbpkg.Sanction{Email: email, Kind: sa.kind, Reason: strings.TrimSpace(payload["reason"]), SetBy: PrincipalFromContext(r.Context()).Email, SetAt: now.Unix()}
+	if sa.kind != dbpkg.SanctionDisqualified {
+		if v := payload["duration"]; v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			s.ExpiresAt = now.Add(d).Unix()
+		} else if until, ok := parseLogTime(payload["until"]); !ok {
+			http.Error(w, "invalid until", http.StatusBadRequest)
+			return
+		} else {
+			s.ExpiresAt = until
+		}
+		if s.ExpiresAt != 0 && s.ExpiresAt <= now.Unix() {
+			http.Error(w, "expiry is in the past", http.StatusBadRequest)
+			return
+		}
+	}
+	if sa.kind == dbpkg.SanctionSuspended && s.ExpiresAt == 0 {
+		http.Error(w, "a suspension needs until or duration", http.StatusBadRequest)
+		return
+	}
+	if err := dbpkg.SetSanction(dbConn, s); err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	var prev interface{}
+	if p, ok := before[sa.kind]; ok {
+		prev = p
+	}
+	audit(dbConn, r, "user."+action, email, prev, s)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "sanction": s})
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2Params are read from PASSWORD_ARGON2_MEMORY (KiB),
+// PASSWORD_ARGON2_TIME and PASSWORD_ARGON2_THREADS. Hashes made with other
+// parameters are upgraded on the next successful login.
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func envUint(name string, def uint64) uint64 {
+	if v, err := strconv.ParseUint(os.Getenv(name), 10, 32); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func currentArgon2Params() argon2Params {
+	return argon2Params{
+		memory:  uint32(envUint("PASSWORD_ARGON2_MEMORY", 64*1024)),
+		time:    uint32(envUint("PASSWORD_ARGON2_TIME", 3)),
+		threads: uint8(envUint("PASSWORD_ARGON2_THREADS", 2)),
+	}
+}
+
+const argon2KeyLen = 32
+
+// HashPassword returns an argon2id hash in PHC string format.
+func HashPassword(password string) (string, error) {
+	p := currentArgon2Params()
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks password against a stored argon2id, bcrypt or
+// legacy unsalted SHA-256 hash. rehash is true when the stored hash should
+// be replaced with a fresh HashPassword result.
+func VerifyPassword(stored, password string) (ok bool, rehash bool) {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		var p argon2Params
+		var version int
+		parts := strings.Split(stored, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		want, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil || len(want) == 0 {
+			return false, false
+		}
+		got := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(want)))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			return false, false
+		}
+		return true, p != currentArgon2Params()
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return false, false
+		}
+		return true, true
+	case len(stored) == 64:
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hashHex(password))) != 1 {
+			return false, false
+		}
+		return true, true
+	}
+	return false, false
+}
+
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "12345678": true, "123456789": true,
+	"1234567890": true, "qwertyuiop": true, "qwerty123": true, "iloveyou": true, "11111111": true,
+	"00000000": true, "abcdefgh": true, "abcd1234": true, "letmein1": true, "sudocrypt": true,
+	"sudocrypt25": true, "exunclan": true, "welcome1": true, "admin123": true, "football": true,
+}
+
+type policyError string
+
+func (e policyError) Error() string { return string(e) }
+
+const (
+	errPasswordLong   policyError = "password must be at most 128 characters"
+	errPasswordCommon policyError = "password is too common"
+	errPasswordEmail  policyError = "password must not contain your email"
+)
+
+func isPolicyError(err error) bool {
+	var pe policyError
+	return errors.As(err, &pe)
+}
+
+// CheckPasswordPolicy enforces the signup rules: 8 to 128 characters, not
+// a well-known password, not a single repeated character and not built
+// from the account's email address. PASSWORD_MIN_LENGTH raises the minimum.
+func CheckPasswordPolicy(password, email string) error {
+	n := utf8.RuneCountInString(password)
+	if min := envUint("PASSWORD_MIN_LENGTH", 8); uint64(n) < min {
+		return policyError(fmt.Sprintf("password must be at least %d characters", min))
+	}
+	if n > 128 {
+		return errPasswordLong
+	}
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] || strings.Count(lower, lower[:1]) == len(lower) {
+		return errPasswordCommon
+	}
+	if local, _, ok := strings.Cut(strings.ToLower(email), "@"); ok && len(local) >= 4 && strings.Contains(lower, local) {
+		return errPasswordEmail
+	}
+	return nil
+}
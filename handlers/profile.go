@@ -12,24 +12,14 @@ import (
 	dbpkg "sudocrypt25/db"
 )
 
-func UpdateBioHandler(dbConn *sql.DB) http.HandlerFunc {
+func UpdateBioHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		email, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || email == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+		email := PrincipalFromContext(r.Context()).Email
 
 		var req struct {
 			Bio       string `json:"bio"`
@@ -40,23 +30,11 @@ func UpdateBioHandler(dbConn *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		acctRaw, err := dbpkg.Get(dbConn, "users", email)
-		if err != nil {
-			http.Error(w, "Account not found", http.StatusNotFound)
-			return
-		}
-
-		var acct map[string]interface{}
-		if err := json.Unmarshal([]byte(acctRaw), &acct); err != nil {
-			http.Error(w, "Error loading account", http.StatusInternalServerError)
-			return
-		}
-
-		acct["bio"] = req.Bio
-		acct["bio_public"] = req.BioPublic
-
-		acctBytes, _ := json.Marshal(acct)
-		if err := dbpkg.Set(dbConn, "users", email, string(acctBytes)); err != nil {
+		if err := dbpkg.UpdateBio(dbConn, email, req.Bio, req.BioPublic); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Account not found", http.StatusNotFound)
+				return
+			}
 			http.Error(w, "Failed to update", http.StatusInternalServerError)
 			return
 		}
@@ -69,52 +47,26 @@ func UpdateBioHandler(dbConn *sql.DB) http.HandlerFunc {
 	}
 }
 
-func UserProfileHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func UserProfileHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Redirect(w, r, "/auth?toast=1&from="+r.URL.Path, http.StatusFound)
-			return
-		}
-
+		p := PrincipalFromContext(r.Context())
 		ident := strings.TrimPrefix(r.URL.Path, "/profile/")
 		ident = strings.TrimSpace(ident)
 		email, _ := url.PathUnescape(ident)
 
-		acctRaw, err := dbpkg.Get(dbConn, "users", email)
+		acct, err := dbpkg.GetAccount(dbConn, email)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
 
-		var acct map[string]interface{}
-		if err := json.Unmarshal([]byte(acctRaw), &acct); err != nil {
-			http.Error(w, "Error loading user", http.StatusInternalServerError)
-			return
-		}
+		isOwnProfile := email == p.Email
 
-		currentUserEmail := ""
-		if ce, err := GetEmailFromRequest(dbConn, r); err == nil {
-			currentUserEmail = ce
-		}
-
-		isOwnProfile := email == currentUserEmail
-
-		userBio := ""
-		if bio, ok := acct["bio"].(string); ok {
-			userBio = bio
-		}
-
-		bioPublic := false
-		if bp, ok := acct["bio_public"].(bool); ok {
-			bioPublic = bp
-		}
+		userBio := acct.Bio
+		bioPublic := acct.BioPublic
 
 		showBio := isOwnProfile || bioPublic
-		displayName := ""
-		if n, ok := acct["name"].(string); ok {
-			displayName = n
-		}
+		displayName := acct.Name
 		userImg := ""
 		if displayName != "" {
 			userImg = fmt.Sprintf("https://api.dicebear.com/9.x/big-smile/svg?seed=%s", displayName)
@@ -122,33 +74,21 @@ func UserProfileHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			userImg = fmt.Sprintf("https://api.dicebear.com/9.x/big-smile/svg?seed=%s", email)
 		}
 
-		levelsCryptic := 0.0
-		levelsCTF := 0.0
-		if lv, ok := acct["levels"].(map[string]interface{}); ok {
-			if v, ok2 := lv["cryptic"].(float64); ok2 {
-				levelsCryptic = v
-			}
-			if v, ok2 := lv["ctf"].(float64); ok2 {
-				levelsCTF = v
-			}
+		type trackLevel struct {
+			Name  string
+			Level int
 		}
-
-		viewerIsAdmin := false
-		if currentUserEmail != "" {
-			if admins != nil && admins.IsAdmin(currentUserEmail) {
-				viewerIsAdmin = true
-			} else {
-				if acctRawV, err := dbpkg.Get(dbConn, "accounts", currentUserEmail); err == nil && acctRawV != "" {
-					var acctV map[string]interface{}
-					if json.Unmarshal([]byte(acctRawV), &acctV) == nil {
-						if adm, _ := acctV["admin"].(bool); adm {
-							viewerIsAdmin = true
-						}
-					}
-				}
+		levels := []trackLevel{}
+		weights := map[string]int{}
+		for _, t := range tracks.List() {
+			weights[t.ID] = t.Weight
+			if t.Listed() {
+				levels = append(levels, trackLevel{t.Name, acct.Level(t.ID)})
 			}
 		}
 
+		viewerIsAdmin := p.Can(dbpkg.PermUsersRead)
+
 		data := map[string]interface{}{
 			"Name":            displayName,
 			"Email":           email,
@@ -157,8 +97,7 @@ func UserProfileHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			"IsOwnProfile":    isOwnProfile,
 			"BioPublic":       bioPublic,
 			"ShowBio":         showBio,
-			"LevelsCryptic":   levelsCryptic,
-			"LevelsCTF":       levelsCTF,
+			"Levels":          levels,
 			"ScoreTimes":      nil,
 			"ScorePoints":     nil,
 			"PageTitle":       fmt.Sprintf("%s - Profile", displayName),
@@ -166,33 +105,18 @@ func UserProfileHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			"Admin":           viewerIsAdmin,
 		}
 
-		logsMap, _ := dbpkg.GetAll(dbConn, "logs")
+		solves, _ := dbpkg.ListSolves(dbConn, email)
 		times := []int64{}
 		points := []int{}
-		cum := 0
-		for _, v := range logsMap {
-			var entry struct {
-				ID        int    `json:"id"`
-				Namespace string `json:"namespace"`
-				Key       string `json:"key"`
-				Event     string `json:"event"`
-				Data      string `json:"data"`
-				CreatedAt int64  `json:"created_at"`
-			}
-			if err := json.Unmarshal([]byte(v), &entry); err != nil {
-				continue
-			}
-			if entry.Key != email {
-				continue
-			}
-			if entry.Namespace != "submit" {
-				continue
-			}
-			if strings.Contains(entry.Data, "correct") {
-				cum += 1
-				times = append(times, entry.CreatedAt)
-				points = append(points, cum)
+		total := 0
+		for _, sv := range solves {
+			w, ok := weights[sv.Track]
+			if !ok {
+				w = 1
 			}
+			total += w
+			times = append(times, sv.CreatedAt)
+			points = append(points, total)
 		}
 		if len(times) > 0 {
 			tb, _ := json.Marshal(times)
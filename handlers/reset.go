@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sudocrypt25/db"
+)
+
+const resetTokenTTL = 30 * time.Minute
+
+var (
+	errResetToken   = errors.New("invalid or expired reset link")
+	resetSecretOnce sync.Once
+	resetSecretKey  []byte
+	resetSent       sync.Map
+)
+
+// resetSecret signs reset tokens. Without RESET_SECRET or AUTH_SALT a
+// random key is used, so outstanding links stop working on restart.
+func resetSecret() []byte {
+	resetSecretOnce.Do(func() {
+		for _, name := range []string{"RESET_SECRET", "AUTH_SALT"} {
+			if v := os.Getenv(name); v != "" {
+				resetSecretKey = []byte("password-reset|" + v)
+				return
+			}
+		}
+		resetSecretKey = make([]byte, 32)
+		rand.Read(resetSecretKey)
+	})
+	return resetSecretKey
+}
+
+// passwordFingerprint ties a token to the hash it was issued against; once
+// the password changes the token no longer verifies.
+func passwordFingerprint(hash string) string {
+	h := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(h[:8])
+}
+
+func signReset(payload string) string {
+	m := hmac.New(sha256.New, resetSecret())
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func makeResetToken(email, passwordHash string, now time.Time) string {
+	payload := email + "|" + strconv.FormatInt(now.Add(resetTokenTTL).Unix(), 10) + "|" + passwordFingerprint(passwordHash)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signReset(payload)
+}
+
+func parseResetToken(token string, now time.Time) (email, fingerprint string, err error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", errResetToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return "", "", errResetToken
+	}
+	payload := string(raw)
+	if !hmac.Equal([]byte(sig), []byte(signReset(payload))) {
+		return "", "", errResetToken
+	}
+	parts := strings.Split(payload, "|")
+	if len(parts) != 3 {
+		return "", "", errResetToken
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() > exp {
+		return "", "", errResetToken
+	}
+	return parts[0], parts[2], nil
+}
+
+func publicURL(r *http.Request) string {
+	if v := os.Getenv("PUBLIC_URL"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return "https://" + r.Host
+}
+
+// sendResetMail mails a reset link for acct as HTML, which is what SendMail
+// declares. Player requests are limited to one a minute per account; admin
+// resets always send.
+func sendResetMail(r *http.Request, acct *db.Account, throttle bool) {
+	now := time.Now()
+	if last, ok := resetSent.Load(acct.Email); throttle && ok && now.Sub(last.(time.Time)) < time.Minute {
+		return
+	}
+	resetSent.Store(acct.Email, now)
+	link := publicURL(r) + "/auth?reset_token=" + url.QueryEscape(makeResetToken(acct.Email, acct.Password, now))
+	body := fmt.Sprintf(`<p>Hi %s,</p><p>Use the link below to choose a new Sudocrypt password. It expires in %d minutes.</p><p><a href="%s">%s</a></p><p>If you did not ask for this, ignore this email.</p>`,
+		html.EscapeString(acct.DisplayName()), int(resetTokenTTL.Minutes()), html.EscapeString(link), html.EscapeString(link))
+	go SendMail(acct.Email, "Reset your Sudocrypt password", body)
+}
+
+// resetPassword checks token and sets password, signing the account out
+// everywhere.
+func resetPassword(dbConn db.Store, token, password string) error {
+	email, fp, err := parseResetToken(token, time.Now())
+	if err != nil {
+		return err
+	}
+	acct, err := db.GetAccount(dbConn, email)
+	if err != nil || !hmac.Equal([]byte(fp), []byte(passwordFingerprint(acct.Password))) {
+		return errResetToken
+	}
+	if err := CheckPasswordPolicy(password, email); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := db.ChangePassword(dbConn, email, acct.Password, hash); err != nil {
+		if err == db.ErrConflict {
+			return errResetToken
+		}
+		return err
+	}
+	return nil
+}
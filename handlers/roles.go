@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	dbpkg "sudocrypt25/db"
+)
+
+// AdminRolesHandler manages staff roles. GET returns the roles, the
+// permissions they can be built from and who holds what. POST takes
+// {action: grant|revoke, email, role} or {action: define, role,
+// description, permissions} to create or change a role. Only owners may
+// grant or revoke owner, and other managers may only grant or define roles
+// within the permissions they hold themselves.
+func AdminRolesHandler(dbConn dbpkg.Store, admins *Admins) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFromContext(r.Context())
+		requester := p.Email
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			roles, err := dbpkg.ListRoles(dbConn)
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			grants, err := dbpkg.ListRoleGrants(dbConn, strings.ToLower(strings.TrimSpace(r.URL.Query().Get("email"))))
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"roles": roles, "permissions": dbpkg.Permissions, "grants": grants})
+		case http.MethodPost:
+			var payload struct {
+				Action      string   `json:"action"`
+				Email       string   `json:"email"`
+				Role        string   `json:"role"`
+				Description string   `json:"description"`
+				Permissions []string `json:"permissions"`
+			}
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "bad payload", http.StatusBadRequest)
+				return
+			}
+			email := strings.ToLower(strings.TrimSpace(payload.Email))
+			role := strings.ToLower(strings.TrimSpace(payload.Role))
+			if role == "" {
+				http.Error(w, "missing role", http.StatusBadRequest)
+				return
+			}
+			if role == dbpkg.RoleOwner && (payload.Action == "grant" || payload.Action == "revoke") && !isOwner(p, admins) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			before, err := findRole(dbConn, role)
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			switch payload.Action {
+			case "grant":
+				if before != nil && !canDelegate(p, admins, before.Permissions) {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				if _, err := dbpkg.GetAccount(dbConn, email); err != nil {
+					http.Error(w, "no account", http.StatusNotFound)
+					return
+				}
+				if err := dbpkg.GrantRole(dbConn, email, role, requester); err != nil {
+					if err == dbpkg.ErrUnknownRole {
+						http.Error(w, err.Error(), http.StatusNotFound)
+						return
+					}
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				audit(dbConn, r, "role.grant", email, nil, map[string]string{"role": role})
+			case "revoke":
+				if role == dbpkg.RoleOwner && len(admins.set) == 0 {
+					n, err := dbpkg.CountRoleHolders(dbConn, dbpkg.RoleOwner)
+					if err != nil {
+						http.Error(w, "db error", http.StatusInternalServerError)
+						return
+					}
+					if n <= 1 {
+						http.Error(w, "cannot revoke the last owner", http.StatusConflict)
+						return
+					}
+				}
+				ok, err := dbpkg.RevokeRole(dbConn, email, role)
+				if err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				if !ok {
+					http.Error(w, "role not held", http.StatusNotFound)
+					return
+				}
+				audit(dbConn, r, "role.revoke", email, map[string]string{"role": role}, nil)
+			case "define":
+				if role == dbpkg.RoleOwner {
+					http.Error(w, "the owner role cannot be changed", http.StatusBadRequest)
+					return
+				}
+				for _, perm := range payload.Permissions {
+					if _, ok := dbpkg.LookupPermission(perm); !ok {
+						http.Error(w, "unknown permission "+perm, http.StatusBadRequest)
+						return
+					}
+				}
+				// both what the role gives now and what it would give, so
+				// nobody can widen a role or strip one above their own
+				if !canDelegate(p, admins, payload.Permissions) || (before != nil && !canDelegate(p, admins, before.Permissions)) {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				def := dbpkg.Role{Name: role, Description: strings.TrimSpace(payload.Description), Permissions: payload.Permissions}
+				if err := dbpkg.DefineRole(dbConn, def); err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				audit(dbConn, r, "role.define", role, before, def)
+			default:
+				http.Error(w, "unknown action", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func isOwner(p *Principal, admins *Admins) bool {
+	if p == nil {
+		return false
+	}
+	if admins.bootstrap(p.Email) {
+		return true
+	}
+	for _, r := range p.Roles {
+		if r == dbpkg.RoleOwner {
+			return true
+		}
+	}
+	return false
+}
+
+// canDelegate reports whether p may hand out perms: owners may hand out
+// anything, everyone else only permissions they hold.
+func canDelegate(p *Principal, admins *Admins, perms []string) bool {
+	if isOwner(p, admins) {
+		return true
+	}
+	for _, perm := range perms {
+		if !p.Can(perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// findRole returns the role called name, or nil if there is none.
+func findRole(dbConn dbpkg.Store, name string) (*dbpkg.Role, error) {
+	roles, err := dbpkg.ListRoles(dbConn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range roles {
+		if roles[i].Name == name {
+			return &roles[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sudocrypt25/db"
+)
+
+func TestRoleManagersCannotHandOutMoreThanTheyHold(t *testing.T) {
+	const manager = "m@x.com"
+	d := newTestStore(t, manager)
+	if err := db.CreateAccount(d, &db.Account{Email: "p@x.com", Name: "p"}); err != nil {
+		t.Fatal(err)
+	}
+	h := AdminRolesHandler(d, NewAdmins(d, ""))
+	p := &Principal{Email: manager, Roles: []string{"manager"}, Permissions: []string{db.PermRolesManage, db.PermUsersRead}}
+
+	post := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/roles", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), principalContextKey, p))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	for _, c := range []struct {
+		what, body string
+		want       int
+	}{
+		{"change a built-in role above their own", `{"action":"define","role":"viewer","permissions":["users.read"]}`, http.StatusForbidden},
+		{"define a role past their own", `{"action":"define","role":"helper","permissions":["users.read","logs.read"]}`, http.StatusForbidden},
+		{"define a role within their own", `{"action":"define","role":"helper","permissions":["users.read"]}`, http.StatusOK},
+		{"grant a role past their own", `{"action":"grant","email":"m@x.com","role":"moderator"}`, http.StatusForbidden},
+		{"grant a role within their own", `{"action":"grant","email":"p@x.com","role":"helper"}`, http.StatusOK},
+	} {
+		if got := post(c.body); got != c.want {
+			t.Errorf("%s: %d, want %d", c.what, got, c.want)
+		}
+	}
+	roles, err := db.AccountRoles(d, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 0 {
+		t.Fatalf("manager now holds %v, want nothing", roles)
+	}
+}
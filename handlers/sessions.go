@@ -2,13 +2,38 @@ package handlers
 
 import (
 	"crypto/rand"
-	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
+	"time"
 
 	"sudocrypt25/db"
 )
 
+var errSessionExpired = errors.New("session expired")
+
+// sessionTouchInterval limits how often last_seen_at is written.
+const sessionTouchInterval = 60
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// sessionIdleTimeout and sessionMaxAge are read from SESSION_IDLE_TIMEOUT
+// and SESSION_MAX_AGE as Go durations.
+func sessionIdleTimeout() time.Duration {
+	return envDuration("SESSION_IDLE_TIMEOUT", 24*time.Hour)
+}
+
+func sessionMaxAge() time.Duration {
+	return envDuration("SESSION_MAX_AGE", 7*24*time.Hour)
+}
+
 func genSessionID() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -17,38 +42,167 @@ func genSessionID() (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
-func CreateSession(dbConn *sql.DB, email string) (string, error) {
+// sessionHandle is the public name of a session; the id itself is a
+// bearer credential and never leaves the cookie.
+func sessionHandle(sid string) string {
+	return hashHex(sid)[:16]
+}
+
+func CreateSession(dbConn db.Store, r *http.Request, email string, mfa bool) (string, error) {
 	sid, err := genSessionID()
 	if err != nil {
 		return "", err
 	}
-	if err := db.Set(dbConn, "sessions", sid, email); err != nil {
+	ua := r.UserAgent()
+	if len(ua) > 256 {
+		ua = ua[:256]
+	}
+	now := time.Now().Unix()
+	s := &db.Session{ID: sid, Email: email, IP: clientIP(r), UserAgent: ua, CreatedAt: now, LastSeenAt: now, MFA: mfa}
+	if err := db.CreateSession(dbConn, s); err != nil {
 		return "", err
 	}
 	return sid, nil
 }
 
-func GetEmailFromRequest(dbConn *sql.DB, r *http.Request) (string, error) {
+// StartSession signs email in with a fresh session id, dropping whatever
+// session the request arrived with. mfa records that a second factor was
+// checked.
+func StartSession(dbConn db.Store, w http.ResponseWriter, r *http.Request, email string, mfa bool) error {
+	if c, err := r.Cookie("session_id"); err == nil && c.Value != "" {
+		db.DeleteSession(dbConn, c.Value)
+	}
+	sid, err := CreateSession(dbConn, r, email, mfa)
+	if err != nil {
+		return err
+	}
+	SetSessionCookie(w, sid)
+	return nil
+}
+
+func sessionExpired(s *db.Session, now int64) bool {
+	return now-s.LastSeenAt > int64(sessionIdleTimeout().Seconds()) || now-s.CreatedAt > int64(sessionMaxAge().Seconds())
+}
+
+// CurrentSession returns the request's session if it exists and has not
+// timed out. Expired sessions are deleted on sight.
+func CurrentSession(dbConn db.Store, r *http.Request) (*db.Session, error) {
 	c, err := r.Cookie("session_id")
-	if err != nil || c.Value == "" {
-		return "", err
+	if err != nil {
+		return nil, err
+	}
+	if c.Value == "" {
+		return nil, http.ErrNoCookie
 	}
-	email, err := db.Get(dbConn, "sessions", c.Value)
+	s, err := db.GetSession(dbConn, c.Value)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if sessionExpired(s, now) {
+		db.DeleteSession(dbConn, s.ID)
+		return nil, errSessionExpired
 	}
-	return email, nil
+	if now-s.LastSeenAt >= sessionTouchInterval {
+		if err := db.TouchSession(dbConn, s.ID, now); err == nil {
+			s.LastSeenAt = now
+		}
+	}
+	return s, nil
 }
 
-func DeleteSession(dbConn *sql.DB, r *http.Request) error {
+func DeleteSession(dbConn db.Store, r *http.Request) error {
 	c, err := r.Cookie("session_id")
 	if err != nil || c.Value == "" {
 		return err
 	}
-	return db.Delete(dbConn, "sessions", c.Value)
+	return db.DeleteSession(dbConn, c.Value)
 }
 
 func SetSessionCookie(w http.ResponseWriter, sid string) {
-	cookie := &http.Cookie{Name: "session_id", Value: sid, Path: "/", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode, MaxAge: 86400}
+	cookie := &http.Cookie{Name: "session_id", Value: sid, Path: "/", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode, MaxAge: int(sessionMaxAge().Seconds())}
 	http.SetCookie(w, cookie)
 }
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "session_id", Value: "", Path: "/", HttpOnly: true, Expires: time.Unix(0, 0), MaxAge: -1})
+}
+
+// SessionsHandler lets a player see where they are signed in. GET lists
+// sessions; POST takes {action: revoke, id}, {action: revoke_others} or
+// {action: revoke_all}.
+func SessionsHandler(dbConn db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cur := PrincipalFromContext(r.Context()).Session
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			list, err := db.ListSessions(dbConn, cur.Email)
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			out := make([]map[string]interface{}, 0, len(list))
+			for _, s := range list {
+				out = append(out, map[string]interface{}{
+					"id":           sessionHandle(s.ID),
+					"ip":           s.IP,
+					"user_agent":   s.UserAgent,
+					"created_at":   s.CreatedAt,
+					"last_seen_at": s.LastSeenAt,
+					"current":      s.ID == cur.ID,
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"sessions": out})
+		case http.MethodPost:
+			var payload map[string]string
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "bad payload", http.StatusBadRequest)
+				return
+			}
+			switch payload["action"] {
+			case "revoke":
+				list, err := db.ListSessions(dbConn, cur.Email)
+				if err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				found := false
+				for _, s := range list {
+					if payload["id"] != "" && sessionHandle(s.ID) == payload["id"] {
+						if err := db.DeleteSession(dbConn, s.ID); err != nil {
+							http.Error(w, "db error", http.StatusInternalServerError)
+							return
+						}
+						if s.ID == cur.ID {
+							clearSessionCookie(w)
+						}
+						found = true
+					}
+				}
+				if !found {
+					http.Error(w, "no such session", http.StatusNotFound)
+					return
+				}
+			case "revoke_others":
+				if err := db.DeleteOtherSessions(dbConn, cur.Email, cur.ID); err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+			case "revoke_all":
+				if err := db.DeleteSessions(dbConn, cur.Email); err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				clearSessionCookie(w)
+			default:
+				http.Error(w, "unknown action", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
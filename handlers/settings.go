@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dbpkg "sudocrypt25/db"
+)
+
+func AdminSettingsHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := PrincipalFromContext(r.Context()).Email
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			w.Header().Set("Content-Type", "application/json")
+			if _, ok := q["history"]; ok {
+				limit, _ := strconv.Atoi(q.Get("limit"))
+				hist, err := settings.History(q.Get("key"), limit)
+				if err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"history": hist})
+				return
+			}
+			list, err := settings.List()
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"settings": list})
+		case http.MethodPost:
+			var payload map[string]interface{}
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				defer r.Body.Close()
+				json.NewDecoder(r.Body).Decode(&payload)
+			} else {
+				r.ParseForm()
+				payload = map[string]interface{}{"key": r.FormValue("key"), "value": r.FormValue("value")}
+			}
+			key, _ := payload["key"].(string)
+			key = strings.TrimSpace(key)
+			value := ""
+			if v, ok := payload["value"]; ok && v != nil {
+				value = fmt.Sprint(v)
+			}
+			if f, ok := dbpkg.LookupFlag(key); ok && key == "admin.require_2fa" {
+				// whoever turns it on must already be able to pass it
+				v, _ := f.Validate(value)
+				if v == "true" && !PrincipalFromContext(r.Context()).Session.MFA {
+					http.Error(w, "sign in with two-factor authentication before requiring it", http.StatusConflict)
+					return
+				}
+			}
+			before := settings.Get(key)
+			if err := settings.Set(key, value, email); err != nil {
+				if _, ok := dbpkg.LookupFlag(key); !ok {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			audit(dbConn, r, "setting.set", key, map[string]string{"value": before}, map[string]string{"value": settings.Get(key)})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": key, "value": settings.Get(key)})
+		case http.MethodDelete:
+			key := strings.TrimSpace(r.URL.Query().Get("key"))
+			before := settings.Get(key)
+			if err := settings.Reset(key, email); err != nil {
+				if _, ok := dbpkg.LookupFlag(key); !ok {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			audit(dbConn, r, "setting.reset", key, map[string]string{"value": before}, map[string]string{"value": settings.Get(key)})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": key, "value": settings.Get(key)})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sudocrypt25/db"
+)
+
+// RFC 6238 parameters understood by every common authenticator app.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+	totpIssuer = "Sudocrypt"
+
+	recoveryCodeCount = 10
+	mfaChallengeTTL   = 5 * time.Minute
+	mfaMaxAttempts    = 5
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+// totpCode is the HOTP value (RFC 4226) of secret at counter step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	m := hmac.New(sha1.New, secret)
+	m.Write(msg[:])
+	sum := m.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+// matchTOTP returns the time step code belongs to, allowing totpSkew steps
+// of clock drift either way.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / totpPeriod
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// provisioning URI that authenticator apps read
+// from a QR code.
+func totpURI(secret, email string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(totpDigits))
+	v.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + v.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func recoveryHash(email, code string) string {
+	return hashHex(email + "|" + normalizeRecoveryCode(code))
+}
+
+// newRecoveryCodes returns fresh codes and the hashes to store for them.
+func newRecoveryCodes(email string) ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(b32.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		hashes[i] = recoveryHash(email, codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Both are single use.
+func verifySecondFactor(dbConn db.Store, email, code string, now time.Time) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if len(code) == totpDigits {
+		t, err := db.GetTOTP(dbConn, email)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		step, ok := matchTOTP(t.Secret, code, now)
+		if !ok || !t.Enabled {
+			return false, nil
+		}
+		return db.UseTOTPStep(dbConn, email, step)
+	}
+	return db.UseRecoveryCode(dbConn, email, recoveryHash(email, code))
+}
+
+// checkSecondFactor is verifySecondFactor with failures counted against
+// the same per-email limiter as passwords.
+func checkSecondFactor(dbConn db.Store, r *http.Request, email, code string) (bool, error) {
+	if wait, _ := loginLimits.email.Wait(email); wait > 0 {
+		return false, &db.ThrottleError{RetryAfter: wait}
+	}
+	ok, err := verifySecondFactor(dbConn, email, code, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		loginFailed(dbConn, r, email)
+	}
+	return ok, nil
+}
+
+// mfaChallenge is a password login waiting for its second factor.
+type mfaChallenge struct {
+	email    string
+	expires  time.Time
+	attempts int32
+}
+
+var mfaChallenges sync.Map
+
+func startMFAChallenge(email string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	mfaChallenges.Store(token, &mfaChallenge{email: email, expires: time.Now().Add(mfaChallengeTTL)})
+	return token, nil
+}
+
+func lookupMFAChallenge(token string) (*mfaChallenge, bool) {
+	v, ok := mfaChallenges.Load(token)
+	if !ok {
+		return nil, false
+	}
+	c := v.(*mfaChallenge)
+	if time.Now().After(c.expires) || atomic.LoadInt32(&c.attempts) >= mfaMaxAttempts {
+		mfaChallenges.Delete(token)
+		return nil, false
+	}
+	return c, true
+}
+
+func pruneMFAChallenges() {
+	now := time.Now()
+	mfaChallenges.Range(func(k, v interface{}) bool {
+		if now.After(v.(*mfaChallenge).expires) {
+			mfaChallenges.Delete(k)
+		}
+		return true
+	})
+}
+
+func writeSecondFactorError(w http.ResponseWriter, err error) {
+	if te, ok := err.(*db.ThrottleError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(te.RetryAfter.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": te.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "db error"})
+		return
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": "incorrect code"})
+}
+
+// TwoFactorHandler manages the caller's authenticator. GET reports status;
+// POST takes {action: enroll}, {action: confirm, code}, {action: disable,
+// code} or {action: recovery_codes, code}.
+func TwoFactorHandler(dbConn db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cur := PrincipalFromContext(r.Context()).Session
+		email := cur.Email
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			enabled, err := db.TOTPEnabled(dbConn, email)
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			left, err := db.RecoveryCodesLeft(dbConn, email)
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"enabled": enabled, "recovery_codes_left": left, "session_verified": cur.MFA})
+		case http.MethodPost:
+			var payload map[string]string
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "bad payload", http.StatusBadRequest)
+				return
+			}
+			switch payload["action"] {
+			case "enroll":
+				secret, err := newTOTPSecret()
+				if err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				if err := db.BeginTOTP(dbConn, email, secret); err != nil {
+					if err == db.ErrConflict {
+						http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+						return
+					}
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]string{"secret": secret, "uri": totpURI(secret, email)})
+			case "confirm":
+				t, err := db.GetTOTP(dbConn, email)
+				if err != nil || t.Enabled {
+					http.Error(w, "no pending enrollment", http.StatusBadRequest)
+					return
+				}
+				step, ok := matchTOTP(t.Secret, strings.TrimSpace(payload["code"]), time.Now())
+				if ok {
+					ok, err = db.UseTOTPStep(dbConn, email, step)
+				}
+				if err != nil || !ok {
+					writeSecondFactorError(w, err)
+					return
+				}
+				codes, hashes, err := newRecoveryCodes(email)
+				if err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				if err := db.EnableTOTP(dbConn, email, hashes); err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				db.SetSessionMFA(dbConn, cur.ID)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "recovery_codes": codes})
+			case "disable", "recovery_codes":
+				ok, err := checkSecondFactor(dbConn, r, email, payload["code"])
+				if err != nil || !ok {
+					writeSecondFactorError(w, err)
+					return
+				}
+				if payload["action"] == "disable" {
+					if err := db.DisableTOTP(dbConn, email); err != nil {
+						http.Error(w, "db error", http.StatusInternalServerError)
+						return
+					}
+					json.NewEncoder(w).Encode(map[string]bool{"success": true})
+					return
+				}
+				codes, hashes, err := newRecoveryCodes(email)
+				if err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				if err := db.SetRecoveryCodes(dbConn, email, hashes); err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "recovery_codes": codes})
+			default:
+				http.Error(w, "unknown action", http.StatusBadRequest)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sudocrypt25/db"
+)
+
+// rfc6238Secret is the SHA-1 key from RFC 6238 appendix B.
+var rfc6238Secret = b32.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, cut to our six digits
+	for _, v := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if got := totpCode([]byte("12345678901234567890"), v.unix/totpPeriod); got != v.code {
+			t.Errorf("code at %d = %s, want %s", v.unix, got, v.code)
+		}
+		step, ok := matchTOTP(rfc6238Secret, v.code, time.Unix(v.unix, 0))
+		if !ok || step != v.unix/totpPeriod {
+			t.Errorf("matchTOTP at %d = %d, %v; want step %d", v.unix, step, ok, v.unix/totpPeriod)
+		}
+	}
+}
+
+func TestTOTPWindow(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	cur := now.Unix() / totpPeriod
+	for off := int64(-3); off <= 3; off++ {
+		step, ok := matchTOTP(rfc6238Secret, totpCode(key, cur+off), now)
+		inWindow := off >= -totpSkew && off <= totpSkew
+		if ok != inWindow {
+			t.Errorf("code %+d steps away accepted = %v, want %v", off, ok, inWindow)
+		}
+		if ok && step != cur+off {
+			t.Errorf("code %+d steps away matched step %d, want %d", off, step, cur+off)
+		}
+	}
+	if _, ok := matchTOTP(rfc6238Secret, "12345", now); ok {
+		t.Error("short code accepted")
+	}
+}
+
+func newTestStore(t *testing.T, email string) db.Store {
+	t.Helper()
+	d, err := db.OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := db.InitDB(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateAccount(d, &db.Account{Email: email, Name: email}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestTOTPReplayRejected(t *testing.T) {
+	const email = "p@x.com"
+	d := newTestStore(t, email)
+	if err := db.BeginTOTP(d, email, rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnableTOTP(d, email, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	cur := now.Unix() / totpPeriod
+
+	check := func(code string, want bool, what string) {
+		t.Helper()
+		ok, err := verifySecondFactor(d, email, code, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("%s: accepted = %v, want %v", what, ok, want)
+		}
+	}
+	check(totpCode(key, cur), true, "current code")
+	check(totpCode(key, cur), false, "same code again")
+	check(totpCode(key, cur-1), false, "older code after a newer one")
+	check(totpCode(key, cur+1), true, "next code")
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	const email = "p@x.com"
+	d := newTestStore(t, email)
+	if err := db.BeginTOTP(d, email, rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := newRecoveryCodes(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnableTOTP(d, email, hashes); err != nil {
+		t.Fatal(err)
+	}
+	for i, code := range codes {
+		// codes are accepted however the player types them
+		typed := code
+		if i%2 == 1 {
+			typed = " " + normalizeRecoveryCode(code)[:5] + " " + normalizeRecoveryCode(code)[5:]
+		}
+		if ok, err := verifySecondFactor(d, email, typed, time.Now()); err != nil || !ok {
+			t.Fatalf("code %d first use: %v, %v", i, ok, err)
+		}
+		if ok, err := verifySecondFactor(d, email, code, time.Now()); err != nil || ok {
+			t.Fatalf("code %d second use: %v, %v", i, ok, err)
+		}
+	}
+	if n, err := db.RecoveryCodesLeft(d, email); err != nil || n != 0 {
+		t.Fatalf("%d codes left, want 0 (%v)", n, err)
+	}
+}
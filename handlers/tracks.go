@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dbpkg "sudocrypt25/db"
+)
+
+var tracks *dbpkg.Tracks
+
+// InitTracks loads tracks from dbConn. InitHandlers calls it; commands that
+// use levels without serving call it themselves.
+func InitTracks(dbConn dbpkg.Store) {
+	tracks = dbpkg.NewTracks(dbConn)
+}
+
+func lookupTrack(id string) (dbpkg.Track, bool) {
+	if tracks == nil {
+		return dbpkg.Track{}, false
+	}
+	return tracks.Get(id)
+}
+
+// splitLevelID parses "<track>-<n>" for a configured track.
+func splitLevelID(id string) (string, int, bool) {
+	i := strings.LastIndex(id, "-")
+	if i <= 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(id[i+1:])
+	if err != nil || n < 0 || id[i+1:] != strconv.Itoa(n) {
+		return "", 0, false
+	}
+	if _, ok := lookupTrack(id[:i]); !ok {
+		return "", 0, false
+	}
+	return id[:i], n, true
+}
+
+func isValidLevelID(id string) bool {
+	_, _, ok := splitLevelID(id)
+	return ok
+}
+
+func TrackEnabled(track string) bool {
+	t, ok := lookupTrack(track)
+	return ok && t.Playable()
+}
+
+// DefaultTrack is where /play and friends go when no type is given: the
+// first track players can see.
+func DefaultTrack() string {
+	if tracks != nil {
+		for _, t := range tracks.List() {
+			if t.Listed() {
+				return t.ID
+			}
+		}
+	}
+	return "cryptic"
+}
+
+// VisibleTracks are the tracks p may see: the listed ones, plus hidden ones
+// for staff who playtest.
+func VisibleTracks(p *Principal) []dbpkg.Track {
+	out := []dbpkg.Track{}
+	if tracks == nil {
+		return out
+	}
+	for _, t := range tracks.List() {
+		if t.Listed() || p.Can(dbpkg.PermLevelsPlaytest) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func TracksHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type view struct {
+			ID         string `json:"id"`
+			Name       string `json:"name"`
+			Visibility string `json:"visibility"`
+		}
+		out := []view{}
+		for _, t := range VisibleTracks(PrincipalFromContext(r.Context())) {
+			out = append(out, view{t.ID, t.Name, t.Visibility})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// AdminTracksHandler serves /api/admin/tracks. GET lists every track, POST
+// {"action":"set","track":{...}} creates or updates one and
+// {"action":"delete","id":...} removes an unused one.
+func AdminTracksHandler(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := dbpkg.ListTracks(dbConn)
+			if err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"tracks": list})
+		case http.MethodPost:
+			var payload struct {
+				Action string      `json:"action"`
+				ID     string      `json:"id"`
+				Track  dbpkg.Track `json:"track"`
+			}
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "bad payload", http.StatusBadRequest)
+				return
+			}
+			switch payload.Action {
+			case "set":
+				t := payload.Track
+				if err := t.Validate(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				var before interface{}
+				if old, ok := tracks.Get(t.ID); ok {
+					before = old
+				}
+				if err := tracks.Save(t, PrincipalFromContext(r.Context()).Email); err != nil {
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				audit(dbConn, r, "track.set", t.ID, before, t)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "track": t})
+			case "delete":
+				old, ok := tracks.Get(payload.ID)
+				if !ok {
+					http.Error(w, "no such track", http.StatusNotFound)
+					return
+				}
+				if err := tracks.Delete(payload.ID); err != nil {
+					if errors.Is(err, dbpkg.ErrTrackInUse) {
+						http.Error(w, err.Error(), http.StatusConflict)
+						return
+					}
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+				audit(dbConn, r, "track.delete", payload.ID, old, nil)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]bool{"success": true})
+			default:
+				http.Error(w, "unknown action", http.StatusBadRequest)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
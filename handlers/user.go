@@ -1,28 +1,17 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 
 	dbpkg "sudocrypt25/db"
 )
 
-func AdminUpdateUserProgressHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func AdminUpdateUserProgressHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-		requester, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || requester == "" || admins == nil || !admins.IsAdmin(requester) {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
+		p := PrincipalFromContext(r.Context())
 
 		switch r.Method {
 		case http.MethodGet:
@@ -31,57 +20,18 @@ func AdminUpdateUserProgressHandler(dbConn *sql.DB, admins *Admins) http.Handler
 				http.Error(w, "missing email", http.StatusBadRequest)
 				return
 			}
-			acctRaw, err := dbpkg.Get(dbConn, "accounts", email)
-			var acct map[string]interface{}
-			if err == nil {
-				json.Unmarshal([]byte(acctRaw), &acct)
-			} else {
-				acct = map[string]interface{}{"levels": map[string]float64{"cryptic": 0, "ctf": 0}}
-			}
-			progMap := map[string][]interface{}{}
-			if p, ok := acct["progress"].([]interface{}); ok && len(p) >= 2 {
-				progMap["cryptic"] = []interface{}{p[0], p[1]}
-				progMap["ctf"] = []interface{}{"ctf-0", float64(0)}
-			} else if pm, ok := acct["progress"].(map[string]interface{}); ok {
-				for k, v := range pm {
-					if arr, ok2 := v.([]interface{}); ok2 && len(arr) >= 2 {
-						progMap[k] = []interface{}{arr[0], arr[1]}
-					}
-				}
-				if _, ok := progMap["cryptic"]; !ok {
-					levelsMap := map[string]float64{}
-					if lm, ok := acct["levels"].(map[string]interface{}); ok {
-						for k, v := range lm {
-							if vf, ok := v.(float64); ok {
-								levelsMap[k] = vf
-							}
-						}
-					}
-					curr := int(levelsMap["cryptic"])
-					levelID := fmt.Sprintf("%s-%d", "cryptic", curr)
-					progMap["cryptic"] = []interface{}{levelID, float64(0)}
-				}
-				if _, ok := progMap["ctf"]; !ok {
-					progMap["ctf"] = []interface{}{"ctf-0", float64(0)}
-				}
-			} else {
-				levelsMap := map[string]float64{}
-				if lm, ok := acct["levels"].(map[string]interface{}); ok {
-					for k, v := range lm {
-						if vf, ok := v.(float64); ok {
-							levelsMap[k] = vf
-						}
-					}
-				}
-				curr := int(levelsMap["cryptic"])
-				levelID := fmt.Sprintf("%s-%d", "cryptic", curr)
-				progMap["cryptic"] = []interface{}{levelID, float64(0)}
-				progMap["ctf"] = []interface{}{"ctf-0", float64(0)}
+			acct, err := dbpkg.GetAccount(dbConn, email)
+			if err != nil {
+				acct = &dbpkg.Account{Email: email}
 			}
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"progress": progMap})
+			json.NewEncoder(w).Encode(map[string]interface{}{"progress": progressView(acct)})
 			return
 		case http.MethodPost:
+			if !p.Can(dbpkg.PermUsersProgress) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
 			var payload map[string]interface{}
 			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
 				defer r.Body.Close()
@@ -103,101 +53,66 @@ func AdminUpdateUserProgressHandler(dbConn *sql.DB, admins *Admins) http.Handler
 				return
 			}
 
-			acctRaw, err := dbpkg.Get(dbConn, "accounts", targetEmail)
-			var acct map[string]interface{}
-			if err == nil {
-				json.Unmarshal([]byte(acctRaw), &acct)
-			} else {
-				acct = map[string]interface{}{"levels": map[string]float64{"cryptic": 0, "ctf": 0}}
+			acct, err := dbpkg.GetAccount(dbConn, targetEmail)
+			if err != nil {
+				http.Error(w, "no account", http.StatusNotFound)
+				return
 			}
 
+			before := progressView(acct)
 			action, _ := payload["action"].(string)
-			progMap := map[string][]interface{}{}
-			if pm, ok := acct["progress"].(map[string]interface{}); ok {
-				for k, v := range pm {
-					if arr, ok2 := v.([]interface{}); ok2 && len(arr) >= 2 {
-						progMap[k] = []interface{}{arr[0], arr[1]}
-					}
-				}
-			} else if p, ok := acct["progress"].([]interface{}); ok && len(p) >= 2 {
-				progMap["cryptic"] = []interface{}{p[0], p[1]}
+			typ, _ := payload["type"].(string)
+			if typ == "" {
+				typ = DefaultTrack()
+			}
+			if _, ok := lookupTrack(typ); !ok {
+				http.Error(w, "unknown track", http.StatusBadRequest)
+				return
 			}
-
 			switch action {
 			case "inc":
-				typ, _ := payload["type"].(string)
-				if typ == "" {
-					typ = "cryptic"
-				}
-				levelsMap := map[string]float64{}
-				if lm, ok := acct["levels"].(map[string]interface{}); ok {
-					for k, v := range lm {
-						if vf, ok := v.(float64); ok {
-							levelsMap[k] = vf
-						}
-					}
+				levelID := fmt.Sprintf("%s-%d", typ, acct.Level(typ))
+				cp := acct.Checkpoints[typ]
+				if cp.LevelID != levelID {
+					cp = dbpkg.Checkpoint{LevelID: levelID}
 				}
-				curr := int(levelsMap[typ])
-				levelID := fmt.Sprintf("%s-%d", typ, curr)
-				var progLevel string
-				var progCheckpoint float64
-				if pr, ok := progMap[typ]; ok && len(pr) >= 2 {
-					if s, ok2 := pr[0].(string); ok2 {
-						progLevel = s
-					}
-					if n, ok2 := pr[1].(float64); ok2 {
-						progCheckpoint = n
-					}
-				} else {
-					progLevel = levelID
-					progCheckpoint = 0
+				cp.Checkpoint++
+				if cp.Checkpoint > 9 {
+					cp.Checkpoint = 9
 				}
-				if progLevel != levelID {
-					progLevel = levelID
-					progCheckpoint = 0
-				}
-				progCheckpoint = progCheckpoint + 1
-				if progCheckpoint > 9 {
-					progCheckpoint = 9
-				}
-				progMap[typ] = []interface{}{progLevel, progCheckpoint}
+				acct.Checkpoints[typ] = cp
 			case "set":
-				typ, _ := payload["type"].(string)
-				if typ == "" {
-					typ = "cryptic"
+				p, ok := payload["progress"].([]interface{})
+				if !ok || len(p) < 2 {
+					http.Error(w, "bad progress", http.StatusBadRequest)
+					return
 				}
-				if p, ok := payload["progress"].([]interface{}); ok && len(p) >= 2 {
-					lvl, ok1 := p[0].(string)
-					num, ok2 := p[1].(float64)
-					if !ok1 || !ok2 {
-						http.Error(w, "bad progress", http.StatusBadRequest)
-						return
-					}
-					if num < 0 {
-						num = 0
-					}
-					if num > 9 {
-						num = 9
-					}
-					progMap[typ] = []interface{}{lvl, num}
-				} else {
+				lvl, ok1 := p[0].(string)
+				num, ok2 := p[1].(float64)
+				if !ok1 || !ok2 {
 					http.Error(w, "bad progress", http.StatusBadRequest)
 					return
 				}
+				if num < 0 {
+					num = 0
+				}
+				if num > 9 {
+					num = 9
+				}
+				acct.Checkpoints[typ] = dbpkg.Checkpoint{LevelID: lvl, Checkpoint: int(num)}
 			default:
 				http.Error(w, "unknown action", http.StatusBadRequest)
 				return
 			}
 
-			acct["progress"] = progMap
-
-			b, _ := json.Marshal(acct)
-			if err := dbpkg.Set(dbConn, "accounts", targetEmail, string(b)); err != nil {
+			cp := acct.Checkpoints[typ]
+			if err := dbpkg.SetCheckpoint(dbConn, targetEmail, typ, cp.LevelID, cp.Checkpoint); err != nil {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			audit(dbConn, r, "user.progress", targetEmail, before, progressView(acct))
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "progress": acct["progress"]})
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "progress": progressView(acct)})
 			return
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -206,111 +121,67 @@ func AdminUpdateUserProgressHandler(dbConn *sql.DB, admins *Admins) http.Handler
 	}
 }
 
-func AdminListUsersHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+func progressView(acct *dbpkg.Account) map[string][]interface{} {
+	progMap := map[string][]interface{}{}
+	for _, t := range tracks.List() {
+		progMap[t.ID] = []interface{}{fmt.Sprintf("%s-%d", t.ID, acct.Level(t.ID)), 0}
+	}
+	for typ, cp := range acct.Checkpoints {
+		progMap[typ] = []interface{}{cp.LevelID, cp.Checkpoint}
+	}
+	return progMap
+}
+
+func AdminListUsersHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		accts, err := dbpkg.ListAccounts(dbConn)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
-		requester, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || requester == "" || admins == nil || !admins.IsAdmin(requester) {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		sanctions, err := dbpkg.ListSanctions(dbConn)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
-		users := map[string]map[string]interface{}{}
-		if accs, err := dbpkg.GetAll(dbConn, "accounts"); err == nil {
-			for email, raw := range accs {
-				var obj map[string]interface{}
-				if err := json.Unmarshal([]byte(raw), &obj); err == nil {
-					users[email] = obj
-				}
-			}
-		}
-		if regs, err := dbpkg.GetAll(dbConn, "registration"); err == nil {
-			for email, raw := range regs {
-				if _, ok := users[email]; ok {
-					continue
-				}
-				var obj map[string]interface{}
-				if err := json.Unmarshal([]byte(raw), &obj); err == nil {
-					users[email] = obj
-				}
-			}
-		}
-		if lbs, err := dbpkg.GetAll(dbConn, "leaderboard"); err == nil {
-			for email, raw := range lbs {
-				if _, ok := users[email]; ok {
-					continue
-				}
-				var obj map[string]interface{}
-				if err := json.Unmarshal([]byte(raw), &obj); err == nil {
-					users[email] = obj
-				}
-			}
-		}
-
 		out := []map[string]interface{}{}
-		for email, obj := range users {
-			name := ""
-			if n, ok := obj["name"].(string); ok {
-				name = n
-			}
-			cryptic := 0
-			ctf := 0
-			if lm, ok := obj["levels"].(map[string]interface{}); ok {
-				if v, ok2 := lm["cryptic"]; ok2 {
-					if vf, ok3 := v.(float64); ok3 {
-						cryptic = int(vf)
-					}
-				}
-				if v, ok2 := lm["ctf"]; ok2 {
-					if vf, ok3 := v.(float64); ok3 {
-						ctf = int(vf)
-					}
-				}
+		for _, a := range accts {
+			s := sanctions[a.Email]
+			if s == nil {
+				s = dbpkg.Sanctions{}
 			}
-			if prog, ok := obj["progress"].(map[string]interface{}); ok {
-				if p, ok2 := prog["cryptic"].([]interface{}); ok2 && len(p) > 0 {
-					if s, ok3 := p[0].(string); ok3 {
-						parts := strings.SplitN(s, "-", 2)
-						if len(parts) == 2 {
-							if n, err := strconv.Atoi(parts[1]); err == nil {
-								cryptic = n
-							}
-						}
-					}
-				}
-				if p, ok2 := prog["ctf"].([]interface{}); ok2 && len(p) > 0 {
-					if s, ok3 := p[0].(string); ok3 {
-						parts := strings.SplitN(s, "-", 2)
-						if len(parts) == 2 {
-							if n, err := strconv.Atoi(parts[1]); err == nil {
-								ctf = n
-							}
-						}
-					}
-				}
+			levels := map[string]int{}
+			for _, t := range tracks.List() {
+				levels[t.ID] = a.Level(t.ID)
 			}
-			out = append(out, map[string]interface{}{"email": email, "name": name, "cryptic": cryptic, "ctf": ctf})
+			out = append(out, map[string]interface{}{"email": a.Email, "name": a.Name, "levels": levels, "points": a.Points, "sanctions": s})
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(out)
 	}
 }
 
-func AdminUserActionHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
+var userActionPerms = map[string]string{
+	"reset":           dbpkg.PermUsersProgress,
+	"force_reset":     dbpkg.PermUsersSecurity,
+	"unlock":          dbpkg.PermUsersSecurity,
+	"disable_2fa":     dbpkg.PermUsersSecurity,
+	"revoke_sessions": dbpkg.PermUsersSecurity,
+	"delete":          dbpkg.PermUsersDelete,
+	"disqualify":      dbpkg.PermUsersDisqualify,
+	"reinstate":       dbpkg.PermUsersDisqualify,
+	"suspend":         dbpkg.PermUsersDisqualify,
+	"unsuspend":       dbpkg.PermUsersDisqualify,
+	"mute":            dbpkg.PermUsersDisqualify,
+	"unmute":          dbpkg.PermUsersDisqualify,
+	"hide":            dbpkg.PermUsersDisqualify,
+	"unhide":          dbpkg.PermUsersDisqualify,
+}
+
+func AdminUserActionHandler(dbConn dbpkg.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_id")
-		if err != nil || c.Value == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-		requester, err := GetEmailFromRequest(dbConn, r)
-		if err != nil || requester == "" || admins == nil || !admins.IsAdmin(requester) {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
+		p := PrincipalFromContext(r.Context())
+		requester := p.Email
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -327,58 +198,91 @@ func AdminUserActionHandler(dbConn *sql.DB, admins *Admins) http.HandlerFunc {
 			http.Error(w, "missing fields", http.StatusBadRequest)
 			return
 		}
-		acctRaw, _ := dbpkg.Get(dbConn, "accounts", email)
-		var acct map[string]interface{}
-		if acctRaw != "" {
-			json.Unmarshal([]byte(acctRaw), &acct)
-		} else {
-			acct = map[string]interface{}{"levels": map[string]float64{"cryptic": 0, "ctf": 0}}
+		// reset_<track> puts the player back to the first level of a track
+		kind := action
+		if strings.HasPrefix(action, "reset_") {
+			kind = "reset"
 		}
-		switch action {
-		case "reset_cryptic":
-			if lm, ok := acct["levels"].(map[string]interface{}); ok {
-				lm["cryptic"] = float64(0)
-				acct["levels"] = lm
-			} else {
-				acct["levels"] = map[string]float64{"cryptic": 0, "ctf": 0}
+		if perm, ok := userActionPerms[kind]; ok && !p.Can(perm) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch kind {
+		case "reset":
+			typ := strings.TrimPrefix(action, "reset_")
+			if _, ok := lookupTrack(typ); !ok {
+				http.Error(w, "unknown track", http.StatusBadRequest)
+				return
 			}
-			if prog, ok := acct["progress"].(map[string]interface{}); ok {
-				delete(prog, "cryptic")
-				acct["progress"] = prog
+			var before map[string][]interface{}
+			if acct, err := dbpkg.GetAccount(dbConn, email); err == nil {
+				before = progressView(acct)
 			}
-			b, _ := json.Marshal(acct)
-			if err := dbpkg.Set(dbConn, "accounts", email, string(b)); err != nil {
+			if err := dbpkg.SetLevel(dbConn, email, typ, 0); err != nil {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			var after map[string][]interface{}
+			if acct, err := dbpkg.GetAccount(dbConn, email); err == nil {
+				after = progressView(acct)
+			}
+			audit(dbConn, r, "user."+action, email, before, after)
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
-		case "reset_ctf":
-			if lm, ok := acct["levels"].(map[string]interface{}); ok {
-				lm["ctf"] = float64(0)
-				acct["levels"] = lm
-			} else {
-				acct["levels"] = map[string]float64{"cryptic": 0, "ctf": 0}
+		case "force_reset":
+			acct, err := dbpkg.GetAccount(dbConn, email)
+			if err != nil {
+				http.Error(w, "no account", http.StatusNotFound)
+				return
 			}
-			if prog, ok := acct["progress"].(map[string]interface{}); ok {
-				delete(prog, "ctf")
-				acct["progress"] = prog
+			if err := dbpkg.ChangePassword(dbConn, email, acct.Password, ""); err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
 			}
-			b, _ := json.Marshal(acct)
-			if err := dbpkg.Set(dbConn, "accounts", email, string(b)); err != nil {
+			acct.Password = ""
+			sendResetMail(r, acct, false)
+			audit(dbConn, r, "user.force_reset", email, nil, nil)
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+			return
+		case "unlock":
+			if err := unlockLogin(dbConn, email, requester); err != nil {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
+			audit(dbConn, r, "user.unlock", email, nil, nil)
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+			return
+		case "disable_2fa":
+			if err := dbpkg.DisableTOTP(dbConn, email); err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			audit(dbConn, r, "user.disable_2fa", email, nil, nil)
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+			return
+		case "revoke_sessions":
+			if err := dbpkg.DeleteSessions(dbConn, email); err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			audit(dbConn, r, "user.revoke_sessions", email, nil, nil)
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
 		case "delete":
-			if err := dbpkg.Delete(dbConn, "accounts", email); err != nil {
+			var before map[string]interface{}
+			if acct, err := dbpkg.GetAccount(dbConn, email); err == nil {
+				before = map[string]interface{}{"name": acct.Name, "progress": progressView(acct)}
+			}
+			if err := dbpkg.DeleteAccount(dbConn, email); err != nil {
 				http.Error(w, "db error", http.StatusInternalServerError)
 				return
 			}
-			_ = dbpkg.Delete(dbConn, "leaderboard", email)
+			audit(dbConn, r, "user.delete", email, before, nil)
 			json.NewEncoder(w).Encode(map[string]bool{"success": true})
 			return
+		case "disqualify", "reinstate", "suspend", "unsuspend", "mute", "unmute", "hide", "unhide":
+			applySanction(w, r, dbConn, email, action, payload)
+			return
 		default:
 			http.Error(w, "unknown action", http.StatusBadRequest)
 			return
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	dbpkg "sudocrypt25/db"
+)
+
+// ViewAsHandler serves /api/admin/view_as. POST {email} makes the caller's
+// session render every page and API as that player until DELETE ends it.
+// Authenticate keeps such a session read-only. GET reports who is being
+// viewed, if anyone.
+func ViewAsHandler(dbConn dbpkg.Store, admins *Admins) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFromContext(r.Context())
+		actor := p.Actor()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]string{"viewing_as": p.Session.ViewAs})
+		case http.MethodPost:
+			if !actor.Can(dbpkg.PermUsersImpersonate) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			var payload struct {
+				Email string `json:"email"`
+			}
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "bad payload", http.StatusBadRequest)
+				return
+			}
+			email := strings.ToLower(strings.TrimSpace(payload.Email))
+			if email == "" || email == actor.Email {
+				http.Error(w, "missing email", http.StatusBadRequest)
+				return
+			}
+			if _, err := dbpkg.GetAccount(dbConn, email); err != nil {
+				http.Error(w, "no account", http.StatusNotFound)
+				return
+			}
+			// staff pages would need the viewer's own permissions anyway
+			if len(admins.Roles(email)) > 0 {
+				http.Error(w, "cannot view as staff", http.StatusBadRequest)
+				return
+			}
+			if err := dbpkg.SetSessionViewAs(dbConn, p.Session.ID, email); err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			audit(dbConn, r, "user.view_as.start", email, nil, map[string]string{"session": sessionHandle(p.Session.ID)})
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "viewing_as": email})
+		case http.MethodDelete:
+			was := p.Session.ViewAs
+			if was == "" {
+				http.Error(w, "not viewing as anyone", http.StatusNotFound)
+				return
+			}
+			if err := dbpkg.SetSessionViewAs(dbConn, p.Session.ID, ""); err != nil {
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			audit(dbConn, r, "user.view_as.end", was, map[string]string{"session": sessionHandle(p.Session.ID)}, nil)
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,8 +11,6 @@ import (
 	dbpkg "sudocrypt25/db"
 	handlers "sudocrypt25/handlers"
 	routes "sudocrypt25/routes"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
@@ -43,7 +40,10 @@ func main() {
 			f.Close()
 		}
 	}
-	dbConn, err := sql.Open("sqlite3", "./data.db")
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	dbConn, err := dbpkg.Open(os.Getenv("DB_DRIVER"), os.Getenv("DB_DSN"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -51,7 +51,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	admins := handlers.NewAdmins(os.Getenv("ADMIN_EMAILS"))
+	if err := handlers.CheckAnswerSecret(); err != nil {
+		log.Fatal(err)
+	}
+	admins := handlers.NewAdmins(dbConn, os.Getenv("ADMIN_EMAILS"))
 	routes.InitRoutes(dbConn, admins)
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -62,6 +65,6 @@ func main() {
 	log.Fatal(http.ListenAndServeTLS("0.0.0.0:"+port,
 		"/etc/letsencrypt/live/sudocrypt.com/fullchain.pem",
         "/etc/letsencrypt/live/sudocrypt.com/privkey.pem",
-		 nil))
+		 handlers.CSRFMiddleware(http.DefaultServeMux)))
 }
 
@@ -0,0 +1,169 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltmpl "html/template"
+	"net/http"
+	"os"
+	"time"
+
+	dbpkg "sudocrypt25/db"
+	"sudocrypt25/handlers"
+	"sudocrypt25/template"
+)
+
+func signedIn(r *http.Request) bool {
+	return handlers.PrincipalFromContext(r.Context()) != nil
+}
+
+// viewingAs is the player a staff member is viewing the site as, for the
+// header banner.
+func viewingAs(r *http.Request) string {
+	if p := handlers.PrincipalFromContext(r.Context()); p != nil && p.Impersonator != nil {
+		return p.Email
+	}
+	return ""
+}
+
+func landingPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Redirect(w, r, "/404", http.StatusFound)
+		return
+	}
+	td := template.TemplateData{PageTitle: "Home", CurrentPath: r.URL.Path, TimeGateStart: handlers.Settings().Get("timegate_start"), IsAuthenticated: signedIn(r), ViewingAs: viewingAs(r)}
+	type sRaw struct {
+		ImageUrl string `json:"imageUrl"`
+		Alt      string `json:"alt"`
+		Link     string `json:"link"`
+		Height   string `json:"height"`
+	}
+	if b, err := os.ReadFile("components/assets/sponsors.json"); err == nil {
+		var arr []sRaw
+		if json.Unmarshal(b, &arr) == nil {
+			var out []template.Sponsor
+			for _, it := range arr {
+				out = append(out, template.Sponsor{ImageURL: it.ImageUrl, Link: it.Link, Alt: it.Alt, Height: it.Height})
+			}
+			td.Sponsors = out
+		}
+	}
+	if err := template.RenderTemplate(w, "landing", td); err != nil {
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+func authPage(w http.ResponseWriter, r *http.Request) {
+	td := template.TemplateData{PageTitle: "Auth", CurrentPath: r.URL.Path, TimeGateStart: handlers.Settings().Get("timegate_start"), IsAuthenticated: signedIn(r)}
+	if err := template.RenderTemplate(w, "auth", td); err != nil {
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+func notFoundPage(w http.ResponseWriter, r *http.Request) {
+	td := template.TemplateData{PageTitle: "Not Found", CurrentPath: r.URL.Path, IsAuthenticated: signedIn(r)}
+	if err := template.RenderFile(w, "components/404.html", td); err != nil {
+		fmt.Printf("render /404 failed: %v\n", err)
+		http.ServeFile(w, r, "components/404.html")
+	}
+}
+
+func timegatePage(w http.ResponseWriter, r *http.Request) {
+	phase := handlers.EventPhase()
+	isOver := phase == 1
+	isBefore := phase == -1
+	td := template.TemplateData{PageTitle: "Time Gate", CurrentPath: r.URL.Path, TimeGateStart: handlers.Settings().Get("timegate_start"), TimeGateEnd: handlers.Settings().Get("timegate_end"), IsAuthenticated: signedIn(r), IsEventOver: isOver, IsBeforeStart: isBefore, ViewingAs: viewingAs(r)}
+	if err := template.RenderFile(w, "components/timegate.html", td); err != nil {
+		http.ServeFile(w, r, "components/timegate.html")
+	}
+}
+
+func logout(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_ = handlers.DeleteSession(dbConn, r)
+		cookie := &http.Cookie{Name: "session_id", Value: "", Path: "/", HttpOnly: true, Expires: time.Unix(0, 0), MaxAge: -1}
+		http.SetCookie(w, cookie)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+// gated keeps players on the time gate page outside the event; staff who
+// playtest may come in any time.
+func gated(r *http.Request) bool {
+	return !handlers.IsTimeGateOpen() && !handlers.PrincipalFromContext(r.Context()).Can(dbpkg.PermLevelsPlaytest)
+}
+
+func playPage(dbConn dbpkg.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if gated(r) {
+			http.Redirect(w, r, "/timegate?toast=1&from=/play", http.StatusFound)
+			return
+		}
+		p := handlers.PrincipalFromContext(r.Context())
+		td := template.TemplateData{PageTitle: "Play", CurrentPath: r.URL.Path, IsAuthenticated: true, ShowAnnouncements: true, UserEmail: p.Email, ViewingAs: viewingAs(r)}
+		if acct, err := dbpkg.GetAccount(dbConn, p.Email); err == nil {
+			typ := r.URL.Query().Get("type")
+			if typ == "" {
+				typ = handlers.DefaultTrack()
+			}
+			td.Track = typ
+			for _, t := range handlers.VisibleTracks(p) {
+				td.Tracks = append(td.Tracks, template.TrackTab{ID: t.ID, Name: t.Name, Active: t.ID == typ})
+			}
+			curr := acct.Level(typ)
+			td.LevelNum = fmt.Sprintf("%d", curr)
+
+			levelID := fmt.Sprintf("%s-%d", typ, curr)
+			if !handlers.TrackEnabled(typ) && !p.Can(dbpkg.PermLevelsPlaytest) {
+				levelID = ""
+			}
+			if lvl, err := handlers.GetLevel(dbConn, levelID); err == nil && lvl != nil {
+				if lvl.SourceHint != "" {
+					td.SrcHint = htmltmpl.HTML("<!--" + lvl.SourceHint + "-->")
+				} else {
+					td.SrcHint = htmltmpl.HTML("")
+				}
+			}
+		}
+		if err := template.RenderTemplate(w, "play", td); err != nil {
+			http.ServeFile(w, r, "components/play/play.html")
+		}
+	}
+}
+
+func leaderboardPage(dbConn dbpkg.Store, admins *handlers.Admins) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if gated(r) {
+			http.Redirect(w, r, "/timegate?toast=1&from=/leaderboard", http.StatusFound)
+			return
+		}
+		td := template.TemplateData{PageTitle: "Leaderboard", CurrentPath: r.URL.Path, IsAuthenticated: true, ViewingAs: viewingAs(r)}
+		if html, err := handlers.GenerateLeaderboardHTML(dbConn, admins, handlers.PrincipalFromContext(r.Context()).Email); err == nil {
+			td.LeaderboardHTML = htmltmpl.HTML(html)
+		}
+		if err := template.RenderTemplate(w, "leaderboard", td); err != nil {
+			http.ServeFile(w, r, "components/leaderboard/leaderboard.html")
+		}
+	}
+}
+
+// levelsPage renders the admin and dashboard pages, which share the level
+// list. Answers are left out; authors reveal them one level at a time.
+func levelsPage(dbConn dbpkg.Store, title, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		td := template.TemplateData{PageTitle: title, CurrentPath: r.URL.Path, IsAuthenticated: true}
+		if !handlers.PrincipalFromContext(r.Context()).Can(dbpkg.PermLevelsRead) {
+			td.LevelsData = htmltmpl.JS("{}")
+		} else if html, js, err := handlers.GenerateAdminLevelsHTML(dbConn); err == nil {
+			td.LevelsHTML = htmltmpl.HTML(html)
+			td.LevelsData = htmltmpl.JS(js)
+		}
+		if err := template.RenderTemplate(w, name, td); err != nil {
+			http.ServeFile(w, r, "components/"+name+"/"+name+".html")
+		}
+	}
+}
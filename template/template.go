@@ -24,12 +24,21 @@ type TemplateData struct {
 	LevelsHTML        template.HTML
 	LevelsData        template.JS
 	LevelNum          string
-	LevelAnswerHash   string
 	UserEmail         string
+	ViewingAs         string
+	Track             string
+	Tracks            []TrackTab
 	SrcHint           template.HTML
 	Sponsors          []Sponsor
 }
 
+// TrackTab is a track the play page links to.
+type TrackTab struct {
+	ID     string
+	Name   string
+	Active bool
+}
+
 type Sponsor struct {
 	ImageURL string
 	Link     string